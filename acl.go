@@ -0,0 +1,23 @@
+package sunrpc
+
+import "net"
+
+// AccessDenyMode defines how a server replies to calls rejected by its access control function.
+type AccessDenyMode int
+
+const (
+	AccessDenyDrop      AccessDenyMode = iota // drop the call without replying
+	AccessDenyAuthError                       // reply with AUTH_ERROR (AUTH_TOOWEAK)
+)
+
+// AccessControlFunc decides whether a call from the specified remote address should be served,
+// similarly to what hosts.allow/hosts.deny do for the classic RPC daemons.
+type AccessControlFunc func(remote net.Addr, program, version, proc uint32) bool
+
+// SetAccessControl installs a function evaluated for each call before dispatching it (and before
+// authentication). Calls for which acl returns false are handled according to deny. It must
+// be called before the server is started.
+func (s *server) SetAccessControl(acl AccessControlFunc, deny AccessDenyMode) {
+	s.acl = acl
+	s.aclDeny = deny
+}
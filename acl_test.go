@@ -0,0 +1,54 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessControl(t *testing.T) {
+	for _, deny := range []AccessDenyMode{AccessDenyDrop, AccessDenyAuthError} {
+		s := NewTCPServer(0x20000001, 1)
+		s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+		s.Register(1, func(arg uint32, reply *uint32) error {
+			*reply = arg
+			return nil
+		})
+		var remote net.Addr
+		s.SetAccessControl(func(addr net.Addr, program, version, proc uint32) bool {
+			remote = addr
+			return proc != 1
+		}, deny)
+		ln, _, err := s.listen("127.0.0.1:0")
+		assert.Nil(t, err)
+		go s.serve(ln)
+
+		c := NewClient(ln.Addr().String(), 0x20000001, 1, &ClientConfig{Transport: ClientTransportTcpOnly})
+		c.SetCallTimeout(100 * time.Millisecond)
+
+		// Allowed calls are served, and the function gets the address of the caller
+		assert.Nil(t, c.Call(0, nil, nil))
+		if addr, ok := remote.(*net.TCPAddr); assert.True(t, ok) {
+			assert.True(t, addr.IP.IsLoopback())
+		}
+
+		// Denied calls are dropped or rejected, depending on the mode
+		var reply uint32
+		err = c.Call(1, uint32(1), &reply)
+		switch deny {
+		case AccessDenyDrop:
+			e, ok := err.(*TransportError)
+			assert.True(t, ok && e.Timeout(), "%v", err)
+		case AccessDenyAuthError:
+			if e, ok := err.(*RPCDeniedError); assert.True(t, ok, "%v", err) {
+				assert.Equal(t, AuthTooWeak, e.AuthStat)
+			}
+		}
+
+		c.Close()
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+}
@@ -0,0 +1,158 @@
+package sunrpc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes a call served, as recorded by an AuditSink.
+type AuditRecord struct {
+	Time      time.Time     // when the call was received
+	Duration  time.Duration // time spent serving the call
+	Remote    net.Addr      // address of the caller
+	Transport string        // "tcp", "udp", or the network of the connection (e.g. "pipe")
+	Xid       uint32
+	Program   uint32
+	Version   uint32
+	Procedure uint32
+
+	// Cred and Identity identify the caller, as in CallInfo. Cred is nil if the credentials
+	// could not be decoded, or if the call was rejected before they were.
+	Cred     interface{}
+	Identity *Identity
+
+	// Err is the result of the call: nil on success, otherwise an error with the types used
+	// by Client (see CallTracer). Status describes it in the terms of RFC 5531.
+	Err error
+
+	CallSize  int // size of the call message, in bytes
+	ReplySize int // size of the reply message, in bytes (for streamed replies, of the last fragment)
+}
+
+// AuditSink records the calls served by a server (see SetAuditSink). It is invoked after
+// each call is replied, on the goroutine which served it, and must thus be safe for
+// concurrent use, and return quickly.
+type AuditSink interface {
+	Audit(rec *AuditRecord)
+}
+
+// AuditFunc is an AuditSink calling a function.
+type AuditFunc func(rec *AuditRecord)
+
+func (f AuditFunc) Audit(rec *AuditRecord) { f(rec) }
+
+// SetAuditSink records the calls received by the server to sink (nil disables auditing). Like
+// with SetTracer, the calls which cannot be decoded are not recorded. It must be called before
+// the server is started.
+func (s *server) SetAuditSink(sink AuditSink) {
+	s.audit = sink
+}
+
+var acceptStatNames = map[AcceptType]string{
+	ProgUnavail:  "PROG_UNAVAIL",
+	ProgMismatch: "PROG_MISMATCH",
+	ProcUnavail:  "PROC_UNAVAIL",
+	GarbageArgs:  "GARBAGE_ARGS",
+	SystemErr:    "SYSTEM_ERR",
+}
+
+// Status returns the status of the call: "SUCCESS", the accept status (e.g. "PROC_UNAVAIL") or
+// reject status (e.g. "AUTH_ERROR") replied, "DROPPED" for calls which were not replied, or
+// "ERROR" when the reply could not be sent.
+func (rec *AuditRecord) Status() string {
+	switch e := rec.Err.(type) {
+	case nil:
+		return "SUCCESS"
+	case AcceptError:
+		if name, ok := acceptStatNames[e.AcceptStat()]; ok {
+			return name
+		}
+		return fmt.Sprintf("ACCEPT_STAT(%d)", e.AcceptStat())
+	case *RPCDeniedError:
+		if e.Stat == RpcMismatch {
+			return "RPC_MISMATCH"
+		}
+		return fmt.Sprintf("AUTH_ERROR(%v)", e.AuthStat)
+	case *ErrRpcMismatch:
+		return "RPC_MISMATCH"
+	case *ErrAuth:
+		return fmt.Sprintf("AUTH_ERROR(%v)", e.Stat)
+	}
+	if rec.Err == errCallDropped {
+		return "DROPPED"
+	}
+	return "ERROR"
+}
+
+// String formats the record as a line of key=value fields, without the time.
+func (rec *AuditRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "remote=%v transport=%v xid=%#x prog=%v vers=%v proc=%v",
+		addrString(rec.Remote), rec.Transport, rec.Xid, rec.Program, rec.Version, rec.Procedure)
+
+	switch cred := rec.Cred.(type) {
+	case AuthUnix:
+		fmt.Fprintf(&b, " cred=unix uid=%v gid=%v host=%q", cred.Uid, cred.Gid, cred.MachineName)
+	case AuthDH:
+		fmt.Fprintf(&b, " cred=dh netname=%q", cred.Netname)
+	case AuthNone:
+		b.WriteString(" cred=none")
+	case nil:
+	default:
+		fmt.Fprintf(&b, " cred=%q", fmt.Sprint(cred))
+	}
+	if rec.Identity != nil {
+		fmt.Fprintf(&b, " euid=%v egid=%v", rec.Identity.Uid, rec.Identity.Gid)
+	}
+
+	fmt.Fprintf(&b, " status=%v call=%v reply=%v duration=%v",
+		rec.Status(), rec.CallSize, rec.ReplySize, rec.Duration)
+	return b.String()
+}
+
+// AuditWriter is an AuditSink writing the records to an io.Writer (e.g. a file), one per line,
+// prefixed with their time in RFC 3339 format.
+type AuditWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditWriter creates an AuditSink writing to w.
+func NewAuditWriter(w io.Writer) *AuditWriter {
+	return &AuditWriter{w: w}
+}
+
+// OpenAuditFile creates an AuditSink appending to the file at path, which is created if needed.
+// It must be closed once the server is shut down.
+func OpenAuditFile(path string) (*AuditWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditWriter(f), nil
+}
+
+func (a *AuditWriter) Audit(rec *AuditRecord) {
+	line := rec.Time.Format(time.RFC3339Nano) + " " + rec.String() + "\n"
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := io.WriteString(a.w, line); err != nil {
+		log.WithField("err", err).Error("Unable to write audit record")
+	}
+}
+
+// Close closes the underlying writer, if it is an io.Closer.
+func (a *AuditWriter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
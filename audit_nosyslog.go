@@ -0,0 +1,7 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package sunrpc
+
+// The system logger is not available: AuditSyslog is not defined.
+const syslogSupported = false
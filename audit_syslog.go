@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package sunrpc
+
+import "log/syslog"
+
+const syslogSupported = true
+
+// AuditSyslog is an AuditSink sending the records to the system logger: calls which succeeded
+// are logged with the LOG_INFO severity, the other ones with LOG_NOTICE.
+type AuditSyslog struct {
+	w *syslog.Writer
+}
+
+// NewAuditSyslog connects to the system logger, to log the records with the specified facility
+// (e.g. syslog.LOG_AUTH) and tag (if empty, the name of the program).
+func NewAuditSyslog(facility syslog.Priority, tag string) (*AuditSyslog, error) {
+	w, err := syslog.New(facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditSyslog{w: w}, nil
+}
+
+func (a *AuditSyslog) Audit(rec *AuditRecord) {
+	var err error
+	if rec.Err == nil {
+		err = a.w.Info(rec.String())
+	} else {
+		err = a.w.Notice(rec.String())
+	}
+	if err != nil {
+		log.WithField("err", err).Error("Unable to log audit record")
+	}
+}
+
+// Close disconnects from the system logger.
+func (a *AuditSyslog) Close() error {
+	return a.w.Close()
+}
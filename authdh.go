@@ -0,0 +1,560 @@
+package sunrpc
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// AUTH_DH (formerly AUTH_DES) authentication, as described in RFC 2695.
+//
+// Both peers own a Diffie-Hellman key pair over the well-known 192-bit modulus used by
+// Secure RPC; public keys are usually published in the "publickey" NIS map, keyed by the
+// netname of the principal (e.g. "unix.1000@example.com"). The client sends a random DES
+// conversation key encrypted with the common key, and every call carries an encrypted
+// timestamp which the server checks against a validity window.
+
+var (
+	authDHModulus, _ = new(big.Int).SetString("d4a0ba0250b6fd2ec626e7efd637df76c716e22d0944b88b", 16)
+	authDHBase       = big.NewInt(3)
+)
+
+const (
+	authDHKeyBytes      = 24 // 192 bits
+	authDHMaxNetname    = 255
+	authDHMaxSessions   = 1024
+	authDHDefaultWindow = 60 * time.Second
+	authDHMaxWindow     = 5 * time.Minute
+)
+
+// Kind of AUTH_DH credential
+const (
+	authDHFullname = 0
+	authDHNickname = 1
+)
+
+type authDHCred struct {
+	Namekind uint32 `xdr:"union"`
+	Fullname struct {
+		Name   string
+		Key    [8]byte // conversation key, encrypted with the common key
+		Window [4]byte // encrypted window (W1)
+	} `xdr:"unioncase=0"`
+	Nickname uint32 `xdr:"unioncase=1"`
+}
+
+type authDHVerf struct {
+	Timestamp [8]byte // encrypted timestamp
+	W         [4]byte // encrypted window minus one (W2) for fullname, zero for nickname
+}
+
+type authDHServerVerf struct {
+	Timestamp [8]byte // encrypted client timestamp minus one second
+	Nickname  uint32
+}
+
+// GenerateAuthDHKey generates a new AUTH_DH key pair.
+func GenerateAuthDHKey() (secret, public *big.Int, err error) {
+	secret, err = rand.Int(rand.Reader, authDHModulus)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, AuthDHPublicKey(secret), nil
+}
+
+// AuthDHPublicKey computes the public key matching the given secret key.
+func AuthDHPublicKey(secret *big.Int) *big.Int {
+	return new(big.Int).Exp(authDHBase, secret, authDHModulus)
+}
+
+// ParseAuthDHKey parses a key in the hexadecimal format used by the publickey database.
+func ParseAuthDHKey(s string) (*big.Int, error) {
+	k, ok := new(big.Int).SetString(s, 16)
+	if !ok || k.Sign() <= 0 || k.Cmp(authDHModulus) >= 0 {
+		return nil, fmt.Errorf("invalid AUTH_DH key: %q", s)
+	}
+	return k, nil
+}
+
+// AuthDHNetname returns the netname of a UNIX user in the specified domain.
+func AuthDHNetname(uid uint32, domain string) string {
+	return fmt.Sprintf("unix.%d@%s", uid, domain)
+}
+
+// authDHCommonKey derives the DES key shared by the owners of the two key pairs. As done by
+// keyserv, the key is extracted from the middle 64 bits of the 192-bit common secret, least
+// significant byte first.
+func authDHCommonKey(secret, public *big.Int) [8]byte {
+	var common [authDHKeyBytes]byte
+	b := new(big.Int).Exp(public, secret, authDHModulus).Bytes()
+	copy(common[authDHKeyBytes-len(b):], b)
+
+	var key [8]byte
+	for i := range key {
+		key[i] = common[15-i]
+	}
+	desSetParity(key[:])
+	return key
+}
+
+// desSetParity sets odd parity on each byte of a DES key.
+func desSetParity(key []byte) {
+	for i, b := range key {
+		b &^= 1
+		ones := 0
+		for x := b; x != 0; x >>= 1 {
+			ones += int(x & 1)
+		}
+		if ones%2 == 0 {
+			b |= 1
+		}
+		key[i] = b
+	}
+}
+
+func desECB(key [8]byte, data []byte, encrypt bool) error {
+	block, err := des.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	for i := 0; i+des.BlockSize <= len(data); i += des.BlockSize {
+		if encrypt {
+			block.Encrypt(data[i:], data[i:])
+		} else {
+			block.Decrypt(data[i:], data[i:])
+		}
+	}
+	return nil
+}
+
+func desCBC(key [8]byte, data []byte, encrypt bool) error {
+	block, err := des.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, des.BlockSize)
+	if encrypt {
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	} else {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	}
+	return nil
+}
+
+func putTimestamp(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()/1000))
+}
+
+func getTimestamp(b []byte) time.Time {
+	sec := binary.BigEndian.Uint32(b[0:])
+	usec := binary.BigEndian.Uint32(b[4:])
+	return time.Unix(int64(sec), int64(usec)*1000)
+}
+
+//
+// Client
+//
+
+// ClientAuthDH implements the AUTH_DH flavor for Client.
+//
+// The first call carries the full name of the client and the encrypted conversation key;
+// the server then assigns a nickname which is used for subsequent calls. If the server
+// forgets the nickname (or rejects the timestamp), the client restarts from the full name.
+type ClientAuthDH struct {
+	netname string
+	window  time.Duration
+	common  [8]byte // common key between client and server
+	convKey [8]byte // conversation key
+
+	mu       sync.Mutex
+	nickname uint32
+	hasNick  bool
+	lastTime time.Time
+}
+
+// NewClientAuthDH creates an AUTH_DH flavor for the client identified by netname and its
+// secret key, talking to a server with the specified public key. window is the lifetime of
+// each credential (default: 60 seconds) and should account for clock skew between the hosts.
+func NewClientAuthDH(netname string, secret, serverPublic *big.Int, window time.Duration) (*ClientAuthDH, error) {
+	if len(netname) > authDHMaxNetname {
+		return nil, errors.New("AUTH_DH netname too long")
+	}
+	if window <= 0 {
+		window = authDHDefaultWindow
+	}
+
+	a := &ClientAuthDH{
+		netname: netname,
+		window:  window,
+		common:  authDHCommonKey(secret, serverPublic),
+	}
+	if _, err := rand.Read(a.convKey[:]); err != nil {
+		return nil, err
+	}
+	desSetParity(a.convKey[:])
+	return a, nil
+}
+
+func (a *ClientAuthDH) Credentials() (OpaqueAuth, OpaqueAuth, error) {
+	return a.credentials(time.Now())
+}
+
+// credentials implements Credentials, for a call made at now.
+func (a *ClientAuthDH) credentials(now time.Time) (OpaqueAuth, OpaqueAuth, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Timestamps must be strictly increasing, or the server will flag a replay
+	now = now.Truncate(time.Microsecond)
+	if !now.After(a.lastTime) {
+		now = a.lastTime.Add(time.Microsecond)
+	}
+	a.lastTime = now
+
+	var cred authDHCred
+	var verf authDHVerf
+
+	if a.hasNick {
+		cred.Namekind = authDHNickname
+		cred.Nickname = a.nickname
+
+		putTimestamp(verf.Timestamp[:], now)
+		if err := desECB(a.convKey, verf.Timestamp[:], true); err != nil {
+			return OpaqueAuth{}, OpaqueAuth{}, err
+		}
+	} else {
+		window := uint32(a.window / time.Second)
+
+		var block [16]byte
+		putTimestamp(block[0:], now)
+		binary.BigEndian.PutUint32(block[8:], window)
+		binary.BigEndian.PutUint32(block[12:], window-1)
+		if err := desCBC(a.convKey, block[:], true); err != nil {
+			return OpaqueAuth{}, OpaqueAuth{}, err
+		}
+
+		cred.Namekind = authDHFullname
+		cred.Fullname.Name = a.netname
+		cred.Fullname.Key = a.convKey
+		if err := desECB(a.common, cred.Fullname.Key[:], true); err != nil {
+			return OpaqueAuth{}, OpaqueAuth{}, err
+		}
+		copy(cred.Fullname.Window[:], block[8:12])
+		copy(verf.Timestamp[:], block[0:8])
+		copy(verf.W[:], block[12:16])
+	}
+
+	var cbuf, vbuf bytes.Buffer
+	if _, err := xdr.Marshal(&cbuf, &cred); err != nil {
+		return OpaqueAuth{}, OpaqueAuth{}, err
+	}
+	if _, err := xdr.Marshal(&vbuf, &verf); err != nil {
+		return OpaqueAuth{}, OpaqueAuth{}, err
+	}
+
+	return OpaqueAuth{Flavor: AuthFlavorDes, Body: cbuf.Bytes()},
+		OpaqueAuth{Flavor: AuthFlavorDes, Body: vbuf.Bytes()}, nil
+}
+
+func (a *ClientAuthDH) ValidateVerifier(verf OpaqueAuth) error {
+	if verf.Flavor != AuthFlavorDes {
+		return errors.New("unexpected verifier flavor for AUTH_DH")
+	}
+
+	var sv authDHServerVerf
+	if _, err := xdr.Unmarshal(bytes.NewReader(verf.Body), &sv); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := desECB(a.convKey, sv.Timestamp[:], false); err != nil {
+		return err
+	}
+
+	// The server must echo our timestamp minus one second
+	if !getTimestamp(sv.Timestamp[:]).Equal(a.lastTime.Add(-time.Second)) {
+		return errors.New("AUTH_DH timestamp mismatch")
+	}
+
+	a.nickname = sv.Nickname
+	a.hasNick = true
+	return nil
+}
+
+// Refresh resets the nickname so that the next call will carry the full name again.
+func (a *ClientAuthDH) Refresh(stat AuthStat) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.hasNick {
+		return false
+	}
+	switch stat {
+	case AuthBadCred, AuthRejectedCred, AuthRejectedVerf:
+		a.hasNick = false
+		return true
+	}
+	return false
+}
+
+//
+// Server
+//
+
+// AuthDHKeyStore gives access to the public keys of AUTH_DH clients.
+type AuthDHKeyStore interface {
+	PublicKey(netname string) (*big.Int, error)
+}
+
+// AuthDHKeyMap is a static AuthDHKeyStore mapping netnames to public keys.
+type AuthDHKeyMap map[string]*big.Int
+
+func (m AuthDHKeyMap) PublicKey(netname string) (*big.Int, error) {
+	if k, found := m[netname]; found {
+		return k, nil
+	}
+	return nil, fmt.Errorf("no public key for %q", netname)
+}
+
+// authDHConversation identifies the conversation key of a client.
+type authDHConversation struct {
+	netname string
+	key     [8]byte
+}
+
+// authDHReplay identifies a fullname credential, to detect replays.
+type authDHReplay struct {
+	authDHConversation
+	stamp time.Time
+}
+
+type authDHSession struct {
+	authDHConversation
+	window   time.Duration
+	lastTime time.Time
+}
+
+// AuthDHServer verifies AUTH_DH credentials on behalf of a server. See SetAuthDH.
+type AuthDHServer struct {
+	// MaxWindow caps the lifetime of the credentials, which is chosen by the clients (default:
+	// 5 minutes). Larger windows are reduced to it.
+	MaxWindow time.Duration
+
+	secret *big.Int
+	keys   AuthDHKeyStore
+
+	mu       sync.Mutex
+	sessions map[uint32]*authDHSession
+	byKey    map[authDHConversation]uint32 // nicknames of the sessions
+	order    []uint32
+	nextNick uint32
+
+	// Fullname credentials received recently, until their timestamp expires (like the replay
+	// cache of the Solaris implementation), so that they cannot be replayed once their session
+	// is evicted
+	replays     map[authDHReplay]time.Time
+	replayOrder []authDHReplay
+}
+
+// NewAuthDHServer creates a verifier for AUTH_DH credentials, using the secret key of the
+// server and a store to look up the public keys of clients.
+func NewAuthDHServer(secret *big.Int, keys AuthDHKeyStore) *AuthDHServer {
+	return &AuthDHServer{
+		secret:   secret,
+		keys:     keys,
+		sessions: make(map[uint32]*authDHSession),
+		byKey:    make(map[authDHConversation]uint32),
+		replays:  make(map[authDHReplay]time.Time),
+	}
+}
+
+// verify checks an AUTH_DH credential/verifier pair. It returns the identity of the caller and
+// the verifier to send back, or the auth_stat to reject the call with.
+func (s *AuthDHServer) verify(credAuth, verfAuth OpaqueAuth) (AuthDH, OpaqueAuth, AuthStat) {
+	return s.verifyAt(credAuth, verfAuth, time.Now())
+}
+
+// verifyAt implements verify, for a call received at now.
+func (s *AuthDHServer) verifyAt(credAuth, verfAuth OpaqueAuth, now time.Time) (AuthDH, OpaqueAuth, AuthStat) {
+	var cred authDHCred
+	var verf authDHVerf
+
+	if _, err := xdr.Unmarshal(bytes.NewReader(credAuth.Body), &cred); err != nil {
+		return AuthDH{}, OpaqueAuth{}, AuthBadCred
+	}
+	if verfAuth.Flavor != AuthFlavorDes {
+		return AuthDH{}, OpaqueAuth{}, AuthBadVerf
+	}
+	if _, err := xdr.Unmarshal(bytes.NewReader(verfAuth.Body), &verf); err != nil {
+		return AuthDH{}, OpaqueAuth{}, AuthBadVerf
+	}
+
+	var sess *authDHSession
+	var stamp time.Time
+	var nick uint32
+
+	switch cred.Namekind {
+	case authDHFullname:
+		if len(cred.Fullname.Name) > authDHMaxNetname {
+			return AuthDH{}, OpaqueAuth{}, AuthBadCred
+		}
+		public, err := s.keys.PublicKey(cred.Fullname.Name)
+		if err != nil {
+			return AuthDH{}, OpaqueAuth{}, AuthBadCred
+		}
+
+		key := cred.Fullname.Key
+		if err := desECB(authDHCommonKey(s.secret, public), key[:], false); err != nil {
+			return AuthDH{}, OpaqueAuth{}, AuthBadCred
+		}
+
+		var block [16]byte
+		copy(block[0:], verf.Timestamp[:])
+		copy(block[8:], cred.Fullname.Window[:])
+		copy(block[12:], verf.W[:])
+		if err := desCBC(key, block[:], false); err != nil {
+			return AuthDH{}, OpaqueAuth{}, AuthBadCred
+		}
+
+		window := binary.BigEndian.Uint32(block[8:])
+		if binary.BigEndian.Uint32(block[12:]) != window-1 {
+			// wrong key, most likely
+			return AuthDH{}, OpaqueAuth{}, AuthBadCred
+		}
+
+		stamp = getTimestamp(block[0:])
+		conv := authDHConversation{netname: cred.Fullname.Name, key: key}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// A client which lost its nickname resumes its session, if it is still known:
+		// the timestamp must then follow the ones seen in the session
+		var found bool
+		if nick, found = s.byKey[conv]; found {
+			sess = s.sessions[nick]
+		} else {
+			sess = &authDHSession{
+				authDHConversation: conv,
+				window:             s.clampWindow(time.Duration(window) * time.Second),
+			}
+		}
+		if !s.checkTimestamp(sess, stamp, now) || !s.addReplay(authDHReplay{conv, stamp}, sess.window, now) {
+			return AuthDH{}, OpaqueAuth{}, AuthRejectedVerf
+		}
+		if !found {
+			nick = s.addSession(sess)
+		}
+
+	case authDHNickname:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		nick = cred.Nickname
+		var found bool
+		if sess, found = s.sessions[nick]; !found {
+			return AuthDH{}, OpaqueAuth{}, AuthBadCred
+		}
+
+		ts := verf.Timestamp
+		if err := desECB(sess.key, ts[:], false); err != nil {
+			return AuthDH{}, OpaqueAuth{}, AuthBadVerf
+		}
+		stamp = getTimestamp(ts[:])
+		if !s.checkTimestamp(sess, stamp, now) {
+			return AuthDH{}, OpaqueAuth{}, AuthRejectedVerf
+		}
+
+	default:
+		return AuthDH{}, OpaqueAuth{}, AuthBadCred
+	}
+
+	sv := authDHServerVerf{Nickname: nick}
+	putTimestamp(sv.Timestamp[:], stamp.Add(-time.Second))
+	if err := desECB(sess.key, sv.Timestamp[:], true); err != nil {
+		return AuthDH{}, OpaqueAuth{}, AuthFailed
+	}
+
+	var buf bytes.Buffer
+	if _, err := xdr.Marshal(&buf, &sv); err != nil {
+		return AuthDH{}, OpaqueAuth{}, AuthFailed
+	}
+
+	return AuthDH{Netname: sess.netname}, OpaqueAuth{Flavor: AuthFlavorDes, Body: buf.Bytes()}, AuthOk
+}
+
+// checkTimestamp verifies that a timestamp is within the window of the session, and that it
+// is not a replay of a previous one.
+func (s *AuthDHServer) checkTimestamp(sess *authDHSession, stamp, now time.Time) bool {
+	if stamp.Before(now.Add(-sess.window)) || stamp.After(now.Add(sess.window)) {
+		return false
+	}
+	if !stamp.After(sess.lastTime) {
+		return false
+	}
+	sess.lastTime = stamp
+	return true
+}
+
+// clampWindow reduces the window requested by a client to the maximum allowed by the server.
+func (s *AuthDHServer) clampWindow(window time.Duration) time.Duration {
+	max := s.MaxWindow
+	if max <= 0 {
+		max = authDHMaxWindow
+	}
+	if window > max {
+		return max
+	}
+	return window
+}
+
+// addSession stores a session under a new nickname, evicting the oldest one if needed. The
+// caller must hold s.mu.
+func (s *AuthDHServer) addSession(sess *authDHSession) uint32 {
+	if len(s.order) >= authDHMaxSessions {
+		if old := s.sessions[s.order[0]]; old != nil {
+			delete(s.byKey, old.authDHConversation)
+		}
+		delete(s.sessions, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.nextNick++
+	s.sessions[s.nextNick] = sess
+	s.byKey[sess.authDHConversation] = s.nextNick
+	s.order = append(s.order, s.nextNick)
+	return s.nextNick
+}
+
+// addReplay records a fullname credential until its timestamp expires, returning false if it
+// was already received. The caller must hold s.mu.
+func (s *AuthDHServer) addReplay(r authDHReplay, window time.Duration, now time.Time) bool {
+	if _, found := s.replays[r]; found {
+		return false
+	}
+
+	// Forget the expired credentials (and the oldest ones, if there are too many)
+	for len(s.replayOrder) > 0 {
+		first := s.replayOrder[0]
+		if expiry, found := s.replays[first]; found && now.Before(expiry) && len(s.replayOrder) < authDHMaxSessions {
+			break
+		}
+		delete(s.replays, first)
+		s.replayOrder = s.replayOrder[1:]
+	}
+
+	s.replays[r] = r.stamp.Add(window)
+	s.replayOrder = append(s.replayOrder, r)
+	return true
+}
@@ -0,0 +1,181 @@
+package sunrpc
+
+import (
+	"context"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Secret keys of the tests; the expected values below were computed independently (with
+// Python and OpenSSL).
+var (
+	authDHTestClientSecret    = big.NewInt(0x1234567890abcdef)
+	authDHTestServerSecret, _ = new(big.Int).SetString("fedcba0987654321", 16)
+)
+
+const authDHTestNetname = "unix.1000@example.com"
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestAuthDHCommonKey(t *testing.T) {
+	clientPublic := AuthDHPublicKey(authDHTestClientSecret)
+	serverPublic := AuthDHPublicKey(authDHTestServerSecret)
+	assert.Equal(t, "5fccd2c19d0db3795366a00604b572e9563c0f96441ef82a", clientPublic.Text(16))
+	assert.Equal(t, "218eca6501ae3a62166cb17836c1fdb316619e91b9857913", serverPublic.Text(16))
+
+	key := authDHCommonKey(authDHTestClientSecret, serverPublic)
+	assert.Equal(t, unhex("bc4fcbbfa2add31a"), key[:])
+	assert.Equal(t, key, authDHCommonKey(authDHTestServerSecret, clientPublic))
+}
+
+func TestAuthDHDES(t *testing.T) {
+	var key [8]byte
+	copy(key[:], unhex("133457799bbcdff1"))
+
+	data := unhex("0123456789abcdef")
+	assert.Nil(t, desECB(key, data, true))
+	assert.Equal(t, unhex("85e813540f0ab405"), data)
+	assert.Nil(t, desECB(key, data, false))
+	assert.Equal(t, unhex("0123456789abcdef"), data)
+
+	data = unhex("5f5e10000001e2400000003c0000003b")
+	assert.Nil(t, desCBC(key, data, true))
+	assert.Nil(t, desCBC(key, data, false))
+	assert.Equal(t, unhex("5f5e10000001e2400000003c0000003b"), data)
+}
+
+func newTestClientAuthDH(window time.Duration) *ClientAuthDH {
+	a := &ClientAuthDH{
+		netname: authDHTestNetname,
+		window:  window,
+		common:  authDHCommonKey(authDHTestClientSecret, AuthDHPublicKey(authDHTestServerSecret)),
+	}
+	copy(a.convKey[:], unhex("133457799bbcdff1"))
+	return a
+}
+
+func newTestAuthDHServer() *AuthDHServer {
+	return NewAuthDHServer(authDHTestServerSecret, AuthDHKeyMap{
+		authDHTestNetname: AuthDHPublicKey(authDHTestClientSecret),
+	})
+}
+
+func TestAuthDHCredentialEncoding(t *testing.T) {
+	now := time.Unix(1600000000, 123456000)
+	client := newTestClientAuthDH(time.Minute)
+
+	cred, verf, err := client.credentials(now)
+	assert.Nil(t, err)
+	assert.Equal(t, AuthFlavorDes, cred.Flavor)
+	assert.Equal(t, unhex("0000000000000015756e69782e31303030406578616d706c652e636f6d000000"+
+		"e130e3d04e6a2043"+"c56f240a"), cred.Body)
+	assert.Equal(t, unhex("711ec2663d635a48"+"0cd31704"), verf.Body)
+
+	s := newTestAuthDHServer()
+	id, sv, stat := s.verifyAt(cred, verf, now)
+	assert.Equal(t, AuthOk, stat)
+	assert.Equal(t, authDHTestNetname, id.Netname)
+	assert.Equal(t, unhex("3c8731f78b18fa53"+"00000001"), sv.Body)
+
+	// The client checks the echoed timestamp, and switches to the nickname
+	assert.Nil(t, client.ValidateVerifier(sv))
+	cred, verf, err = client.credentials(now.Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, unhex("0000000100000001"), cred.Body)
+	_, _, stat = s.verifyAt(cred, verf, now.Add(time.Second))
+	assert.Equal(t, AuthOk, stat)
+
+	// Replayed nickname credential
+	_, _, stat = s.verifyAt(cred, verf, now.Add(2*time.Second))
+	assert.Equal(t, AuthRejectedVerf, stat)
+}
+
+func TestAuthDHFullnameReplay(t *testing.T) {
+	now := time.Now()
+	client := newTestClientAuthDH(time.Hour)
+	s := newTestAuthDHServer()
+
+	cred, verf, err := client.credentials(now)
+	assert.Nil(t, err)
+	_, _, stat := s.verifyAt(cred, verf, now)
+	assert.Equal(t, AuthOk, stat)
+
+	// The window requested by the client is clamped
+	if assert.Len(t, s.sessions, 1) {
+		assert.Equal(t, authDHMaxWindow, s.sessions[1].window)
+	}
+
+	// Replays are rejected, and do not take session slots
+	for i := 0; i < 3; i++ {
+		_, _, stat = s.verifyAt(cred, verf, now.Add(time.Second))
+		assert.Equal(t, AuthRejectedVerf, stat)
+	}
+	assert.Len(t, s.sessions, 1)
+
+	// Even once the session was evicted
+	s.mu.Lock()
+	delete(s.byKey, s.sessions[1].authDHConversation)
+	delete(s.sessions, 1)
+	s.mu.Unlock()
+	_, _, stat = s.verifyAt(cred, verf, now.Add(time.Second))
+	assert.Equal(t, AuthRejectedVerf, stat)
+
+	// A new fullname credential of the same client resumes its session
+	cred, verf, err = client.credentials(now.Add(2 * time.Second))
+	assert.Nil(t, err)
+	_, sv, stat := s.verifyAt(cred, verf, now.Add(2*time.Second))
+	assert.Equal(t, AuthOk, stat)
+	assert.Nil(t, client.ValidateVerifier(sv))
+	cred, verf, err = client.credentials(now.Add(3 * time.Second))
+	assert.Nil(t, err)
+	_, _, stat = s.verifyAt(cred, verf, now.Add(3*time.Second))
+	assert.Equal(t, AuthOk, stat)
+	assert.Len(t, s.sessions, 1)
+}
+
+func TestPipeAuthDH(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.SetAuthDH(newTestAuthDHServer())
+	s.Register(1, func(ctx context.Context, arg uint32, reply *string) error {
+		if cred, ok := CallInfoFromContext(ctx).Cred.(AuthDH); ok {
+			*reply = cred.Netname
+		}
+		return nil
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	auth, err := NewClientAuthDH(authDHTestNetname, authDHTestClientSecret, AuthDHPublicKey(authDHTestServerSecret), 0)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.SetAuth(auth)
+
+	for i := 0; i < 3; i++ {
+		var reply string
+		assert.Nil(t, c.Call(1, uint32(0), &reply))
+		assert.Equal(t, authDHTestNetname, reply)
+	}
+	assert.True(t, auth.hasNick)
+
+	// Unknown clients are rejected
+	other, err := NewClientAuthDH("unix.1001@example.com", authDHTestClientSecret, AuthDHPublicKey(authDHTestServerSecret), 0)
+	assert.Nil(t, err)
+	c.SetAuth(other)
+	err = c.Call(1, uint32(0), nil)
+	stat, ok := AuthErrorStat(err)
+	assert.True(t, ok)
+	assert.Equal(t, AuthBadCred, stat)
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
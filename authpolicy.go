@@ -0,0 +1,52 @@
+package sunrpc
+
+// AuthPolicy defines the authentication flavors accepted for the calls to a program. Calls using
+// other flavors are rejected with AUTH_ERROR (AUTH_TOOWEAK) before being dispatched.
+//
+// For instance, to require AUTH_UNIX for all procedures but the NULL one:
+//
+//	server.SetAuthPolicy(program, &sunrpc.AuthPolicy{
+//	    Flavors: []sunrpc.AuthFlavor{sunrpc.AuthFlavorUnix},
+//	    ProcFlavors: map[uint32][]sunrpc.AuthFlavor{
+//	        0: {sunrpc.AuthFlavorNone, sunrpc.AuthFlavorUnix},
+//	    },
+//	})
+//
+// AUTH_SHORT credentials are accepted wherever AUTH_UNIX is, since they stand for the AUTH_UNIX
+// credentials they were issued for.
+type AuthPolicy struct {
+	Flavors     []AuthFlavor            // flavors accepted by default (empty: any flavor)
+	ProcFlavors map[uint32][]AuthFlavor // flavors accepted by specific procedures
+}
+
+// allows reports whether a call to proc with the specified credential flavor is acceptable.
+func (p *AuthPolicy) allows(proc uint32, flavor AuthFlavor) bool {
+	flavors, found := p.ProcFlavors[proc]
+	if !found {
+		flavors = p.Flavors
+	}
+	if len(flavors) == 0 {
+		return true
+	}
+
+	if flavor == AuthFlavorShort {
+		flavor = AuthFlavorUnix
+	}
+	for _, f := range flavors {
+		if f == flavor {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAuthPolicy installs the authentication policy for the calls to the specified program.
+// A nil policy accepts any flavor (which is the default). Policies must be installed before
+// the server is started.
+func (s *server) SetAuthPolicy(program uint32, policy *AuthPolicy) {
+	if policy == nil {
+		delete(s.authPolicies, program)
+		return
+	}
+	s.authPolicies[program] = policy
+}
@@ -0,0 +1,59 @@
+package sunrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthPolicy(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	s.RegisterProgram(0x20000002, 1, map[uint32]interface{}{
+		1: func(arg uint32, reply *uint32) error { return nil },
+	})
+	s.SetAuthShortCache(NewAuthShortCache(16))
+	s.SetAuthPolicy(0x20000001, &AuthPolicy{
+		Flavors:     []AuthFlavor{AuthFlavorUnix},
+		ProcFlavors: map[uint32][]AuthFlavor{0: {AuthFlavorNone, AuthFlavorUnix}},
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+
+	// AUTH_NONE is only accepted by the NULL procedure, and by other programs
+	var reply uint32
+	assert.Nil(t, c.Call(0, nil, nil))
+	assert.Equal(t, &RPCDeniedError{Stat: AuthError, AuthStat: AuthTooWeak}, c.Call(1, uint32(1), &reply))
+	assert.Nil(t, c.CallProgram(0x20000002, 1, 1, uint32(1), &reply))
+
+	// AUTH_SHORT credentials are accepted wherever AUTH_UNIX is
+	auth := NewClientAuthUnix("host", 1000, 100, nil)
+	c.SetAuth(auth)
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	cred, _, _ := auth.Credentials()
+	assert.Equal(t, AuthFlavorShort, cred.Flavor)
+	assert.Nil(t, c.Call(1, uint32(2), &reply))
+	assert.Equal(t, uint32(2), reply)
+
+	c.Close()
+	s.Shutdown(context.Background())
+
+	// Removing the policy accepts any flavor again
+	s = NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error { return nil })
+	s.SetAuthPolicy(0x20000001, &AuthPolicy{Flavors: []AuthFlavor{AuthFlavorUnix}})
+	s.SetAuthPolicy(0x20000001, nil)
+	conn, err = Pipe(s, nil)
+	assert.Nil(t, err)
+	c = NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	assert.Nil(t, c.Call(1, uint32(3), &reply))
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
@@ -0,0 +1,164 @@
+package sunrpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// AuthShortCache stores the full credentials for which the server has issued an AUTH_SHORT
+// handle. Implementations must be safe for concurrent use.
+type AuthShortCache interface {
+	// Put returns the short-hand handle for the given full credential, allocating a new one
+	// if needed. Issuing the same handle for identical credentials is advised. On error, no
+	// AUTH_SHORT verifier is sent, and the client keeps using its full credential.
+	Put(cred OpaqueAuth) ([]byte, error)
+
+	// Get returns the full credential associated with a short-hand handle. It returns false
+	// if the handle is unknown or expired.
+	Get(handle []byte) (OpaqueAuth, bool)
+}
+
+type authShortEntry struct {
+	handle string
+	cred   OpaqueAuth
+}
+
+// authShortMemoryCache is an in-memory AuthShortCache that evicts the oldest entries when full.
+type authShortMemoryCache struct {
+	mu       sync.Mutex
+	size     int
+	byHandle map[string]*authShortEntry
+	byCred   map[string]*authShortEntry
+	order    []*authShortEntry
+}
+
+// NewAuthShortCache returns an in-memory AuthShortCache holding up to size credentials.
+// When the cache is full, the oldest handles are evicted; clients presenting them will be
+// asked to send their full credential again.
+func NewAuthShortCache(size int) AuthShortCache {
+	if size < 1 {
+		size = 1
+	}
+	return &authShortMemoryCache{
+		size:     size,
+		byHandle: make(map[string]*authShortEntry),
+		byCred:   make(map[string]*authShortEntry),
+	}
+}
+
+func credKey(cred OpaqueAuth) string {
+	return fmt.Sprintf("%d:%s", cred.Flavor, cred.Body)
+}
+
+func (c *authShortMemoryCache) Put(cred OpaqueAuth) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := credKey(cred)
+	if e, found := c.byCred[key]; found {
+		return []byte(e.handle), nil
+	}
+
+	var handle [8]byte
+	if _, err := rand.Read(handle[:]); err != nil {
+		return nil, err
+	}
+
+	if len(c.order) >= c.size {
+		old := c.order[0]
+		c.order = c.order[1:]
+		delete(c.byHandle, old.handle)
+		delete(c.byCred, credKey(old.cred))
+	}
+
+	e := &authShortEntry{
+		handle: string(handle[:]),
+		cred:   OpaqueAuth{Flavor: cred.Flavor, Body: append([]byte(nil), cred.Body...)},
+	}
+	c.byHandle[e.handle] = e
+	c.byCred[key] = e
+	c.order = append(c.order, e)
+	return handle[:], nil
+}
+
+func (c *authShortMemoryCache) Get(handle []byte) (OpaqueAuth, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.byHandle[string(handle)]
+	if !found {
+		return OpaqueAuth{}, false
+	}
+	return e.cred, true
+}
+
+// ClientAuthUnix implements the AUTH_UNIX (aka AUTH_SYS) flavor for Client.
+//
+// If the server replies with an AUTH_SHORT verifier, the short-hand credential is sent in
+// place of the full one on subsequent calls. When the server rejects a stale short-hand
+// credential, the client transparently retries the call with the full credential.
+type ClientAuthUnix struct {
+	Cred AuthUnix
+
+	mu    sync.Mutex
+	short []byte
+}
+
+// NewClientAuthUnix creates an AUTH_UNIX flavor for the specified identity.
+func NewClientAuthUnix(machineName string, uid, gid uint32, gids []uint32) *ClientAuthUnix {
+	return &ClientAuthUnix{
+		Cred: AuthUnix{
+			MachineName: machineName,
+			Uid:         uid,
+			Gid:         gid,
+			Gids:        gids,
+		},
+	}
+}
+
+func (a *ClientAuthUnix) Credentials() (OpaqueAuth, OpaqueAuth, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.short != nil {
+		return OpaqueAuth{Flavor: AuthFlavorShort, Body: a.short}, OpaqueAuth{}, nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := xdr.Marshal(&buf, &a.Cred); err != nil {
+		return OpaqueAuth{}, OpaqueAuth{}, err
+	}
+	return OpaqueAuth{Flavor: AuthFlavorUnix, Body: buf.Bytes()}, OpaqueAuth{}, nil
+}
+
+func (a *ClientAuthUnix) ValidateVerifier(verf OpaqueAuth) error {
+	switch verf.Flavor {
+	case AuthFlavorNone:
+		return nil
+	case AuthFlavorShort:
+		a.mu.Lock()
+		a.short = append([]byte(nil), verf.Body...)
+		a.mu.Unlock()
+		return nil
+	default:
+		return errors.New("unexpected verifier flavor for AUTH_UNIX")
+	}
+}
+
+// Refresh drops the short-hand credential (if any) after the server refused it. It returns
+// true if the call should be retried with the full credential.
+func (a *ClientAuthUnix) Refresh(stat AuthStat) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if stat != AuthRejectedCred || a.short == nil {
+		return false
+	}
+	a.short = nil
+	return true
+}
@@ -0,0 +1,137 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingShortCache is an AuthShortCache which cannot issue handles.
+type failingShortCache struct{}
+
+func (failingShortCache) Put(cred OpaqueAuth) ([]byte, error) {
+	return nil, errors.New("no entropy")
+}
+
+func (failingShortCache) Get(handle []byte) (OpaqueAuth, bool) {
+	return OpaqueAuth{}, false
+}
+
+// countingShortCache counts the handles issued by an AuthShortCache.
+type countingShortCache struct {
+	AuthShortCache
+	issued int
+}
+
+func (c *countingShortCache) Put(cred OpaqueAuth) ([]byte, error) {
+	c.issued++
+	return c.AuthShortCache.Put(cred)
+}
+
+func TestPipeAuthShort(t *testing.T) {
+	cache := NewAuthShortCache(1)
+	s := NewTCPServer(0x20000001, 1)
+	s.SetAuthShortCache(cache)
+	var creds []interface{}
+	s.SetAuth(func(proc uint32, cred interface{}) bool {
+		creds = append(creds, cred)
+		return true
+	})
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	auth := NewClientAuthUnix("host", 1000, 100, nil)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.SetAuth(auth)
+
+	// The first call carries the full credential, and obtains a short-hand one
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	cred, _, err := auth.Credentials()
+	assert.Nil(t, err)
+	assert.Equal(t, AuthFlavorShort, cred.Flavor)
+
+	// The short-hand credential is resolved into the full one
+	assert.Nil(t, c.Call(1, uint32(2), &reply))
+	assert.Equal(t, uint32(3), reply)
+
+	// Once evicted, the client transparently falls back to its full credential
+	_, err = cache.Put(OpaqueAuth{Flavor: AuthFlavorUnix, Body: []byte{0, 0, 0, 0}})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Call(1, uint32(3), &reply))
+	assert.Equal(t, uint32(4), reply)
+
+	full := AuthUnix{MachineName: "host", Uid: 1000, Gid: 100, Gids: []uint32{}}
+	assert.Equal(t, []interface{}{full, full, full}, creds)
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
+
+func TestPipeAuthShortUnavailable(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.SetAuthShortCache(failingShortCache{})
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	auth := NewClientAuthUnix("host", 1000, 100, nil)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.SetAuth(auth)
+
+	// Without a handle, no AUTH_SHORT verifier is sent and the full credential is kept
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.Equal(t, uint32(2), reply)
+	cred, _, err := auth.Credentials()
+	assert.Nil(t, err)
+	assert.Equal(t, AuthFlavorUnix, cred.Flavor)
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
+
+func TestPipeAuthShortRejected(t *testing.T) {
+	cache := &countingShortCache{AuthShortCache: NewAuthShortCache(16)}
+	s := NewTCPServer(0x20000001, 1)
+	s.SetAuthShortCache(cache)
+	s.SetAuth(func(proc uint32, cred interface{}) bool {
+		unix, ok := cred.(AuthUnix)
+		return ok && unix.Uid != 0
+	})
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	// A rejected credential doesn't get a handle
+	auth := NewClientAuthUnix("host", 0, 0, nil)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.SetAuth(auth)
+	var reply uint32
+	_, rejected := AuthErrorStat(c.Call(1, uint32(1), &reply))
+	assert.True(t, rejected)
+	assert.Equal(t, 0, cache.issued)
+	cred, _, err := auth.Credentials()
+	assert.Nil(t, err)
+	assert.Equal(t, AuthFlavorUnix, cred.Flavor)
+
+	// An accepted one does
+	c.SetAuth(NewClientAuthUnix("host", 1000, 100, nil))
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.Equal(t, 1, cache.issued)
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
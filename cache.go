@@ -0,0 +1,162 @@
+package sunrpc
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// ReplyCache is an LRU cache of the results of idempotent procedures, which lets clients
+// answer repeated lookups (e.g. the GETPORT procedure of the portmapper, or the EXPORT
+// procedure of MOUNT) without a round trip to the server. Results are cached by server
+// address, program, version, procedure and encoded arguments, for a limited time.
+//
+// Caching is opt-in: only the procedures declared with Cacheable are cached, and only their
+// successful replies. A cache can be shared by several clients (see ClientConfig.Cache).
+type ReplyCache struct {
+	size int
+	ttl  time.Duration
+
+	mu        sync.Mutex
+	cacheable map[progVers]map[uint32]bool
+	entries   map[string]*list.Element
+	lru       *list.List // most recently used first
+}
+
+type replyCacheEntry struct {
+	key     string
+	results []byte
+	expires time.Time
+}
+
+// NewReplyCache creates a cache holding up to size results, each for at most ttl.
+func NewReplyCache(size int, ttl time.Duration) *ReplyCache {
+	return &ReplyCache{
+		size:      size,
+		ttl:       ttl,
+		cacheable: make(map[progVers]map[uint32]bool),
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// Cacheable declares procedures of a program version whose results can be cached, because
+// calling them again with the same arguments returns the same results (until they expire).
+func (rc *ReplyCache) Cacheable(program, version uint32, procs ...uint32) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	pv := progVers{program, version}
+	if rc.cacheable[pv] == nil {
+		rc.cacheable[pv] = make(map[uint32]bool)
+	}
+	for _, proc := range procs {
+		rc.cacheable[pv][proc] = true
+	}
+}
+
+// Purge removes all the cached results, e.g. when the servers are known to have changed.
+func (rc *ReplyCache) Purge() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.entries = make(map[string]*list.Element)
+	rc.lru.Init()
+}
+
+// Len returns the number of cached results, including expired ones not evicted yet.
+func (rc *ReplyCache) Len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.lru.Len()
+}
+
+func (rc *ReplyCache) isCacheable(program, version, proc uint32) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.cacheable[progVers{program, version}][proc]
+}
+
+func (rc *ReplyCache) get(key string) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem := rc.entries[key]
+	if elem == nil {
+		return nil, false
+	}
+	entry := elem.Value.(*replyCacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.lru.Remove(elem)
+		delete(rc.entries, key)
+		return nil, false
+	}
+
+	rc.lru.MoveToFront(elem)
+	return entry.results, true
+}
+
+func (rc *ReplyCache) put(key string, results []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	entry := &replyCacheEntry{key: key, results: results, expires: time.Now().Add(rc.ttl)}
+	if elem := rc.entries[key]; elem != nil {
+		elem.Value = entry
+		rc.lru.MoveToFront(elem)
+		return
+	}
+
+	rc.entries[key] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.size {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*replyCacheEntry).key)
+	}
+}
+
+// replyCacheKey returns the key of the results of a call, and the encoded arguments.
+func replyCacheKey(addr string, program, version, proc uint32, args interface{}) (string, rawMessage, error) {
+	var buf bytes.Buffer
+	buf.WriteString(addr)
+
+	var ids [12]byte
+	binary.BigEndian.PutUint32(ids[0:], program)
+	binary.BigEndian.PutUint32(ids[4:], version)
+	binary.BigEndian.PutUint32(ids[8:], proc)
+	buf.Write(ids[:])
+
+	start := buf.Len()
+	if raw, ok := args.(rawMessage); ok {
+		buf.Write(raw)
+	} else if args != nil {
+		if _, err := xdr.Marshal(&buf, args); err != nil {
+			return "", nil, err
+		}
+	}
+	return buf.String(), rawMessage(buf.Bytes()[start:]), nil
+}
+
+// cachedCall performs a call to a cacheable procedure, through the cache.
+func (c *Client) cachedCall(ctx context.Context, program, version, proc uint32, args, reply interface{}) error {
+	key, encoded, err := replyCacheKey(c.Addr, program, version, proc, args)
+	if err != nil {
+		return err
+	}
+
+	results, found := c.cfg.Cache.get(key)
+	if !found {
+		var raw rawMessage
+		if err := c.callProgram(ctx, program, version, proc, encoded, &raw); err != nil {
+			return err
+		}
+		results = raw
+		c.cfg.Cache.put(key, results)
+	}
+	return decodeResults(bytes.NewReader(results), reply)
+}
@@ -0,0 +1,67 @@
+package sunrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyCache(t *testing.T) {
+	var calls int
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		calls++
+		*reply = arg * 2
+		return nil
+	})
+	s.Register(2, func(arg uint32, reply *uint32) error {
+		calls++
+		return nil
+	})
+
+	cache := NewReplyCache(2, 50*time.Millisecond)
+	cache.Cacheable(0x20000001, 1, 1)
+
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.cfg.Cache = cache
+
+	call := func(proc, arg uint32) uint32 {
+		var reply uint32
+		assert.Nil(t, c.Call(proc, arg, &reply))
+		return reply
+	}
+
+	assert.Equal(t, uint32(2), call(1, 1))
+	assert.Equal(t, uint32(2), call(1, 1))
+	assert.Equal(t, 1, calls)
+
+	// Other arguments, and procedures not declared cacheable, reach the server
+	assert.Equal(t, uint32(4), call(1, 2))
+	call(2, 1)
+	call(2, 1)
+	assert.Equal(t, 4, calls)
+
+	// The least recently used results are evicted first
+	call(1, 1)
+	call(1, 3)
+	assert.Equal(t, 5, calls)
+	assert.Equal(t, 2, cache.Len())
+	call(1, 1)
+	call(1, 2)
+	assert.Equal(t, 6, calls)
+
+	// Results expire
+	time.Sleep(60 * time.Millisecond)
+	call(1, 2)
+	assert.Equal(t, 7, calls)
+
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
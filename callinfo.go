@@ -0,0 +1,64 @@
+package sunrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+)
+
+// CallInfo describes the call being served. Procedures registered with a context.Context
+// as first argument can access it through CallInfoFromContext.
+type CallInfo struct {
+	Remote    net.Addr // address of the caller
+	Xid       uint32
+	Program   uint32
+	Version   uint32
+	Procedure uint32
+
+	// Cred holds the credentials of the caller: the decoded RPC credentials (AuthNone,
+	// AuthUnix, AuthDH), or whatever the Authenticator of the server mapped them to. It is nil
+	// if the credentials could not be decoded.
+	Cred interface{}
+
+	// Identity is the effective identity of AUTH_UNIX callers, when the server has squash
+	// rules (see SetSquashRules). It is nil otherwise.
+	Identity *Identity
+
+	// TLS is the state of the connection for calls received over TLS, and nil otherwise.
+	// PeerCertificates is the certificate chain presented by the client (if any).
+	TLS              *tls.ConnectionState
+	PeerCertificates []*x509.Certificate
+
+	// Conn holds the state of the client connection, for calls received over TCP. It is nil
+	// for transports without connections (UDP).
+	Conn *ConnState
+
+	fragment     func([]byte) error               // sends a reply fragment on stream transports
+	fragmentFrom func(r io.Reader, n int64) error // sends the next n bytes of r as a reply fragment
+	abandoned    *abandonedProc                   // set if the procedure was given up
+}
+
+type callInfoKey struct{}
+
+// CallInfoFromContext returns the CallInfo of the call being served, or nil if ctx was not
+// created by the server.
+func CallInfoFromContext(ctx context.Context) *CallInfo {
+	info, _ := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info
+}
+
+// Authenticator maps the identity of the caller to the credentials passed to the procedures.
+// It is invoked for each call with info.Cred set to the decoded RPC credentials, and typically
+// uses info.PeerCertificates to derive the credentials from the TLS client certificate (for
+// instance, to map its subject to an AuthUnix). A nil cred keeps the RPC credentials; an error
+// rejects the call with AUTH_BADCRED.
+type Authenticator func(info *CallInfo) (cred interface{}, err error)
+
+// SetAuthenticator installs the Authenticator of the server. The credentials it returns are
+// the ones passed to the function installed with SetAuth. It must be called before the
+// server is started.
+func (s *server) SetAuthenticator(auth Authenticator) {
+	s.authenticator = auth
+}
@@ -0,0 +1,54 @@
+package sunrpc
+
+import (
+	"net"
+	"runtime"
+	"sync"
+)
+
+// Capabilities describes the transport features available on the current platform. Features
+// which are not available degrade gracefully: the package builds and serves everywhere, but
+// the corresponding settings are ignored (with a warning) or fail.
+type Capabilities struct {
+	// SourcePinning reports whether UDPServer.SetSourcePinning is effective (IP_PKTINFO).
+	SourcePinning bool
+
+	// UnixSockets reports whether Unix domain sockets (the "local" netid) can be used.
+	UnixSockets bool
+
+	// IPv6 reports whether the host has IPv6 connectivity on the loopback interface (the
+	// "tcp6" and "udp6" netids).
+	IPv6 bool
+
+	// Syslog reports whether the system logger is available (AuditSyslog).
+	Syslog bool
+}
+
+var (
+	capsOnce sync.Once
+	caps     Capabilities
+)
+
+// PlatformCapabilities reports which transport features are available. Some of them are
+// probed the first time it is called.
+func PlatformCapabilities() Capabilities {
+	capsOnce.Do(func() {
+		caps = Capabilities{
+			SourcePinning: sourcePinningSupported,
+			UnixSockets:   runtime.GOOS != "plan9" && runtime.GOOS != "js",
+			IPv6:          probeIPv6(),
+			Syslog:        syslogSupported,
+		}
+	})
+	return caps
+}
+
+// probeIPv6 checks whether a socket can be bound to the IPv6 loopback address.
+func probeIPv6() bool {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
@@ -2,17 +2,21 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/rasky/go-xdr/xdr2"
+	"gopkg.in/Sirupsen/logrus.v0"
 )
 
-const ClientMaxRpcMessageSize = 32 * 1024
+// ClientMaxRpcMessageSize is the maximum size of the replies received by Client over UDP: the
+// largest UDP payload, so that replies are never truncated.
+const ClientMaxRpcMessageSize = MaxUdpSize
 
 type ClientTransport uint32
 
@@ -25,7 +29,49 @@ const (
 
 type ClientConfig struct {
 	Transport ClientTransport // transport to use (default: ClientTransportTcpUdp)
-	Timeout   time.Duration   // read/write timeout (default: 5 seconds)
+	Timeout   time.Duration   // call timeout (default: 5 seconds)
+	Auth      ClientAuth      // authentication flavor (default: AUTH_NONE)
+
+	// DialContext opens the connections to the server (default: net.Dialer.DialContext). It
+	// can be used to go through a proxy, or to bind a specific source address. network is
+	// either "tcp" or "udp".
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// LenientRecordMarkers makes the client tolerate record markers sent in the wrong byte
+	// order by broken servers (TCP only). Each occurrence is logged.
+	LenientRecordMarkers bool
+
+	// KeepAlive is the idle time after which the connection is checked by calling procedure 0
+	// (default: 0, no keepalive). See SetKeepAlive.
+	KeepAlive time.Duration
+
+	// ReadBuffer and WriteBuffer set the size of the socket buffers (SO_RCVBUF and SO_SNDBUF)
+	// of the connections, when non-zero. Raising ReadBuffer helps receiving large UDP
+	// replies, which are otherwise dropped when they exceed the default buffer size of the
+	// system. They are ignored for connections returned by DialContext which do not support
+	// them.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// MaxReplySize caps the size of the replies (0: no limit, besides the maximum size of a
+	// datagram or a record fragment). Calls receiving a larger reply fail with an
+	// ErrRecordTooLarge error: on TCP, the reply is detected as soon as its record markers
+	// exceed the cap, and it is read and discarded without being buffered, unless
+	// CloseOnLargeReply is set, in which case the connection is closed right away.
+	MaxReplySize      int
+	CloseOnLargeReply bool
+
+	// Tracer observes the calls performed by the client, including the pings done when
+	// connecting (default: none).
+	Tracer CallTracer
+
+	// Cache holds the results of the procedures declared cacheable, which are then not called
+	// again until they expire (default: none).
+	Cache *ReplyCache
+
+	// Compression enables the compression extension on TCP connections, when the server
+	// supports it too (default: none). See Compression.
+	Compression *CompressionConfig
 }
 
 type Client struct {
@@ -36,7 +82,16 @@ type Client struct {
 
 	mu           sync.Mutex
 	conn         net.Conn
+	proto        PortmapperProtocol // transport of conn
+	fromConn     bool               // conn was provided by the caller, so it cannot be redialed
 	disconnected bool
+	replyHints   map[uint32]int
+	lastUsed     time.Time   // end of the last call, for keepalives
+	keepAlive    *time.Timer // pending keepalive check, if any
+	stats        clientStats
+	compression  Compression // negotiated on conn
+	hooks        []SessionHook
+	resumed      bool // a session was started before
 }
 
 var clientBufPool = sync.Pool{
@@ -70,25 +125,106 @@ func NewClient(addr string, program, version uint32, cfg *ClientConfig) *Client
 	}
 }
 
+// NewClientFromConn creates a new RPC client talking to the specified program/version service
+// over an already established connection, for instance one obtained through a proxy or a
+// tunnel. proto tells whether conn must be treated as a stream (Tcp, with record marking) or
+// as a datagram (Udp) transport.
+//
+// The client takes ownership of conn, and closes it on Close. Since the client cannot dial
+// again, calls fail once the connection is broken.
+func NewClientFromConn(conn net.Conn, proto PortmapperProtocol, program, version uint32) *Client {
+	var addr string
+	if raddr := conn.RemoteAddr(); raddr != nil {
+		addr = raddr.String()
+	}
+
+	return &Client{
+		Addr:     addr,
+		Program:  program,
+		Version:  version,
+		cfg:      ClientConfig{Timeout: 5 * time.Second},
+		conn:     conn,
+		proto:    proto,
+		fromConn: true,
+	}
+}
+
 func (c *Client) Close() {
 	c.mu.Lock()
+	if c.keepAlive != nil {
+		c.keepAlive.Stop()
+	}
 	c.close()
 	c.mu.Unlock()
 }
 
+// SetCallTimeout changes the maximum time a call can take, including both sending the call
+// and waiting for the reply. Zero means no timeout.
+func (c *Client) SetCallTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	c.cfg.Timeout = timeout
+	c.mu.Unlock()
+}
+
+// SetAuth changes the authentication flavor used by the subsequent calls (nil: AUTH_NONE), e.g.
+// for clients created with NewClientFromConn.
+func (c *Client) SetAuth(auth ClientAuth) {
+	c.mu.Lock()
+	c.cfg.Auth = auth
+	c.mu.Unlock()
+}
+
+// SetReplySizeHint declares the expected size (in bytes) of the results of the specified
+// procedure of the client program, so that the receive buffer can be allocated upfront instead
+// of being grown while the reply is read. It is only a hint: larger replies are still accepted.
+func (c *Client) SetReplySizeHint(proc uint32, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replyHints == nil {
+		c.replyHints = make(map[uint32]int)
+	}
+	c.replyHints[proc] = size
+}
+
 // Call the specified proc in the RPC server, optionally passing some args, and receive
 // the reply body in reply.
 //
 // On top of network errors, err can be one of the errors defined in this package to signal
 // specific error conditions that callers might want to specifically handle.
 func (c *Client) Call(proc uint32, args, reply interface{}) (err error) {
-	return c.CallProgram(c.Program, c.Version, proc, args, reply)
+	return c.CallProgramContext(context.Background(), c.Program, c.Version, proc, args, reply)
 }
 
 // CallProgram is like Call, but allows to define a non-default program and version.
 func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply interface{}) error {
+	return c.CallProgramContext(context.Background(), program, version, proc, args, reply)
+}
+
+// CallContext is like Call, but the call is aborted when ctx is done. If ctx has a deadline
+// earlier than the call timeout of the client, it overrides it for this call.
+func (c *Client) CallContext(ctx context.Context, proc uint32, args, reply interface{}) error {
+	return c.CallProgramContext(ctx, c.Program, c.Version, proc, args, reply)
+}
+
+// CallProgramContext is like CallProgram, with the context semantics of CallContext.
+//
+// Calls are serialized: concurrent calls on the same Client wait for each other.
+func (c *Client) CallProgramContext(ctx context.Context, program, version uint32, proc uint32, args, reply interface{}) error {
+	if c.cfg.Cache != nil && c.cfg.Cache.isCacheable(program, version, proc) {
+		return c.cachedCall(ctx, program, version, proc, args, reply)
+	}
+	return c.callProgram(ctx, program, version, proc, args, reply)
+}
+
+// callProgram implements CallProgramContext, without the cache.
+func (c *Client) callProgram(ctx context.Context, program, version uint32, proc uint32, args, reply interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.scheduleKeepAlive()
+
 	if c.disconnected {
-		if err := c.reconnect(); err != nil {
+		if err := c.reconnect(ctx); err != nil {
 			return err
 		}
 		if proc == 0 {
@@ -97,27 +233,112 @@ func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply i
 		}
 	}
 
-	var useUdp bool
+	err := c.call(ctx, program, version, proc, args, reply)
+
+	// If the server rejected the credentials, retry once with refreshed ones
+	if e, ok := err.(*RPCDeniedError); ok && e.Stat == AuthError {
+		if a, ok := c.cfg.Auth.(RefreshableAuth); ok && a.Refresh(e.AuthStat) {
+			c.stats.retransmit()
+			err = c.call(ctx, program, version, proc, args, reply)
+		}
+	}
+
+	return err
+}
+
+// deadline returns the deadline for a call started now, combining the timeout configured
+// in the client with the deadline of ctx (if any). fromCtx reports whether the deadline of
+// ctx is the earliest one.
+func (c *Client) deadline(ctx context.Context) (deadline time.Time, fromCtx bool) {
+	if c.cfg.Timeout != 0 {
+		deadline = time.Now().Add(c.cfg.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		return d, true
+	}
+	return deadline, false
+}
+
+// call performs a single round-trip to the server. It must be called with c.mu held.
+func (c *Client) call(ctx context.Context, program, version uint32, proc uint32, args, reply interface{}) (err error) {
 	var buf bytes.Buffer
 
-	_, useUdp = c.conn.(*net.UDPConn)
+	var sent, received int
+	defer func() { c.stats.record(err, sent, received) }()
+
+	useUdp := c.proto == Udp
 
 	pcall := NewProcedureCall(program, version, proc)
+	if c.cfg.Tracer != nil {
+		transport := "tcp"
+		if useUdp {
+			transport = "udp"
+		}
+		_, end := c.cfg.Tracer(ctx, &TraceInfo{
+			Program:   program,
+			Version:   version,
+			Procedure: proc,
+			Xid:       pcall.Header.Xid,
+			Transport: transport,
+			Peer:      c.conn.RemoteAddr(),
+		})
+		defer func() { end(err) }()
+	}
+	if c.cfg.Auth != nil {
+		cred, verf, err := c.cfg.Auth.Credentials()
+		if err != nil {
+			return err
+		}
+		pcall.Body.Cred = cred
+		pcall.Body.Verf = verf
+	}
 	if _, err := xdr.Marshal(&buf, pcall); err != nil {
 		return err
 	}
 
 	// Write procedure arguments to the buffer (if any)
-	if args != nil {
+	if raw, ok := args.(rawMessage); ok {
+		buf.Write(raw)
+	} else if args != nil {
 		if _, err := xdr.Marshal(&buf, args); err != nil {
 			return err
 		}
 	}
 
-	// Set write timeout to avoid stalling forever
-	var zd time.Duration
-	if c.cfg.Timeout != zd {
-		c.conn.SetWriteDeadline(time.Now().Add(c.cfg.Timeout))
+	// Set a deadline for the whole call, to avoid stalling forever
+	conn := c.conn
+	deadline, ctxDeadline := c.deadline(ctx)
+	conn.SetDeadline(deadline)
+
+	// Report context errors rather than the I/O errors they caused
+	defer func() {
+		if err == nil {
+			return
+		}
+		if cerr := ctx.Err(); cerr != nil {
+			err = cerr
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() && ctxDeadline {
+			err = context.DeadlineExceeded
+		}
+	}()
+
+	// If the context can be canceled, abort pending I/O as soon as it is done
+	if done := ctx.Done(); done != nil {
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-done:
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			wg.Wait()
+		}()
 	}
 
 	// On TCP transport, we need to write a record marker
@@ -125,22 +346,28 @@ func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply i
 		// Because of a bug on the Linux implementation of rpcbind, we want
 		// to send the record marker and the payload in a single TCP segment
 		// if possible (so with a single conn.Write)
-		full := bytes.NewBuffer(make([]byte, 0, buf.Len()+4))
-		if err := WriteRecordMarker(full, uint32(buf.Len()), true); err != nil {
+		msg := buf.Bytes()
+		if c.compression != CompressionNone {
+			msg = compressRecord(c.compression, msg, c.cfg.Compression.minSize())
+		}
+		full := bytes.NewBuffer(make([]byte, 0, len(msg)+4))
+		if err := WriteRecordMarker(full, uint32(len(msg)), true); err != nil {
 			return err
 		}
-		io.Copy(full, &buf)
+		full.Write(msg)
 
 		// Send the payload
-		if _, err := c.conn.Write(full.Bytes()); err != nil {
+		sent = full.Len() - 4
+		if err := writeFull(conn, full.Bytes()); err != nil {
 			c.disconnected = true
-			return err
+			return &TransportError{Op: "write", Err: err}
 		}
 	} else {
 		// Send the payload
-		if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		sent = buf.Len()
+		if _, err := conn.Write(buf.Bytes()); err != nil {
 			c.disconnected = true
-			return err
+			return &TransportError{Op: "write", Err: err}
 		}
 	}
 
@@ -150,96 +377,178 @@ func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply i
 	// in fact, in that case, this is where we get an error if the UDP port
 	// was closed while sending).
 	var replyh ProcedureReply
-
-	if c.cfg.Timeout != zd {
-		c.conn.SetReadDeadline(time.Now().Add(c.cfg.Timeout))
-	}
-
 	var reader io.Reader
 
-	if _, ok := c.conn.(*net.UDPConn); !ok {
-		// On TCP transport, we need to read the record through different markers
-		if buf, err := ReadRecord(c.conn); err != nil {
-			c.disconnected = true
-			return err
-		} else {
-			reader = buf
-		}
-	} else {
+	var udpBuf *[]byte
+	if useUdp {
 		// On UDP, we need to read the whole answer through a single Read()
 		// call because it is a single datagram. Use a pool of buffers
 		// to speed up processing
-		buf := clientBufPool.Get().(*[]byte)
-		defer clientBufPool.Put(buf)
+		udpBuf = clientBufPool.Get().(*[]byte)
+		defer clientBufPool.Put(udpBuf)
+	}
 
-		if n, err := c.conn.Read(*buf); err != nil {
-			c.disconnected = true
-			return err
+	var hint int
+	if program == c.Program && version == c.Version {
+		hint = c.replyHints[proc]
+	}
+
+	for {
+		if !useUdp {
+			// On TCP transport, we need to read the record through different markers
+			var buf bytes.Buffer
+			if hint > 0 {
+				buf.Grow(replyHeaderSize + hint)
+			}
+			limits := RecordLimits{MaxSize: c.cfg.MaxReplySize, Discard: !c.cfg.CloseOnLargeReply}
+			err := readRecordInto(conn, &buf, c.swappedMarker(), limits)
+			received += buf.Len()
+			if err != nil {
+				if _, ok := err.(*ErrRecordTooLarge); ok {
+					if !limits.Discard {
+						c.close()
+					}
+					return err
+				}
+				c.disconnected = true
+				return &TransportError{Op: "read", Err: err}
+			}
+			reader = &buf
+			if c.compression != CompressionNone && isCompressedRecord(buf.Bytes()) {
+				msg, err := decompressRecord(buf.Bytes(), c.cfg.Compression.maxSize(c.cfg.MaxReplySize))
+				if err != nil {
+					c.disconnected = true
+					if _, ok := err.(*ErrRecordTooLarge); ok {
+						return err
+					}
+					return &ProtocolError{Err: err}
+				}
+				reader = bytes.NewReader(msg)
+			}
 		} else {
-			reader = bytes.NewReader((*buf)[:n])
+			n, err := conn.Read(*udpBuf)
+			received += n
+			if err != nil {
+				// A timeout doesn't invalidate a UDP socket: a late reply will simply
+				// be discarded by the next call.
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					c.disconnected = true
+				}
+				return &TransportError{Op: "read", Err: err}
+			} else if c.cfg.MaxReplySize > 0 && n > c.cfg.MaxReplySize {
+				if n >= 4 && binary.BigEndian.Uint32(*udpBuf) == pcall.Header.Xid {
+					return &ErrRecordTooLarge{Max: c.cfg.MaxReplySize}
+				}
+				continue // late reply to an earlier call
+			} else {
+				reader = bytes.NewReader((*udpBuf)[:n])
+			}
 		}
-	}
 
-	if _, err := xdr.Unmarshal(reader, &replyh); err != nil {
-		return err
-	}
+		if _, err := xdr.Unmarshal(reader, &replyh); err != nil {
+			return &ProtocolError{Err: err}
+		}
 
-	if replyh.Header.Xid != pcall.Header.Xid {
-		return errors.New("invalid Xid in reply")
+		// Replies to earlier calls that timed out might still be arriving: skip them
+		// until we get ours (or the deadline expires).
+		if replyh.Header.Xid == pcall.Header.Xid {
+			break
+		}
+		log.WithField("xid", replyh.Header.Xid).Debug("Discarding reply with unexpected Xid")
 	}
 
 	if replyh.Header.Type != Reply {
-		return errors.New("invalid reply type")
+		return &ProtocolError{Err: errors.New("invalid reply type")}
 	}
 
-	if replyh.Type != Accepted {
-		switch replyh.Rejected.Stat {
-		case RpcMismatch:
-			return &ErrRpcMismatch{High: replyh.Rejected.MismatchInfo.High, Low: replyh.Rejected.MismatchInfo.Low}
-		case AuthError:
-			return &ErrAuth{Stat: replyh.Rejected.AuthStat}
-		default:
-			c.disconnected = true
-			return fmt.Errorf("RPC reply has invalid wire format")
+	if replyh.Type == Accepted && c.cfg.Auth != nil {
+		// Let the authentication flavor check (and possibly consume) the server verifier
+		if err := c.cfg.Auth.ValidateVerifier(replyh.Accepted.Verf); err != nil {
+			return &ErrBadVerifier{Flavor: replyh.Accepted.Verf.Flavor, Err: err}
 		}
 	}
 
-	if replyh.Accepted.Stat != Success {
-		switch replyh.Accepted.Stat {
-		case ProgMismatch:
-			return &ErrProgMismatch{High: replyh.Accepted.MismatchInfo.High, Low: replyh.Accepted.MismatchInfo.Low}
-		case ProcUnavail:
-			return &ErrProcUnavail{}
-		case ProgUnavail:
-			return &ErrProgUnavail{}
-		case GarbageArgs:
-			return &ErrGarbageArgs{}
+	if err := replyError(&replyh); err != nil {
+		if _, ok := err.(*ProtocolError); ok {
+			c.disconnected = true
 		}
+		return err
 	}
 
 	// Everything is OK, read reply body (if any)
-	if reply != nil {
-		if _, err := xdr.Unmarshal(reader, reply); err != nil {
-			return err
+	return decodeResults(reader, reply)
+}
+
+// decodeResults decodes the results of a call into reply (if not nil).
+func decodeResults(r io.Reader, reply interface{}) error {
+	if d, ok := reply.(replyDecoder); ok {
+		if err := d.decodeReply(r); err != nil {
+			return &ProtocolError{Err: err}
+		}
+	} else if reply != nil {
+		if _, err := xdr.Unmarshal(r, reply); err != nil {
+			return &ProtocolError{Err: err}
 		}
 	}
-
 	return nil
 }
 
+// replyError converts a non successful reply into the matching error.
+func replyError(reply *ProcedureReply) error {
+	switch reply.Type {
+	case Accepted:
+		if reply.Accepted.Stat == Success {
+			return nil
+		}
+		return &RPCAcceptError{
+			Stat: reply.Accepted.Stat,
+			Low:  reply.Accepted.MismatchInfo.Low,
+			High: reply.Accepted.MismatchInfo.High,
+		}
+	case Denied:
+		switch reply.Rejected.Stat {
+		case RpcMismatch:
+			return &RPCDeniedError{
+				Stat: RpcMismatch,
+				Low:  reply.Rejected.MismatchInfo.Low,
+				High: reply.Rejected.MismatchInfo.High,
+			}
+		case AuthError:
+			return &RPCDeniedError{Stat: AuthError, AuthStat: reply.Rejected.AuthStat}
+		}
+	}
+	return &ProtocolError{Err: errors.New("RPC reply has invalid wire format")}
+}
+
+// swappedMarker returns the function reporting byte-swapped record markers, or nil if they
+// must not be tolerated.
+func (c *Client) swappedMarker() func(marker uint32) {
+	if !c.cfg.LenientRecordMarkers {
+		return nil
+	}
+	return func(marker uint32) {
+		log.WithFields(logrus.Fields{
+			"addr":   c.Addr,
+			"marker": marker,
+		}).Warn("Tolerating byte-swapped record marker")
+	}
+}
+
 func (c *Client) close() {
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
 	}
 	c.disconnected = true
+	c.compression = CompressionNone
 }
 
-func (c *Client) reconnect() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
+// reconnect opens a new connection to the server. It must be called with c.mu held.
+func (c *Client) reconnect(ctx context.Context) error {
 	c.close()
+	if c.fromConn {
+		return &TransportError{Op: "dial", Err: errors.New("connection to RPC server is closed")}
+	}
 
 	var prot []string
 	switch c.cfg.Transport {
@@ -253,13 +562,32 @@ func (c *Client) reconnect() error {
 		prot = []string{"tcp"}
 	}
 
+	dial := c.cfg.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+
+	lastErr := errors.New("cannot connect to RPC server")
 	for _, p := range prot {
-		conn, err := net.Dial(p, c.Addr)
+		conn, err := dial(ctx, p, c.Addr)
 		if err == nil {
+			c.stats.reconnect()
+			err = setSocketBuffers(conn, c.cfg.ReadBuffer, c.cfg.WriteBuffer)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			lastErr = err
+		} else {
 			c.conn = conn
+			c.proto = Tcp
+			if p == "udp" {
+				c.proto = Udp
+			}
 			c.disconnected = false
-			// Check with procedure 0, which is always reserved as a ping
-			if c.Call(0, nil, nil) == nil {
+			if lastErr = c.startSession(ctx); lastErr == nil {
 				return nil
 			}
 			c.conn = nil
@@ -268,5 +596,11 @@ func (c *Client) reconnect() error {
 		}
 	}
 
-	return errors.New("cannot connect to RPC server")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, ok := lastErr.(*TransportError); ok {
+		return lastErr
+	}
+	return &TransportError{Op: "dial", Err: lastErr}
 }
@@ -2,15 +2,20 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/rasky/go-xdr/xdr2"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestWriteCall(t *testing.T) {
 	var buf bytes.Buffer
 
-	err := WriteCall(&buf, PortmapperProgram, PortmapperVersion, PortmapperPortSet, mapping{
+	err := WriteCall(&buf, PortmapperProgram, PortmapperVersion, PortmapperPortSet, PortmapperMapping{
 		Program:  1,
 		Version:  1,
 		Protocol: Tcp,
@@ -30,3 +35,494 @@ func TestWriteCall(t *testing.T) {
 	assert.Equal(t, expected[0:4], buf.Bytes()[0:4]) // Test marker
 	assert.Equal(t, expected[8:], buf.Bytes()[8:])   // Then the rest of the payload, excluding the transaction id
 }
+
+func TestCallErrorClassification(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+
+	err = c.Call(1, nil, nil)
+	if e, ok := err.(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(ProcUnavail), e.Stat)
+	}
+	assert.True(t, errors.As(err, new(*ErrProcUnavail)))
+
+	err = c.CallProgram(0x20000001, 2, 1, nil, nil)
+	if e, ok := err.(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(ProgMismatch), e.Stat)
+	}
+	var mismatch *ErrProgMismatch
+	if assert.True(t, errors.As(err, &mismatch)) {
+		assert.Equal(t, &ErrProgMismatch{Low: 1, High: 1}, mismatch)
+	}
+
+	err = c.CallProgram(0x20000002, 1, 1, nil, nil)
+	assert.True(t, errors.As(err, new(*ErrProgUnavail)))
+
+	s.Shutdown(context.Background())
+	err = c.Call(1, nil, nil)
+	_, transport := err.(*TransportError)
+	assert.True(t, transport)
+}
+
+func TestCallAuthErrorStat(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		return nil
+	})
+	s.SetAuthPolicy(0x20000001, &AuthPolicy{Flavors: []AuthFlavor{AuthFlavorDes}})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	err = c.Call(1, uint32(0), nil)
+	stat, ok := AuthErrorStat(err)
+	assert.True(t, ok)
+	assert.Equal(t, AuthTooWeak, stat)
+	assert.False(t, stat.Refreshable())
+	assert.Equal(t, "RPC auth unsupported, found: AUTH_TOOWEAK", err.Error())
+
+	assert.True(t, RpcsecGssCtxProblem.Refreshable())
+	assert.Equal(t, "RPCSEC_GSS_CTXPROBLEM", RpcsecGssCtxProblem.String())
+	assert.Equal(t, "AUTH_STAT(99)", AuthStat(99).String())
+
+	var denied *RPCDeniedError
+	if assert.True(t, errors.As(err, &denied)) {
+		assert.Equal(t, RejectStat(AuthError), denied.RejectStat())
+		assert.Equal(t, AuthTooWeak, denied.AuthStat)
+	}
+	var legacy *ErrAuth
+	if assert.True(t, errors.As(err, &legacy)) {
+		assert.Equal(t, AuthTooWeak, legacy.Stat)
+	}
+
+	_, ok = AuthErrorStat(&RPCAcceptError{Stat: ProcUnavail})
+	assert.False(t, ok)
+	c.Close()
+	s.Shutdown(context.Background())
+}
+
+func TestCallRpcMismatch(t *testing.T) {
+	// A server which only supports version 3 of the RPC protocol
+	conn, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		record, err := ReadRecord(server)
+		if err != nil {
+			return
+		}
+		call, err := ReadProcedureCall(record)
+		if err != nil {
+			return
+		}
+		var reply bytes.Buffer
+		writeRejectedReply(&reply, call.Header.Xid, RpcMismatch, &MismatchInfo{Low: 3, High: 3})
+		WriteRecordMarker(server, uint32(reply.Len()), true)
+		server.Write(reply.Bytes())
+	}()
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	err := c.Call(1, nil, nil)
+	var denied *RPCDeniedError
+	if assert.True(t, errors.As(err, &denied), "%v", err) {
+		assert.Equal(t, RejectStat(RpcMismatch), denied.Stat)
+	}
+	var legacy *ErrRpcMismatch
+	if assert.True(t, errors.As(err, &legacy)) {
+		assert.Equal(t, &ErrRpcMismatch{Low: 3, High: 3}, legacy)
+	}
+	_, ok := AuthErrorStat(err)
+	assert.False(t, ok)
+	c.Close()
+}
+
+func TestReplyErrorTypes(t *testing.T) {
+	accepted := func(stat AcceptType) *ProcedureReply {
+		return &ProcedureReply{Type: Accepted, Accepted: AcceptedReplyBody{
+			Stat:         stat,
+			MismatchInfo: MismatchInfo{Low: 2, High: 3},
+		}}
+	}
+	rejected := func(stat RejectStat) *ProcedureReply {
+		return &ProcedureReply{Type: Denied, Rejected: RejectedReplyBody{
+			Stat:         stat,
+			MismatchInfo: MismatchInfo{Low: 2, High: 2},
+			AuthStat:     AuthBadCred,
+		}}
+	}
+
+	assert.Nil(t, replyError(accepted(Success)))
+	assert.Equal(t, &RPCAcceptError{Stat: SystemErr, Low: 2, High: 3}, replyError(accepted(SystemErr)))
+	assert.Equal(t, &RPCDeniedError{Stat: RpcMismatch, Low: 2, High: 2}, replyError(rejected(RpcMismatch)))
+	assert.Equal(t, &RPCDeniedError{Stat: AuthError, AuthStat: AuthBadCred}, replyError(rejected(AuthError)))
+
+	// The legacy errors are matched with errors.As
+	assert.True(t, errors.As(replyError(accepted(ProgUnavail)), new(*ErrProgUnavail)))
+	var mismatch *ErrProgMismatch
+	if assert.True(t, errors.As(replyError(accepted(ProgMismatch)), &mismatch)) {
+		assert.Equal(t, &ErrProgMismatch{Low: 2, High: 3}, mismatch)
+	}
+	assert.True(t, errors.As(replyError(accepted(ProcUnavail)), new(*ErrProcUnavail)))
+	assert.True(t, errors.As(replyError(accepted(GarbageArgs)), new(*ErrGarbageArgs)))
+	assert.Nil(t, errors.Unwrap(replyError(accepted(SystemErr))))
+	var rpcMismatch *ErrRpcMismatch
+	if assert.True(t, errors.As(replyError(rejected(RpcMismatch)), &rpcMismatch)) {
+		assert.Equal(t, &ErrRpcMismatch{Low: 2, High: 2}, rpcMismatch)
+	}
+	var auth *ErrAuth
+	if assert.True(t, errors.As(replyError(rejected(AuthError)), &auth)) {
+		assert.Equal(t, AuthBadCred, auth.Stat)
+	}
+
+	_, protocol := replyError(rejected(2)).(*ProtocolError)
+	assert.True(t, protocol)
+
+	for _, stat := range []AcceptType{ProgUnavail, ProgMismatch, ProcUnavail, GarbageArgs, SystemErr} {
+		if e, ok := replyError(accepted(stat)).(AcceptError); assert.True(t, ok) {
+			assert.Equal(t, stat, e.AcceptStat())
+		}
+	}
+	for _, stat := range []RejectStat{RpcMismatch, AuthError} {
+		if e, ok := replyError(rejected(stat)).(RejectError); assert.True(t, ok) {
+			assert.Equal(t, stat, e.RejectStat())
+		}
+	}
+}
+
+// stampAuth sends AUTH_UNIX credentials with a stamp, which is renewed on Refresh.
+type stampAuth struct {
+	stamp     uint32
+	refreshed []AuthStat
+}
+
+func (a *stampAuth) Credentials() (OpaqueAuth, OpaqueAuth, error) {
+	var buf bytes.Buffer
+	_, err := xdr.Marshal(&buf, &AuthUnix{Stamp: a.stamp})
+	return OpaqueAuth{Flavor: AuthFlavorUnix, Body: buf.Bytes()}, OpaqueAuth{}, err
+}
+
+func (a *stampAuth) ValidateVerifier(verf OpaqueAuth) error { return nil }
+
+func (a *stampAuth) Refresh(stat AuthStat) bool {
+	a.refreshed = append(a.refreshed, stat)
+	a.stamp++
+	return true
+}
+
+// noneAuth sends AUTH_NONE credentials, and only accepts AUTH_NONE reply verifiers.
+type noneAuth struct {
+	verfs []OpaqueAuth
+}
+
+func (a *noneAuth) Credentials() (OpaqueAuth, OpaqueAuth, error) {
+	return OpaqueAuth{}, OpaqueAuth{}, nil
+}
+
+func (a *noneAuth) ValidateVerifier(verf OpaqueAuth) error {
+	a.verfs = append(a.verfs, verf)
+	if verf.Flavor != AuthFlavorNone {
+		return errors.New("unexpected verifier")
+	}
+	return nil
+}
+
+func TestCallValidateVerifier(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	s.SetAuthShortCache(NewAuthShortCache(16))
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	auth := &noneAuth{}
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.SetAuth(auth)
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	if assert.Len(t, auth.verfs, 1) {
+		assert.Equal(t, AuthFlavorNone, auth.verfs[0].Flavor)
+	}
+
+	// The AUTH_SHORT verifier issued for AUTH_UNIX credentials is refused by the flavor
+	var buf bytes.Buffer
+	_, err = xdr.Marshal(&buf, &AuthUnix{MachineName: "host"})
+	assert.Nil(t, err)
+	c.SetAuth(&verfAuth{noneAuth: auth, cred: OpaqueAuth{Flavor: AuthFlavorUnix, Body: buf.Bytes()}})
+	err = c.Call(1, uint32(2), &reply)
+	if e, ok := err.(*ErrBadVerifier); assert.True(t, ok) {
+		assert.Equal(t, AuthFlavorShort, e.Flavor)
+		assert.Equal(t, "unexpected verifier", e.Err.Error())
+	}
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
+
+// verfAuth sends the specified credential, and validates verifiers like noneAuth.
+type verfAuth struct {
+	*noneAuth
+	cred OpaqueAuth
+}
+
+func (a *verfAuth) Credentials() (OpaqueAuth, OpaqueAuth, error) {
+	return a.cred, OpaqueAuth{}, nil
+}
+
+func TestCallRefreshAuth(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		return nil
+	})
+	s.SetAuth(func(proc uint32, cred interface{}) bool {
+		return cred.(AuthUnix).Stamp == 1
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	// The first credentials are rejected, the call is retried with the refreshed ones
+	auth := &stampAuth{}
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.SetAuth(auth)
+	assert.Nil(t, c.Call(1, uint32(0), nil))
+	assert.Equal(t, []AuthStat{AuthBadCred}, auth.refreshed)
+
+	// The call is only retried once
+	auth.stamp = 5
+	err = c.Call(1, uint32(0), nil)
+	stat, _ := AuthErrorStat(err)
+	assert.Equal(t, AuthBadCred, stat)
+	assert.Len(t, auth.refreshed, 2)
+	c.Close()
+	s.Shutdown(context.Background())
+}
+
+func TestClientStats(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	s.Register(3, func(arg uint32, reply *uint32) error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	err = c.Call(2, uint32(1), &reply)
+	assert.NotNil(t, err)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(2), stats.Calls)
+	assert.Equal(t, uint64(1), stats.Errors)
+	assert.Equal(t, err, stats.LastError)
+	assert.Equal(t, uint64(0), stats.Timeouts)
+	assert.True(t, stats.BytesOut > 0 && stats.BytesIn > 0)
+
+	c.SetCallTimeout(50 * time.Millisecond)
+	assert.NotNil(t, c.Call(3, uint32(1), &reply))
+	assert.Equal(t, uint64(1), c.Stats().Timeouts)
+	c.Close()
+	s.Shutdown(context.Background())
+}
+
+func TestCallTimeout(t *testing.T) {
+	for _, udp := range []bool{false, true} {
+		register := func(s Server) {
+			s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+			s.Register(1, func(arg uint32, reply *uint32) error {
+				time.Sleep(time.Duration(arg) * time.Millisecond)
+				*reply = arg
+				return nil
+			})
+		}
+
+		var s Server
+		var addr string
+		transport := ClientTransportTcpOnly
+		if udp {
+			us := NewUDPServer(0x20000001, 1)
+			register(us)
+			conn, _, err := us.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go us.serve(conn)
+			s, addr, transport = us, conn.LocalAddr().String(), ClientTransportUdpOnly
+		} else {
+			ts := NewTCPServer(0x20000001, 1)
+			register(ts)
+			ln, _, err := ts.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go ts.serve(ln)
+			s, addr = ts, ln.Addr().String()
+		}
+
+		// The call timeout of the client
+		c := NewClient(addr, 0x20000001, 1, &ClientConfig{Transport: transport})
+		c.SetCallTimeout(50 * time.Millisecond)
+		var reply uint32
+		err := c.Call(1, uint32(300), &reply)
+		if e, ok := err.(*TransportError); assert.True(t, ok, "udp: %v", udp) {
+			assert.True(t, e.Timeout())
+		}
+
+		// The deadline of the context, when it is earlier
+		c.SetCallTimeout(5 * time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		assert.Equal(t, context.DeadlineExceeded, c.CallContext(ctx, 1, uint32(300), &reply))
+		cancel()
+
+		// The cancellation of the context
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		assert.Equal(t, context.Canceled, c.CallContext(ctx, 1, uint32(300), &reply))
+		assert.True(t, time.Since(start) < 250*time.Millisecond)
+
+		// The client recovers from the aborted calls
+		assert.Nil(t, c.Call(1, uint32(1), &reply))
+		assert.Equal(t, uint32(1), reply)
+
+		c.Close()
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+}
+
+func TestNewClientFromConn(t *testing.T) {
+	for _, udp := range []bool{false, true} {
+		var s Server
+		var conn net.Conn
+		var err error
+		protocol := Tcp
+		if udp {
+			us := NewUDPServer(0x20000001, 1)
+			sc, _, lerr := us.listen("127.0.0.1:0")
+			assert.Nil(t, lerr)
+			go us.serve(sc)
+			s, protocol = us, Udp
+			conn, err = net.Dial("udp", sc.LocalAddr().String())
+		} else {
+			ts := NewTCPServer(0x20000001, 1)
+			ln, _, lerr := ts.listen("127.0.0.1:0")
+			assert.Nil(t, lerr)
+			go ts.serve(ln)
+			s = ts
+			conn, err = net.Dial("tcp", ln.Addr().String())
+		}
+		assert.Nil(t, err)
+		s.Register(1, func(arg uint32, reply *uint32) error {
+			*reply = arg * 2
+			return nil
+		})
+
+		c := NewClientFromConn(conn, protocol, 0x20000001, 1)
+		var reply uint32
+		assert.Nil(t, c.Call(1, uint32(21), &reply))
+		assert.Equal(t, uint32(42), reply)
+
+		// The client cannot reconnect on its own once closed
+		c.Close()
+		assert.NotNil(t, c.Call(1, uint32(21), &reply))
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+}
+
+func TestClientDialContext(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+
+	var dialed []string
+	fail := false
+	c := NewClient("server.example:111", 0x20000001, 1, &ClientConfig{
+		Transport: ClientTransportTcpOnly,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+addr)
+			if fail {
+				return nil, errors.New("unreachable")
+			}
+			return Pipe(s, nil)
+		},
+	})
+
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(7), &reply))
+	assert.Equal(t, uint32(7), reply)
+	assert.Equal(t, []string{"tcp server.example:111"}, dialed)
+
+	// Dial errors are transport errors
+	c.Close()
+	fail = true
+	err := c.Call(1, uint32(7), &reply)
+	if e, ok := err.(*TransportError); assert.True(t, ok) {
+		assert.Equal(t, "dial", e.Op)
+		assert.Equal(t, "unreachable", e.Err.Error())
+	}
+	assert.Len(t, dialed, 2)
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	pings := make(chan struct{}, 16)
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error {
+		pings <- struct{}{}
+		return nil
+	})
+
+	dialed := make(chan net.Conn, 4)
+	c := NewClient("server.example:111", 0x20000001, 1, &ClientConfig{
+		Transport: ClientTransportTcpOnly,
+		KeepAlive: 20 * time.Millisecond,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := Pipe(s, nil)
+			dialed <- conn
+			return conn, err
+		},
+	})
+	ping := func() {
+		t.Helper()
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatal("no ping received")
+		}
+	}
+
+	assert.Nil(t, c.Call(0, nil, nil))
+	conn := <-dialed
+	ping()
+
+	// The idle connection is checked periodically
+	ping()
+	ping()
+
+	// When a check fails, the client reconnects without waiting for the next call
+	conn.Close()
+	select {
+	case <-dialed:
+	case <-time.After(time.Second):
+		t.Fatal("the client did not reconnect")
+	}
+	ping()
+
+	// No checks are done once the client is closed
+	c.Close()
+	for len(pings) > 0 {
+		<-pings
+	}
+	time.Sleep(60 * time.Millisecond)
+	assert.Len(t, pings, 0)
+	s.Shutdown(context.Background())
+}
@@ -0,0 +1,30 @@
+package sunrpc
+
+// ClientAuth is implemented by authentication flavors used by Client. It provides the
+// credential and verifier sent with each call, and validates the verifier that the server
+// returns in accepted replies.
+//
+// Flavors like AUTH_SHORT or RPCSEC_GSS use ValidateVerifier to consume data that the
+// server sends back (a short-hand credential, a sequence window checksum, etc.).
+type ClientAuth interface {
+	// Credentials returns the credential and verifier to attach to the next call.
+	Credentials() (cred OpaqueAuth, verf OpaqueAuth, err error)
+
+	// ValidateVerifier is invoked with the verifier of every accepted reply. Returning an
+	// error causes the call to fail with an ErrBadVerifier.
+	ValidateVerifier(verf OpaqueAuth) error
+}
+
+// RefreshableAuth is implemented by flavors whose credentials can be refreshed when the server
+// rejects them, like AUTH_REFRESH in the classic ONC RPC library: flavors using short-lived
+// credentials (AUTH_SHORT handles, AUTH_DH nicknames) fall back to the full credential, and
+// flavors with expiring credentials or verifiers (e.g. time-skewed AUTH_DH timestamps, or
+// RPCSEC_GSS contexts) can renew them.
+//
+// When a call is rejected with AUTH_ERROR, Client invokes Refresh with the auth_stat replied
+// (see AuthStat.Refreshable); if it returns true, the call is retried once, with the
+// credentials returned by Credentials afterwards.
+type RefreshableAuth interface {
+	ClientAuth
+	Refresh(stat AuthStat) bool
+}
@@ -0,0 +1,78 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ClientStats is a snapshot of the statistics of a client (see Client.Stats). Calls answered
+// by the reply cache (see ClientConfig.Cache) are not accounted for.
+type ClientStats struct {
+	Calls        uint64 // calls sent, including the pings done when connecting and retries
+	Errors       uint64 // calls which failed, for any reason
+	Retransmits  uint64 // calls sent again, after the server rejected their credentials
+	Timeouts     uint64 // calls not replied before their deadline
+	DecodeErrors uint64 // replies which could not be decoded
+	Reconnects   uint64 // connections opened to the server
+	BytesOut     uint64 // size of the calls sent, without record marking
+	BytesIn      uint64 // size of the replies received (including discarded ones), without record marking
+
+	// LastError is the error of the last call which failed (nil if none), at LastErrorTime.
+	LastError     error
+	LastErrorTime time.Time
+}
+
+type clientStats struct {
+	mu sync.Mutex
+	ClientStats
+}
+
+// Stats returns the statistics of the client. It can be called while calls are in progress.
+func (c *Client) Stats() ClientStats {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	return c.stats.ClientStats
+}
+
+// record accounts for a round-trip to the server, which sent out bytes and received in bytes.
+func (st *clientStats) record(err error, out, in int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.Calls++
+	st.BytesOut += uint64(out)
+	st.BytesIn += uint64(in)
+	if err == nil {
+		return
+	}
+
+	st.Errors++
+	st.LastError = err
+	st.LastErrorTime = time.Now()
+	switch e := err.(type) {
+	case *ProtocolError:
+		st.DecodeErrors++
+	case net.Error:
+		if e.Timeout() {
+			st.Timeouts++
+		}
+	default:
+		if err == context.DeadlineExceeded {
+			st.Timeouts++
+		}
+	}
+}
+
+func (st *clientStats) retransmit() {
+	st.mu.Lock()
+	st.Retransmits++
+	st.mu.Unlock()
+}
+
+func (st *clientStats) reconnect() {
+	st.mu.Lock()
+	st.Reconnects++
+	st.mu.Unlock()
+}
@@ -0,0 +1,315 @@
+package sunrpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"gopkg.in/Sirupsen/logrus.v0"
+)
+
+// Compression identifies an algorithm used to compress the records exchanged between a
+// Client and a TCPServer of this package, for links where bandwidth matters more than CPU
+// (e.g. bulk transfers over a WAN).
+//
+// Compression is an extension of the protocol: it is disabled by default, and only used once
+// both ends agreed on it (see CompressionConfig), so that other implementations are never
+// sent compressed records.
+type Compression uint32
+
+const (
+	CompressionNone Compression = 0
+	CompressionGzip Compression = 1
+	CompressionZstd Compression = 2 // requires a Compressor registered with RegisterCompressor
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("COMPRESSION(%d)", uint32(c))
+}
+
+// The compression algorithm of a connection is negotiated by the client, right after
+// connecting, by calling this private program with the list of the algorithms it supports,
+// in order of preference. The server replies with the one it selected, or CompressionNone.
+// Servers not supporting the extension reply with PROG_UNAVAIL, and the connection is left
+// uncompressed.
+const (
+	CompressionProgram       = 0x2f5a4950
+	CompressionVersion       = 1
+	CompressionProcNegotiate = 1
+)
+
+// CompressionConfig configures the compression of the records of a connection.
+type CompressionConfig struct {
+	// Algorithms lists the accepted algorithms (default: gzip). The client offers them in
+	// this order, and the server selects the first of its own list offered by the client.
+	Algorithms []Compression
+
+	// MinSize is the size below which messages are sent uncompressed (default: 1 KB).
+	// Messages which compression does not make smaller are also sent uncompressed.
+	MinSize int
+
+	// MaxSize is the maximum size of a decompressed message (default: 64 MB). Servers also
+	// apply RecordLimits.MaxSize, and clients ClientConfig.MaxReplySize, when they are set.
+	MaxSize int
+}
+
+func (cfg *CompressionConfig) algorithms() []Compression {
+	if len(cfg.Algorithms) == 0 {
+		return []Compression{CompressionGzip}
+	}
+	return cfg.Algorithms
+}
+
+func (cfg *CompressionConfig) minSize() int {
+	if cfg.MinSize <= 0 {
+		return 1024
+	}
+	return cfg.MinSize
+}
+
+// maxSize returns the maximum size of a decompressed message, given the maximum size of a
+// record (0: none).
+func (cfg *CompressionConfig) maxSize(limit int) int {
+	max := cfg.MaxSize
+	if max <= 0 {
+		max = 64 << 20
+	}
+	if limit > 0 && limit < max {
+		max = limit
+	}
+	return max
+}
+
+// Compressor implements a compression algorithm.
+type Compressor interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[Compression]Compressor{
+		CompressionGzip: gzipCompressor{},
+	}
+)
+
+// RegisterCompressor installs the implementation of a compression algorithm, e.g. to provide
+// CompressionZstd through a third-party package. Algorithms must be registered before the
+// clients and servers using them are started.
+func RegisterCompressor(c Compression, comp Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c] = comp
+}
+
+func lookupCompressor(c Compression) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	comp, ok := compressors[c]
+	return comp, ok
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Compressed records start with a header made of the size of the message, a marker taking the
+// place of the message type (so that they cannot be mistaken for RPC messages) and the
+// algorithm, followed by the compressed message. This allows each record to be compressed or
+// not, independently of the others.
+const (
+	compressedMarker     = 0x535a4950 // "SZIP"
+	compressedHeaderSize = 12
+)
+
+// isCompressedRecord reports whether a record holds a compressed message.
+func isCompressedRecord(b []byte) bool {
+	return len(b) >= compressedHeaderSize && binary.BigEndian.Uint32(b[4:]) == compressedMarker
+}
+
+// compressRecord returns the record holding msg compressed with c, or msg itself if it is
+// smaller than minSize, or compression does not make it smaller.
+func compressRecord(c Compression, msg []byte, minSize int) []byte {
+	if c == CompressionNone || len(msg) < minSize {
+		return msg
+	}
+	comp, ok := lookupCompressor(c)
+	if !ok {
+		return msg
+	}
+
+	var buf bytes.Buffer
+	var header [compressedHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(len(msg)))
+	binary.BigEndian.PutUint32(header[4:], compressedMarker)
+	binary.BigEndian.PutUint32(header[8:], uint32(c))
+	buf.Write(header[:])
+
+	w, err := comp.NewWriter(&buf)
+	if err != nil {
+		return msg
+	}
+	if _, err := w.Write(msg); err != nil {
+		return msg
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(msg) {
+		return msg
+	}
+	return buf.Bytes()
+}
+
+// decompressRecord returns the message held in a compressed record, failing if it is larger
+// than max.
+func decompressRecord(b []byte, max int) ([]byte, error) {
+	size := binary.BigEndian.Uint32(b)
+	c := Compression(binary.BigEndian.Uint32(b[8:]))
+	if int64(size) > int64(max) {
+		return nil, &ErrRecordTooLarge{Max: max}
+	}
+	comp, ok := lookupCompressor(c)
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression algorithm: %v", c)
+	}
+
+	r, err := comp.NewReader(bytes.NewReader(b[compressedHeaderSize:]))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress record: %v", err)
+	}
+	defer r.Close()
+
+	// Do not trust the announced size to allocate the buffer upfront
+	var buf bytes.Buffer
+	if size < 64*1024 {
+		buf.Grow(int(size))
+	}
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(size)+1)); err != nil {
+		return nil, fmt.Errorf("cannot decompress record: %v", err)
+	}
+	if buf.Len() != int(size) {
+		return nil, fmt.Errorf("decompressed record has %d bytes instead of %d", buf.Len(), size)
+	}
+	return buf.Bytes(), nil
+}
+
+// SetCompression enables the compression extension on the connections of the server, for the
+// clients which negotiate it (see Compression). It must be called before Serve. Streamed
+// replies (see ReplyStream) are always sent uncompressed.
+func (s *TCPServer) SetCompression(cfg *CompressionConfig) {
+	s.compression = cfg
+}
+
+// negotiateCompression handles a call to CompressionProgram received on conn, returning false
+// if the record holds another call. The call is subject to the access control function and
+// to the authentication checks, like the calls to the programs of the server: compression
+// is not negotiated if they reject it.
+func (s *TCPServer) negotiateCompression(conn net.Conn, state *tcpConnState, info CallInfo, record []byte) bool {
+	call, args, err := DecodeCallBody(record)
+	if err != nil || call.Body.Program != CompressionProgram || call.Body.Version != CompressionVersion ||
+		call.Body.Procedure != CompressionProcNegotiate {
+		return false
+	}
+
+	var offered []Compression
+	var selected Compression
+	if _, err := xdr.UnmarshalLimited(bytes.NewReader(args), &offered, uint(len(args))); err != nil {
+		return false
+	}
+
+	info.Xid = call.Header.Xid
+	info.Program = call.Body.Program
+	info.Version = call.Body.Version
+	info.Procedure = call.Body.Procedure
+
+	var reply bytes.Buffer
+	var verf OpaqueAuth
+	allowed, err := s.checkAccess(&reply, call, &info)
+	if allowed {
+		verf, allowed, err = s.authenticate(&reply, call, &info)
+	}
+	if err != nil {
+		s.server.log.WithField("err", err).Error("Cannot reply to compression negotiation")
+		return true
+	}
+
+	if allowed {
+		for _, c := range s.compression.algorithms() {
+			if _, ok := lookupCompressor(c); ok && containsCompression(offered, c) {
+				selected = c
+				break
+			}
+		}
+		writeAcceptedReply(&reply, call.Header.Xid, verf, Success, uint32(selected))
+	}
+
+	if reply.Len() > 0 {
+		s.mu.Lock()
+		state.inFlight++
+		state.calls.Add(1)
+		s.mu.Unlock()
+		s.reply(conn, state, reply.Bytes())
+	}
+	if !allowed {
+		return true
+	}
+
+	// The client does not send compressed calls before receiving the reply
+	state.wmu.Lock()
+	state.compression = selected
+	state.wmu.Unlock()
+
+	s.server.log.WithFields(logrus.Fields{
+		"remote":      conn.RemoteAddr().String(),
+		"compression": selected,
+	}).Debug("Negotiated compression")
+	return true
+}
+
+func containsCompression(list []Compression, c Compression) bool {
+	for _, l := range list {
+		if l == c {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateCompression offers the configured compression algorithms to the server, on a new
+// TCP connection. It must be called with c.mu held. Servers which do not support compression,
+// or reject the negotiation, are not an error: the connection is left uncompressed.
+func (c *Client) negotiateCompression(ctx context.Context) error {
+	var selected uint32
+	err := c.call(ctx, CompressionProgram, CompressionVersion, CompressionProcNegotiate,
+		c.cfg.Compression.algorithms(), &selected)
+	if err != nil {
+		switch err.(type) {
+		case AcceptError, RejectError:
+			return nil
+		}
+		return err
+	}
+
+	if _, ok := lookupCompressor(Compression(selected)); ok && containsCompression(c.cfg.Compression.algorithms(), Compression(selected)) {
+		c.compression = Compression(selected)
+	}
+	return nil
+}
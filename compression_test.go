@@ -0,0 +1,132 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		server, client *CompressionConfig
+		compressed     bool
+	}{
+		{"both", &CompressionConfig{}, &CompressionConfig{}, true},
+		{"server only", &CompressionConfig{}, nil, false},
+		{"client only", nil, &CompressionConfig{}, false},
+		{"no common algorithm", &CompressionConfig{Algorithms: []Compression{CompressionZstd}}, &CompressionConfig{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewTCPServer(0x20000001, 1)
+			s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+			s.Register(1, func(arg []byte, reply *[]byte) error {
+				*reply = arg
+				return nil
+			})
+			if tc.server != nil {
+				s.SetCompression(tc.server)
+			}
+			defer s.Shutdown(context.Background())
+
+			c := NewClient("pipe", 0x20000001, 1, &ClientConfig{
+				Transport: ClientTransportTcpOnly,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return Pipe(s, nil)
+				},
+				Compression: tc.client,
+			})
+			defer c.Close()
+
+			// Small calls are not compressed
+			var small []byte
+			assert.Nil(t, c.Call(1, []byte("hello"), &small))
+			assert.Equal(t, []byte("hello"), small)
+
+			data := bytes.Repeat([]byte("compressible "), 2000)
+			before := c.Stats()
+			var reply []byte
+			assert.Nil(t, c.Call(1, data, &reply))
+			assert.Equal(t, data, reply)
+
+			after := c.Stats()
+			sent, received := after.BytesOut-before.BytesOut, after.BytesIn-before.BytesIn
+			if tc.compressed {
+				assert.True(t, sent < uint64(len(data))/10)
+				assert.True(t, received < uint64(len(data))/10)
+			} else {
+				assert.True(t, sent > uint64(len(data)))
+				assert.True(t, received > uint64(len(data)))
+			}
+		})
+	}
+}
+
+func TestDecompressRecordLimits(t *testing.T) {
+	msg := bytes.Repeat([]byte{0}, 4096)
+	record := compressRecord(CompressionGzip, msg, 0)
+	assert.True(t, isCompressedRecord(record))
+
+	got, err := decompressRecord(record, 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, got)
+
+	_, err = decompressRecord(record, 1024)
+	assert.IsType(t, &ErrRecordTooLarge{}, err)
+
+	// The announced size must match the payload
+	record[3]--
+	_, err = decompressRecord(record, 4096)
+	assert.NotNil(t, err)
+}
+
+func TestCompressionAccessControl(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(1, func(arg []byte, reply *[]byte) error {
+		*reply = arg
+		return nil
+	})
+	s.SetCompression(&CompressionConfig{})
+	s.SetAccessControl(func(remote net.Addr, program, version, proc uint32) bool {
+		return program != CompressionProgram
+	}, AccessDenyAuthError)
+	defer s.Shutdown(context.Background())
+
+	// The negotiation is rejected like any other call, and the connection is not compressed
+	c := NewClient("pipe", 0x20000001, 1, &ClientConfig{
+		Transport: ClientTransportTcpOnly,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return Pipe(s, nil)
+		},
+		Compression: &CompressionConfig{},
+	})
+	defer c.Close()
+
+	data := bytes.Repeat([]byte("compressible "), 2000)
+	var reply []byte
+	assert.Nil(t, c.Call(1, data, &reply))
+	assert.Equal(t, data, reply)
+	assert.True(t, c.Stats().BytesOut > uint64(len(data)))
+
+	// Compressed records are not accepted on connections which did not negotiate compression
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+	var call bytes.Buffer
+	_, err = xdr.Marshal(&call, NewProcedureCall(0x20000001, 1, 1))
+	assert.Nil(t, err)
+	_, err = xdr.Marshal(&call, data)
+	assert.Nil(t, err)
+	var record bytes.Buffer
+	assert.Nil(t, WriteTCPReplyMessage(&record, compressRecord(CompressionGzip, call.Bytes(), 0)))
+	go conn.Write(record.Bytes())
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = ReadRecord(conn)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,101 @@
+package sunrpc
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// ConnOverloadPolicy defines what a TCPServer does with new connections when the maximum
+// number of connections is reached.
+type ConnOverloadPolicy int
+
+const (
+	ConnOverloadPause  ConnOverloadPolicy = iota // stop accepting connections, leaving them in the listen backlog
+	ConnOverloadQueue                            // accept connections, but serve them once others are closed
+	ConnOverloadReject                           // close new connections immediately
+)
+
+// MaxConnsConfig bounds the connections served by a TCPServer (see SetMaxConns).
+type MaxConnsConfig struct {
+	MaxConns int                // maximum number of connections served at once
+	Overload ConnOverloadPolicy // behavior when MaxConns is reached (default: ConnOverloadPause)
+
+	// QueueDepth is the number of connections accepted but not served yet, for
+	// ConnOverloadQueue (default: MaxConns). Connections beyond it are closed.
+	QueueDepth int
+}
+
+// connLimiter enforces the MaxConnsConfig of a server.
+type connLimiter struct {
+	slots      chan struct{} // one per connection served
+	policy     ConnOverloadPolicy
+	queueDepth int32
+	queued     int32 // connections waiting for a slot
+}
+
+// SetMaxConns bounds the number of connections served at once, keeping the file descriptors
+// used by the server bounded under connection floods. A nil cfg removes the limit. It must be
+// called before the server is started, and only applies to the connections accepted by Serve
+// and RegisterAndAnnounce (not to ServeConn).
+func (s *TCPServer) SetMaxConns(cfg *MaxConnsConfig) {
+	if cfg == nil || cfg.MaxConns <= 0 {
+		s.connLimit = nil
+		return
+	}
+
+	l := &connLimiter{
+		slots:      make(chan struct{}, cfg.MaxConns),
+		policy:     cfg.Overload,
+		queueDepth: int32(cfg.QueueDepth),
+	}
+	if l.queueDepth <= 0 {
+		l.queueDepth = int32(cfg.MaxConns)
+	}
+	s.connLimit = l
+}
+
+// waitConnSlot waits for a connection slot, returning false if the server was shut down first.
+func (s *TCPServer) waitConnSlot() bool {
+	select {
+	case s.connLimit.slots <- struct{}{}:
+		return true
+	case <-s.baseCtx.Done():
+		return false
+	}
+}
+
+// admit decides what to do with a connection just accepted, when the pause policy does not
+// apply: it is either served, queued or closed.
+func (s *TCPServer) admit(conn net.Conn) {
+	l := s.connLimit
+	select {
+	case l.slots <- struct{}{}:
+		s.startConn(conn, true)
+		return
+	default:
+	}
+
+	if l.policy == ConnOverloadQueue && atomic.AddInt32(&l.queued, 1) <= l.queueDepth {
+		go func() {
+			ok := s.waitConnSlot()
+			atomic.AddInt32(&l.queued, -1)
+			if !ok {
+				conn.Close()
+				return
+			}
+			s.startConn(conn, true)
+		}()
+		return
+	}
+	if l.policy == ConnOverloadQueue {
+		atomic.AddInt32(&l.queued, -1)
+	}
+
+	s.server.log.WithField("remote", conn.RemoteAddr().String()).Warn("Too many connections, closing new connection")
+	conn.Close()
+}
+
+// releaseConnSlot frees the slot of a connection served.
+func (s *TCPServer) releaseConnSlot() {
+	<-s.connLimit.slots
+}
@@ -0,0 +1,59 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxConns(t *testing.T) {
+	for _, policy := range []ConnOverloadPolicy{ConnOverloadReject, ConnOverloadQueue} {
+		s := NewTCPServer(0x20000001, 1)
+		s.Register(1, func(arg uint32, reply *uint32) error {
+			*reply = arg
+			return nil
+		})
+		s.SetMaxConns(&MaxConnsConfig{MaxConns: 1, Overload: policy})
+		ln, _, err := s.listen("127.0.0.1:0")
+		assert.Nil(t, err)
+		go s.serve(ln)
+
+		dial := func() *Client {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			assert.Nil(t, err)
+			return NewClientFromConn(conn, Tcp, 0x20000001, 1)
+		}
+
+		var reply uint32
+		first := dial()
+		assert.Nil(t, first.Call(1, uint32(1), &reply))
+
+		second := dial()
+		second.SetCallTimeout(time.Second)
+		done := make(chan error, 1)
+		go func() {
+			done <- second.Call(1, uint32(2), &reply)
+		}()
+
+		if policy == ConnOverloadReject {
+			assert.NotNil(t, <-done)
+		} else {
+			select {
+			case err := <-done:
+				t.Fatalf("queued connection served before a slot is free: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		first.Close()
+		if policy == ConnOverloadQueue {
+			assert.Nil(t, <-done)
+			assert.Equal(t, uint32(2), reply)
+		}
+		second.Close()
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+}
@@ -0,0 +1,129 @@
+package sunrpc
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// ConnState is a key/value store bound to a client connection, which lets stateful protocols
+// (locks, security contexts, AUTH_SHORT tickets...) keep per-client state across calls. It is
+// available to the procedures through CallInfo.Conn, and it is safe for concurrent use.
+//
+// When the connection is closed, after its last call has been handled, the functions
+// registered with OnClose are invoked and the values are dropped.
+type ConnState struct {
+	mu       sync.Mutex
+	values   map[interface{}]interface{}
+	onClose  []func()
+	released bool
+}
+
+func newConnStore() *ConnState {
+	return &ConnState{values: make(map[interface{}]interface{})}
+}
+
+// Get returns the value stored for key, if any.
+func (c *ConnState) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// Set stores value for key, replacing the previous value (if any).
+func (c *ConnState) Set(key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.released {
+		c.values[key] = value
+	}
+}
+
+// Delete removes the value stored for key.
+func (c *ConnState) Delete(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+}
+
+// OnClose registers a function to be called when the connection is closed, e.g. to release
+// the resources held by the stored values. Functions are called in reverse order of
+// registration; if the connection is already closed, f is called immediately.
+func (c *ConnState) OnClose(f func()) {
+	c.mu.Lock()
+	if !c.released {
+		c.onClose = append(c.onClose, f)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	f()
+}
+
+// release drops the stored values and calls the OnClose functions.
+func (c *ConnState) release() {
+	c.mu.Lock()
+	onClose := c.onClose
+	c.onClose = nil
+	c.values = make(map[interface{}]interface{})
+	c.released = true
+	c.mu.Unlock()
+
+	for i := len(onClose) - 1; i >= 0; i-- {
+		onClose[i]()
+	}
+}
+
+// ConnInfo describes a client connection, for the connection hooks of a TCPServer.
+type ConnInfo struct {
+	Remote net.Addr
+	Local  net.Addr
+
+	// TLS is the state of the connection for clients connected over TLS, and nil otherwise.
+	TLS *tls.ConnectionState
+
+	// State is the store of the connection, also available to the procedures as CallInfo.Conn.
+	State *ConnState
+}
+
+// DisconnectReason tells why a client connection was closed.
+type DisconnectReason int
+
+const (
+	DisconnectPeerClosed DisconnectReason = iota // the client closed the connection
+	DisconnectError                              // the connection failed, or received an invalid record
+	DisconnectShutdown                           // the server was shut down
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectPeerClosed:
+		return "closed by peer"
+	case DisconnectError:
+		return "error"
+	case DisconnectShutdown:
+		return "server shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnHooks are functions called by a TCPServer as clients connect and disconnect, to maintain
+// per-client sessions or emit audit events (see SetConnHooks).
+type ConnHooks struct {
+	// OnConnect is called when a client is connected (after the TLS handshake, if any),
+	// before its calls are read.
+	OnConnect func(info *ConnInfo)
+
+	// OnDisconnect is called when the connection of a client is closed, once its last call
+	// has been replied, but before the values of its ConnState are dropped. err is the error
+	// that caused the disconnection (for DisconnectError), or nil.
+	OnDisconnect func(info *ConnInfo, reason DisconnectReason, err error)
+}
+
+// SetConnHooks installs the functions called as clients connect and disconnect. It must be
+// called before the server is started.
+func (s *TCPServer) SetConnHooks(hooks *ConnHooks) {
+	s.hooks = hooks
+}
@@ -0,0 +1,94 @@
+package sunrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnState(t *testing.T) {
+	type counterKey struct{}
+
+	closed := make(chan struct{})
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(ctx context.Context, arg uint32, reply *uint32) error {
+		store := CallInfoFromContext(ctx).Conn
+		count, ok := store.Get(counterKey{})
+		if !ok {
+			count = uint32(0)
+			store.OnClose(func() { close(closed) })
+		}
+		*reply = count.(uint32) + arg
+		store.Set(counterKey{}, *reply)
+		return nil
+	})
+
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(2), &reply))
+	assert.Nil(t, c.Call(1, uint32(3), &reply))
+	assert.Equal(t, uint32(5), reply)
+
+	c.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called on disconnect")
+	}
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestConnHooks(t *testing.T) {
+	type sessionKey struct{}
+	type event struct {
+		session interface{}
+		reason  DisconnectReason
+	}
+
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(ctx context.Context, arg uint32, reply *uint32) error {
+		session, _ := CallInfoFromContext(ctx).Conn.Get(sessionKey{})
+		*reply = session.(uint32)
+		return nil
+	})
+
+	var sessions uint32
+	disconnected := make(chan event, 2)
+	s.SetConnHooks(&ConnHooks{
+		OnConnect: func(info *ConnInfo) {
+			sessions++
+			info.State.Set(sessionKey{}, sessions)
+		},
+		OnDisconnect: func(info *ConnInfo, reason DisconnectReason, err error) {
+			session, _ := info.State.Get(sessionKey{})
+			disconnected <- event{session, reason}
+		},
+	})
+
+	var reply uint32
+	for i := uint32(1); i <= 2; i++ {
+		conn, err := Pipe(s, nil)
+		assert.Nil(t, err)
+		c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+		assert.Nil(t, c.Call(1, uint32(0), &reply))
+		assert.Equal(t, i, reply)
+
+		if i == 1 {
+			c.Close()
+			select {
+			case ev := <-disconnected:
+				assert.Equal(t, event{uint32(1), DisconnectPeerClosed}, ev)
+			case <-time.After(time.Second):
+				t.Fatal("OnDisconnect not called")
+			}
+		}
+	}
+
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Equal(t, event{uint32(2), DisconnectShutdown}, <-disconnected)
+}
@@ -0,0 +1,77 @@
+package sunrpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// maxOpaqueAuthSize is the maximum size of the body of credentials and verifiers (RFC 5531).
+const maxOpaqueAuthSize = 400
+
+// Limits of the fields of AUTH_UNIX credentials (RFC 5531, appendix A).
+const (
+	maxAuthUnixMachineName = 255
+	maxAuthUnixGids        = 16
+)
+
+// DecodeCallBody decodes the RPC call message held in b (without record marking), and returns
+// its header, together with the encoded procedure arguments that follow it.
+//
+// DecodeCallBody performs no I/O and never panics on malformed input, which makes it a
+// suitable entry point for fuzzing.
+func DecodeCallBody(b []byte) (*ProcedureCall, []byte, error) {
+	r := bytes.NewReader(b)
+
+	var call ProcedureCall
+	if _, err := xdr.UnmarshalLimited(r, &call, uint(len(b))); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode RPC call header: %v", err)
+	}
+
+	if call.Header.Type != Call {
+		return nil, nil, errors.New("Expected a call message")
+	}
+	if len(call.Body.Cred.Body) > maxOpaqueAuthSize || len(call.Body.Verf.Body) > maxOpaqueAuthSize {
+		return nil, nil, errors.New("authentication data too large")
+	}
+
+	return &call, b[len(b)-r.Len():], nil
+}
+
+// DecodeReplyBody decodes the RPC reply message held in b (without record marking), and
+// returns its header, together with the encoded procedure results that follow it (only
+// present in successful replies).
+//
+// Like DecodeCallBody, it performs no I/O and never panics on malformed input.
+func DecodeReplyBody(b []byte) (*ProcedureReply, []byte, error) {
+	r := bytes.NewReader(b)
+
+	var reply ProcedureReply
+	if _, err := xdr.UnmarshalLimited(r, &reply, uint(len(b))); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode RPC reply header: %v", err)
+	}
+
+	if reply.Header.Type != Reply {
+		return nil, nil, errors.New("invalid reply type")
+	}
+
+	switch reply.Type {
+	case Accepted:
+		if len(reply.Accepted.Verf.Body) > maxOpaqueAuthSize {
+			return nil, nil, errors.New("authentication data too large")
+		}
+		if reply.Accepted.Stat < Success || reply.Accepted.Stat > SystemErr {
+			return nil, nil, fmt.Errorf("invalid accept status: %v", reply.Accepted.Stat)
+		}
+	case Denied:
+		if reply.Rejected.Stat != RpcMismatch && reply.Rejected.Stat != AuthError {
+			return nil, nil, fmt.Errorf("invalid reject status: %v", reply.Rejected.Stat)
+		}
+	default:
+		return nil, nil, fmt.Errorf("invalid reply status: %v", reply.Type)
+	}
+
+	return &reply, b[len(b)-r.Len():], nil
+}
@@ -0,0 +1,58 @@
+//go:build go1.18
+// +build go1.18
+
+package sunrpc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+func FuzzDecodeCallBody(f *testing.F) {
+	var call bytes.Buffer
+	xdr.Marshal(&call, NewProcedureCall(PortmapperProgram, PortmapperVersion, PortmapperPortGet))
+	xdr.Marshal(&call, &PortmapperMapping{Program: 100003, Version: 3, Protocol: Tcp})
+	f.Add(call.Bytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		call, args, err := DecodeCallBody(b)
+		if err != nil {
+			return
+		}
+		if call.Header.Type != Call || len(args) > len(b) {
+			t.Fatalf("invalid decoding: %+v", call)
+		}
+	})
+}
+
+func FuzzDecodeReplyBody(f *testing.F) {
+	f.Add([]byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x00, // Accepted
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x00, // Success
+		0x00, 0x00, 0x00, 0x6f, // Result
+	})
+	f.Add([]byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x01, // Denied
+		0x00, 0x00, 0x00, 0x00, // RpcMismatch
+		0x00, 0x00, 0x00, 0x02, // Low
+		0x00, 0x00, 0x00, 0x02, // High
+	})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		reply, results, err := DecodeReplyBody(b)
+		if err != nil {
+			return
+		}
+		if reply.Header.Type != Reply || len(results) > len(b) {
+			t.Fatalf("invalid decoding: %+v", reply)
+		}
+	})
+}
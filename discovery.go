@@ -0,0 +1,292 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// DiscoveryGroup is the default multicast group used to announce and discover services.
+const DiscoveryGroup = "239.255.0.111:5111"
+
+// discoveryMagic identifies the announcements sent by this package ("SRPC").
+const discoveryMagic = 0x53525043
+
+// discoveryMessage is the payload of an announcement datagram.
+type discoveryMessage struct {
+	Magic    uint32
+	Services []PortmapperMapping
+}
+
+// Announcer periodically announces services over a multicast group, so that clients on the
+// local network can find them with a DiscoveryListener, without querying rpcbind. Services
+// are announced from the address the datagrams are sent from.
+type Announcer struct {
+	conn     *net.UDPConn
+	interval time.Duration
+
+	mu       sync.Mutex
+	services PortmapperList
+	servers  []Server
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAnnouncer starts announcing over group (e.g. DiscoveryGroup) every interval. Services
+// to announce are added with Add and AddServer.
+func NewAnnouncer(group string, interval time.Duration) (*Announcer, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, errors.New("not a multicast address: " + group)
+	}
+
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Announcer{
+		conn:     conn,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Add announces a service.
+func (a *Announcer) Add(m PortmapperMapping) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.services = append(a.services, m)
+}
+
+// AddServer announces the programs registered to a server, on the port it is serving. The
+// programs are looked up on each announcement, so that the ones registered or unregistered
+// later are taken into account.
+func (a *Announcer) AddServer(s Server) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.servers = append(a.servers, s)
+}
+
+// Remove stops announcing a service.
+func (a *Announcer) Remove(program, version uint32, protocol PortmapperProtocol) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	services := a.services[:0]
+	for _, m := range a.services {
+		if m.Program != program || m.Version != version || m.Protocol != protocol {
+			services = append(services, m)
+		}
+	}
+	a.services = services
+}
+
+// Close stops the announcements.
+func (a *Announcer) Close() error {
+	close(a.stop)
+	<-a.done
+	return a.conn.Close()
+}
+
+func (a *Announcer) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		a.announce()
+
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// announce sends an announcement of the current services.
+func (a *Announcer) announce() {
+	a.mu.Lock()
+	msg := discoveryMessage{
+		Magic:    discoveryMagic,
+		Services: append(PortmapperList(nil), a.services...),
+	}
+	for _, s := range a.servers {
+		if ms, ok := s.(interface{ mappings() PortmapperList }); ok {
+			msg.Services = append(msg.Services, ms.mappings()...)
+		}
+	}
+	a.mu.Unlock()
+
+	if len(msg.Services) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	if _, err := xdr.Marshal(&buf, &msg); err != nil {
+		return
+	}
+	if buf.Len() > MaxUdpSize {
+		return
+	}
+	a.conn.Write(buf.Bytes())
+}
+
+// DiscoveredService is a service found by a DiscoveryListener. Host is the address of the
+// announcing host.
+type DiscoveredService struct {
+	PortmapperMapping
+	Host net.IP
+}
+
+// Addr returns the address the service can be reached at.
+func (d DiscoveredService) Addr() string {
+	return net.JoinHostPort(d.Host.String(), strconv.Itoa(int(d.Port)))
+}
+
+// DiscoveryListener receives the announcements sent by Announcers on a multicast group.
+type DiscoveryListener struct {
+	conn    *net.UDPConn
+	pending []DiscoveredService
+}
+
+// NewDiscoveryListener joins group (e.g. DiscoveryGroup), on the interface ifi or on the
+// system-assigned multicast interface if ifi is nil.
+func NewDiscoveryListener(group string, ifi *net.Interface) (*DiscoveryListener, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", ifi, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &DiscoveryListener{conn: conn}, nil
+}
+
+// Next returns the next announced service, blocking until an announcement is received or
+// the deadline set with SetDeadline expires. Services are returned each time they are
+// announced.
+func (l *DiscoveryListener) Next() (DiscoveredService, error) {
+	b := make([]byte, MaxUdpSize)
+	for len(l.pending) == 0 {
+		n, from, err := l.conn.ReadFromUDP(b)
+		if err != nil {
+			return DiscoveredService{}, err
+		}
+
+		var msg discoveryMessage
+		if _, err := xdr.UnmarshalLimited(bytes.NewReader(b[:n]), &msg, uint(n)); err != nil || msg.Magic != discoveryMagic {
+			// Not an announcement: ignore it
+			continue
+		}
+		for _, m := range msg.Services {
+			l.pending = append(l.pending, DiscoveredService{PortmapperMapping: m, Host: from.IP})
+		}
+	}
+
+	service := l.pending[0]
+	l.pending = l.pending[1:]
+	return service, nil
+}
+
+// SetDeadline sets the deadline for Next.
+func (l *DiscoveryListener) SetDeadline(t time.Time) error {
+	return l.conn.SetReadDeadline(t)
+}
+
+// Close leaves the multicast group.
+func (l *DiscoveryListener) Close() error {
+	return l.conn.Close()
+}
+
+// Discover listens to the announcements sent over group until ctx expires, and returns the
+// services found, without duplicates.
+func Discover(ctx context.Context, group string) ([]DiscoveredService, error) {
+	l, err := NewDiscoveryListener(group, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var found []DiscoveredService
+	seen := make(map[string]bool)
+	for {
+		service, err := l.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return found, nil
+			}
+			return found, err
+		}
+
+		key := service.Addr() + "/" + strconv.Itoa(int(service.Program)) + "/" +
+			strconv.Itoa(int(service.Version)) + "/" + strconv.Itoa(int(service.Protocol))
+		if !seen[key] {
+			seen[key] = true
+			found = append(found, service)
+		}
+	}
+}
+
+// programMappings returns the mappings of the programs of a server served on port.
+func (s *server) programMappings(prot PortmapperProtocol, port int) PortmapperList {
+	var list PortmapperList
+	for _, pv := range s.servedPrograms() {
+		list = append(list, PortmapperMapping{
+			Program:  pv.program,
+			Version:  pv.version,
+			Protocol: prot,
+			Port:     uint32(port),
+		})
+	}
+	return list
+}
+
+func (s *TCPServer) mappings() PortmapperList {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+
+	if listener == nil || s.isClosed() {
+		return nil
+	}
+	return s.programMappings(Tcp, listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (server *UDPServer) mappings() PortmapperList {
+	server.mu.Lock()
+	conn := server.conn
+	server.mu.Unlock()
+
+	if conn == nil || server.isClosed() {
+		return nil
+	}
+	return server.programMappings(Udp, conn.LocalAddr().(*net.UDPAddr).Port)
+}
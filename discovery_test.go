@@ -0,0 +1,72 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscovery(t *testing.T) {
+	const group = "239.255.0.111:5112"
+
+	l, err := NewDiscoveryListener(group, nil)
+	if err != nil {
+		t.Skip("multicast not available:", err)
+	}
+	l.Close()
+
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.RegisterProgram(0x20000002, 1, map[uint32]interface{}{})
+	ln, _, err := s.listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.serve(ln)
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+
+	a, err := NewAnnouncer(group, 20*time.Millisecond)
+	assert.Nil(t, err)
+	a.Add(PortmapperMapping{Program: 0x20000003, Version: 1, Protocol: Udp, Port: port})
+	a.AddServer(s)
+
+	// discover returns the services announced for port, ignoring the ones announced by
+	// other tests running at the same time
+	discover := func() map[PortmapperMapping]int {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		found, err := Discover(ctx, group)
+		assert.Nil(t, err)
+		mappings := make(map[PortmapperMapping]int)
+		for _, d := range found {
+			assert.NotNil(t, d.Host)
+			if d.Port == port {
+				mappings[d.PortmapperMapping]++
+			}
+		}
+		return mappings
+	}
+
+	// The programs of the server and the added service are found, once each
+	assert.Equal(t, map[PortmapperMapping]int{
+		{Program: 0x20000001, Version: 1, Protocol: Tcp, Port: port}: 1,
+		{Program: 0x20000002, Version: 1, Protocol: Tcp, Port: port}: 1,
+		{Program: 0x20000003, Version: 1, Protocol: Udp, Port: port}: 1,
+	}, discover())
+
+	// Removed services and unregistered programs are no longer announced
+	a.Remove(0x20000003, 1, Udp)
+	s.Unregister(0x20000002, 1)
+	assert.Equal(t, map[PortmapperMapping]int{
+		{Program: 0x20000001, Version: 1, Protocol: Tcp, Port: port}: 1,
+	}, discover())
+
+	assert.Nil(t, a.Close())
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestAnnouncerGroup(t *testing.T) {
+	_, err := NewAnnouncer("127.0.0.1:5111", time.Second)
+	assert.NotNil(t, err)
+}
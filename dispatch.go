@@ -0,0 +1,113 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// Dispatcher is a procedure decoding its arguments from args and encoding its results to
+// results itself, without the reflection used to call the other procedures. It is meant for
+// the hot paths of performance-sensitive servers, with dispatchers generated from the XDR
+// definition of the program, or written by hand:
+//
+//	func dispatchAdd(ctx context.Context, args *xdr.Decoder, results *xdr.Encoder) error {
+//		a, _, err := args.DecodeUint()
+//		if err != nil {
+//			return err
+//		}
+//		b, _, err := args.DecodeUint()
+//		if err != nil {
+//			return err
+//		}
+//		_, err = results.EncodeUint(a + b)
+//		return err
+//	}
+//
+// Decoding errors (of type *xdr.UnmarshalError) are replied with GARBAGE_ARGS, and the other
+// errors like for any procedure. ctx carries the CallInfo of the call.
+type Dispatcher func(ctx context.Context, args *xdr.Decoder, results *xdr.Encoder) error
+
+// RegisterDispatcher binds a procedure ID to a Dispatcher. Dispatchers can also be passed to
+// RegisterProgram.
+func (server *server) RegisterDispatcher(proc uint32, d Dispatcher) {
+	server.programs.register(server.program, server.version, proc, d, "")
+}
+
+// callDispatcher calls a Dispatcher with the rest of the call as arguments.
+func (s *server) callDispatcher(ctx context.Context, r io.Reader, d Dispatcher) (interface{}, error) {
+	// The arguments are decoded straight from the record: the transports keep it until the
+	// dispatcher returns, even if the call is given up. Like for the other procedures,
+	// variable-length items are bounded by the size of the arguments.
+	limit := uint(math.MaxUint32)
+	if br, ok := r.(*bytes.Reader); ok {
+		limit = uint(br.Len())
+	}
+	args := xdr.NewDecoderLimited(r, limit)
+
+	if _, ok := ctx.Deadline(); !ok {
+		return dispatchCall(ctx, d, args)
+	}
+	return runProcedure(ctx, func() (interface{}, error) {
+		return dispatchCall(ctx, d, args)
+	}, nil)
+}
+
+// dispatchCall runs a Dispatcher, and returns its encoded results.
+func dispatchCall(ctx context.Context, d Dispatcher, args *xdr.Decoder) (interface{}, error) {
+	var results bytes.Buffer
+	if err := d(ctx, args, xdr.NewEncoder(&results)); err != nil {
+		if _, garbage := err.(*xdr.UnmarshalError); garbage {
+			return nil, &ErrGarbageArgs{}
+		}
+		return nil, err
+	}
+	return rawMessage(results.Bytes()), nil
+}
+
+// runProcedure runs a procedure. Calls with a deadline run it on its own goroutine, so that
+// they can be given up when ctx expires (abort, if not nil, is then called): the procedure
+// keeps running, and the transport is told about it through the CallInfo of the call, so that
+// it holds the resources of the call until the procedure returns. Other calls run it inline.
+func runProcedure(ctx context.Context, f func() (interface{}, error), abort func()) (interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return f()
+	}
+
+	var ret interface{}
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ret, err = f()
+	}()
+
+	select {
+	case <-done:
+		return ret, err
+	case <-ctx.Done():
+		if abort != nil {
+			abort()
+		}
+		if info := CallInfoFromContext(ctx); info != nil && info.abandoned != nil {
+			info.abandoned.done = done
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// abandonedProc is set by the transports in the CallInfo of the calls they dispatch, to learn
+// about the procedures which were given up when their call timed out.
+type abandonedProc struct {
+	done chan struct{} // closed when the procedure returns, nil if it was not given up
+}
+
+// wait waits for the procedure given up (if any) to return.
+func (p *abandonedProc) wait() {
+	if p.done != nil {
+		<-p.done
+	}
+}
@@ -1,7 +1,15 @@
 package sunrpc
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
 
+// ErrRpcMismatch and ErrAuth describe the rejection of a call, with RPC_MISMATCH and
+// AUTH_ERROR respectively. Client returns them wrapped in a RPCDeniedError: use errors.As to
+// match them.
 type ErrRpcMismatch struct {
 	High, Low uint32
 }
@@ -18,6 +26,20 @@ func (e *ErrAuth) Error() string {
 	return fmt.Sprintf("RPC auth unsupported, found: %v", e.Stat)
 }
 
+// ErrBadVerifier is returned by Client when the verifier sent by the server in its reply
+// is not accepted by the configured authentication flavor.
+type ErrBadVerifier struct {
+	Flavor AuthFlavor
+	Err    error
+}
+
+func (e *ErrBadVerifier) Error() string {
+	return fmt.Sprintf("invalid reply verifier (flavor %v): %v", e.Flavor, e.Err)
+}
+
+// ErrProgMismatch, ErrProgUnavail, ErrProcUnavail and ErrGarbageArgs describe the failure of
+// an accepted call. Client returns them wrapped in a RPCAcceptError: use errors.As to match
+// them. All implement AcceptError, so that procedures can return them.
 type ErrProgMismatch struct {
 	High, Low uint32
 }
@@ -33,3 +55,194 @@ type ErrGarbageArgs struct{}
 func (e *ErrProgUnavail) Error() string { return "requested program unavailable" }
 func (e *ErrProcUnavail) Error() string { return "requested procedure unavailable" }
 func (e *ErrGarbageArgs) Error() string { return "garbage arguments for proc" }
+
+// AcceptError is implemented by the errors a procedure can return to make the server reply with
+// a specific accept status (PROG_UNAVAIL, PROG_MISMATCH, PROC_UNAVAIL, GARBAGE_ARGS or
+// SYSTEM_ERR), instead of SYSTEM_ERR. ErrProgUnavail, ErrProgMismatch, ErrProcUnavail,
+// ErrGarbageArgs and RPCAcceptError implement it, so that procedures of a proxy can forward
+// the errors of a Client as they are.
+//
+// For PROG_MISMATCH, the range of versions replied is the one held by ErrProgMismatch and
+// RPCAcceptError; for other errors, it is the range of versions served for the program.
+type AcceptError interface {
+	error
+	AcceptStat() AcceptType
+}
+
+func (e *ErrProgUnavail) AcceptStat() AcceptType  { return ProgUnavail }
+func (e *ErrProgMismatch) AcceptStat() AcceptType { return ProgMismatch }
+func (e *ErrProcUnavail) AcceptStat() AcceptType  { return ProcUnavail }
+func (e *ErrGarbageArgs) AcceptStat() AcceptType  { return GarbageArgs }
+
+// RejectError is implemented by the errors describing the rejection of a call (RPCDeniedError,
+// ErrRpcMismatch and ErrAuth).
+type RejectError interface {
+	error
+	RejectStat() RejectStat
+}
+
+func (e *ErrRpcMismatch) RejectStat() RejectStat { return RpcMismatch }
+func (e *ErrAuth) RejectStat() RejectStat        { return AuthError }
+
+// ErrReplayMismatch is returned by ReplayConn when a message written to it differs from
+// the one in the recording.
+type ErrReplayMismatch struct {
+	Frame int // index of the expected frame in the recording
+}
+
+func (e *ErrReplayMismatch) Error() string {
+	return fmt.Sprintf("message does not match recorded frame %v", e.Frame)
+}
+
+// ErrRecordTooLarge, ErrTooManyFragments and ErrRecordTimeout are returned when reading a
+// record with ReadRecordLimited, if the peer exceeds the configured RecordLimits.
+// ErrRecordTooLarge is also returned by Client for replies exceeding ClientConfig.MaxReplySize.
+type ErrRecordTooLarge struct {
+	Max int
+}
+
+func (e *ErrRecordTooLarge) Error() string {
+	return fmt.Sprintf("record exceeds the maximum size of %v bytes", e.Max)
+}
+
+type ErrTooManyFragments struct {
+	Max int
+}
+
+func (e *ErrTooManyFragments) Error() string {
+	return fmt.Sprintf("record exceeds the maximum of %v fragments", e.Max)
+}
+
+type ErrRecordTimeout struct {
+	Timeout time.Duration
+}
+
+func (e *ErrRecordTimeout) Error() string {
+	return fmt.Sprintf("record not received within %v", e.Timeout)
+}
+
+// ErrPartialWrite is returned when a message could only be partly written to a stream, e.g.
+// because a write deadline expired. Unless the rest of the message (starting at Written) is
+// sent later, the peer cannot find the boundaries of the subsequent records, so the stream
+// should be closed.
+type ErrPartialWrite struct {
+	Written, Total int   // bytes written, out of the size of the message (with its record markers)
+	Err            error // error which interrupted the write
+}
+
+func (e *ErrPartialWrite) Error() string {
+	return fmt.Sprintf("partial write (%v of %v bytes): %v", e.Written, e.Total, e.Err)
+}
+
+func (e *ErrPartialWrite) Unwrap() error { return e.Err }
+
+// TransportError is returned by Client when the connection to the server fails (while
+// connecting, sending the call or receiving the reply). The call might or might not have
+// been executed by the server. It implements net.Error.
+type TransportError struct {
+	Op  string // "dial", "write" or "read"
+	Err error  // underlying error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("RPC transport error (%v): %v", e.Op, e.Err)
+}
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the error is caused by a timeout.
+func (e *TransportError) Timeout() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Temporary reports whether the error is temporary.
+func (e *TransportError) Temporary() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// ProtocolError is returned by Client when the reply of the server cannot be decoded.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("RPC protocol error: %v", e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+// RPCAcceptError is returned by Client when the server accepted the call, but could not
+// execute it (e.g. PROC_UNAVAIL). Low and High hold the supported versions for PROG_MISMATCH.
+//
+// It unwraps to the matching legacy error (ErrProgUnavail, ErrProgMismatch, ErrProcUnavail,
+// ErrGarbageArgs), if any.
+type RPCAcceptError struct {
+	Stat      AcceptType
+	Low, High uint32
+}
+
+func (e *RPCAcceptError) Error() string {
+	if err := e.Unwrap(); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("RPC call failed with accept status %v", e.Stat)
+}
+
+func (e *RPCAcceptError) AcceptStat() AcceptType { return e.Stat }
+
+func (e *RPCAcceptError) Unwrap() error {
+	switch e.Stat {
+	case ProgUnavail:
+		return &ErrProgUnavail{}
+	case ProgMismatch:
+		return &ErrProgMismatch{High: e.High, Low: e.Low}
+	case ProcUnavail:
+		return &ErrProcUnavail{}
+	case GarbageArgs:
+		return &ErrGarbageArgs{}
+	}
+	return nil
+}
+
+// RPCDeniedError is returned by Client when the server rejected the call. AuthStat is set
+// for AUTH_ERROR rejections, Low and High (the supported RPC versions) for RPC_MISMATCH ones.
+//
+// It unwraps to the matching legacy error (ErrRpcMismatch or ErrAuth).
+type RPCDeniedError struct {
+	Stat      RejectStat
+	AuthStat  AuthStat
+	Low, High uint32
+}
+
+func (e *RPCDeniedError) Error() string {
+	if err := e.Unwrap(); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("RPC call rejected with status %v", e.Stat)
+}
+
+func (e *RPCDeniedError) RejectStat() RejectStat { return e.Stat }
+
+func (e *RPCDeniedError) Unwrap() error {
+	switch e.Stat {
+	case RpcMismatch:
+		return &ErrRpcMismatch{High: e.High, Low: e.Low}
+	case AuthError:
+		return &ErrAuth{Stat: e.AuthStat}
+	}
+	return nil
+}
+
+// AuthErrorStat returns the auth_stat of the AUTH_ERROR rejection err describes (possibly
+// wrapped), or false if err does not describe one. This allows applications to react to the
+// failure, e.g. by refreshing their credentials (see AuthStat.Refreshable) or by switching to
+// a stronger flavor (on AUTH_TOOWEAK).
+func AuthErrorStat(err error) (AuthStat, bool) {
+	var e *ErrAuth
+	if errors.As(err, &e) {
+		return e.Stat, true
+	}
+	return 0, false
+}
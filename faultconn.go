@@ -0,0 +1,211 @@
+package sunrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fault is a kind of fault injected by a FaultConn.
+type Fault int
+
+const (
+	FaultDrop          Fault = iota // the message is not sent
+	FaultDelay                      // the message is sent late
+	FaultTruncate                   // the message is sent truncated
+	FaultCorruptMarker              // a record marker of the message is corrupted
+	FaultDisconnect                 // the connection is closed while sending the message
+)
+
+func (f Fault) String() string {
+	switch f {
+	case FaultDrop:
+		return "drop"
+	case FaultDelay:
+		return "delay"
+	case FaultTruncate:
+		return "truncate"
+	case FaultCorruptMarker:
+		return "corrupt marker"
+	case FaultDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// FaultConfig configures the faults injected by a FaultConn. Each probability (between 0 and
+// 1) is drawn for each message written, in the order of the fields: several faults can thus
+// hit the same message, except that dropped messages are not affected by the other faults.
+type FaultConfig struct {
+	// Seed initializes the random source: with the same seed, configuration and sequence of
+	// messages, the same faults are injected.
+	Seed int64
+
+	Drop      float64       // probability to drop the message
+	Delay     float64       // probability to send the message after DelayTime
+	DelayTime time.Duration // delay of delayed messages
+
+	// Truncate is the probability to send only part of the message. On stream transports, the
+	// record marker of the last fragment is left untouched: the peer then reads the following
+	// bytes as part of the record.
+	Truncate float64
+
+	// CorruptMarker is the probability to flip a bit of a record marker of the message
+	// (stream transports only).
+	CorruptMarker float64
+
+	// Disconnect is the probability to close the connection after sending part of the
+	// message. Subsequent writes fail.
+	Disconnect float64
+
+	// MaxRecordSize is the maximum size of the records buffered on stream transports (default:
+	// 64 MB). Writes making a record larger fail with ErrRecordTooLarge, and close the
+	// connection, since the peer could not make sense of the following bytes anyway.
+	MaxRecordSize int
+
+	// OnFault, if set, is called for each fault injected.
+	OnFault func(f Fault)
+}
+
+func (cfg *FaultConfig) maxRecordSize() int {
+	if cfg.MaxRecordSize <= 0 {
+		return 64 << 20
+	}
+	return cfg.MaxRecordSize
+}
+
+// FaultConn is a connection which injects faults in the RPC messages written to it, to test
+// the error handling of clients and servers: it can wrap the connection of a Client (see
+// NewClientFromConn) to inject faults in the calls, or the one passed to TCPServer.ServeConn to
+// inject faults in the replies. Reads are passed through.
+//
+// On stream transports, the records written are buffered until they are complete, and sent
+// as a whole (with their faults) by the Write call completing them. Records are buffered up
+// to FaultConfig.MaxRecordSize.
+type FaultConn struct {
+	net.Conn
+
+	cfg   FaultConfig
+	proto PortmapperProtocol
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	buf    bytes.Buffer // incomplete record (stream transports)
+	closed bool
+}
+
+var errFaultDisconnect = errors.New("connection closed by fault injection")
+
+// NewFaultConn wraps conn, injecting faults according to cfg. proto tells whether conn is a
+// stream transport (Tcp) or a datagram one (Udp).
+func NewFaultConn(conn net.Conn, proto PortmapperProtocol, cfg FaultConfig) *FaultConn {
+	return &FaultConn{
+		Conn:  conn,
+		cfg:   cfg,
+		proto: proto,
+		rng:   rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+func (c *FaultConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, errFaultDisconnect
+	}
+
+	if c.proto == Udp {
+		if err := c.send(append([]byte(nil), b...), nil); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	c.buf.Write(b)
+	for {
+		markers, ok := recordMarkers(c.buf.Bytes())
+		if !ok {
+			if max := c.cfg.maxRecordSize(); c.buf.Len() > max {
+				c.buf.Reset()
+				c.closed = true
+				c.Conn.Close()
+				return 0, &ErrRecordTooLarge{Max: max}
+			}
+			return len(b), nil
+		}
+		end := markers[len(markers)-1]
+		size, _ := ParseRecordMarker(binary.BigEndian.Uint32(c.buf.Bytes()[end:]))
+		msg := append([]byte(nil), c.buf.Next(end+4+int(size))...)
+		if err := c.send(msg, markers); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// recordMarkers returns the offsets of the record markers of the first record of data, or
+// false if the record is not complete.
+func recordMarkers(data []byte) ([]int, bool) {
+	var markers []int
+	for off := 0; off+4 <= len(data); {
+		size, last := ParseRecordMarker(binary.BigEndian.Uint32(data[off:]))
+		if off+4+int(size) > len(data) {
+			return nil, false
+		}
+		markers = append(markers, off)
+		if last {
+			return markers, true
+		}
+		off += 4 + int(size)
+	}
+	return nil, false
+}
+
+// send writes a message with the faults drawn for it. markers are the offsets of its record
+// markers, on stream transports.
+func (c *FaultConn) send(msg []byte, markers []int) error {
+	if c.hit(c.cfg.Drop, FaultDrop) {
+		return nil
+	}
+	if c.hit(c.cfg.Delay, FaultDelay) {
+		time.Sleep(c.cfg.DelayTime)
+	}
+
+	if c.hit(c.cfg.Truncate, FaultTruncate) {
+		start := 0
+		if len(markers) > 0 {
+			start = markers[len(markers)-1] + 4
+		}
+		if payload := len(msg) - start; payload > 0 {
+			msg = msg[:start+c.rng.Intn(payload)]
+		}
+	}
+	if len(markers) > 0 && c.hit(c.cfg.CorruptMarker, FaultCorruptMarker) {
+		off := markers[c.rng.Intn(len(markers))]
+		msg[off+c.rng.Intn(4)] ^= 1 << uint(c.rng.Intn(8))
+	}
+
+	if c.hit(c.cfg.Disconnect, FaultDisconnect) {
+		c.Conn.Write(msg[:c.rng.Intn(len(msg)+1)])
+		c.closed = true
+		c.Conn.Close()
+		return errFaultDisconnect
+	}
+
+	return writeFull(c.Conn, msg)
+}
+
+// hit draws whether a fault is injected with probability p, and reports it.
+func (c *FaultConn) hit(p float64, f Fault) bool {
+	if p <= 0 || c.rng.Float64() >= p {
+		return false
+	}
+	if c.cfg.OnFault != nil {
+		c.cfg.OnFault(f)
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultConn(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	defer s.Shutdown(context.Background())
+
+	call := func(cfg FaultConfig) error {
+		conn, err := Pipe(s, nil)
+		assert.Nil(t, err)
+		c := NewClientFromConn(NewFaultConn(conn, Tcp, cfg), Tcp, 0x20000001, 1)
+		c.SetCallTimeout(100 * time.Millisecond)
+		defer c.Close()
+
+		var reply uint32
+		return c.Call(1, uint32(1), &reply)
+	}
+
+	assert.Nil(t, call(FaultConfig{}))
+	assert.Nil(t, call(FaultConfig{Delay: 1, DelayTime: 10 * time.Millisecond}))
+
+	err := call(FaultConfig{Drop: 1})
+	if e, ok := err.(*TransportError); assert.True(t, ok) {
+		assert.True(t, e.Timeout())
+	}
+	_, ok := call(FaultConfig{Disconnect: 1}).(*TransportError)
+	assert.True(t, ok)
+	assert.NotNil(t, call(FaultConfig{CorruptMarker: 1}))
+}
+
+func TestFaultConnSeed(t *testing.T) {
+	record := append([]byte{0x80, 0, 0, 8}, make([]byte, 8)...)
+	run := func(seed int64) ([]Fault, []byte) {
+		var faults []Fault
+		var out bytes.Buffer
+		c := NewFaultConn(nopConn{w: &out}, Tcp, FaultConfig{
+			Seed:          seed,
+			Drop:          0.2,
+			Truncate:      0.2,
+			CorruptMarker: 0.2,
+			OnFault:       func(f Fault) { faults = append(faults, f) },
+		})
+		for i := 0; i < 50; i++ {
+			// Records are sent once complete
+			c.Write(record[:2])
+			c.Write(record[2:])
+		}
+		return faults, out.Bytes()
+	}
+
+	faults, out := run(1)
+	assert.NotEmpty(t, faults)
+	faults2, out2 := run(1)
+	assert.Equal(t, faults, faults2)
+	assert.Equal(t, out, out2)
+}
+
+// nopConn is a connection writing to a buffer.
+type nopConn struct {
+	net.Conn
+	w *bytes.Buffer
+}
+
+func (c nopConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c nopConn) Close() error { return nil }
+
+func TestFaultConnMaxRecordSize(t *testing.T) {
+	var out bytes.Buffer
+	c := NewFaultConn(nopConn{w: &out}, Tcp, FaultConfig{MaxRecordSize: 16})
+
+	// Records up to the maximum size are sent
+	record := append([]byte{0x80, 0, 0, 8}, make([]byte, 8)...)
+	n, err := c.Write(record)
+	assert.Nil(t, err)
+	assert.Equal(t, len(record), n)
+	assert.Equal(t, record, out.Bytes())
+
+	// Larger ones are not buffered beyond it, and the connection is closed
+	out.Reset()
+	_, err = c.Write([]byte{0x80, 0, 0, 32})
+	assert.Nil(t, err)
+	_, err = c.Write(make([]byte, 16))
+	assert.Equal(t, &ErrRecordTooLarge{Max: 16}, err)
+	_, err = c.Write(make([]byte, 16))
+	assert.Equal(t, errFaultDisconnect, err)
+	assert.Equal(t, 0, out.Len())
+}
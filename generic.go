@@ -0,0 +1,59 @@
+//go:build go1.18
+// +build go1.18
+
+package sunrpc
+
+import "context"
+
+// CallTyped performs a call to proc, with the program and version of the client, and returns
+// its results, sparing the declaration of a reply variable:
+//
+//	port, err := sunrpc.CallTyped[sunrpc.PortmapperMapping, uint32](c, sunrpc.PortmapperPortGet, mapping)
+//
+// (The name Call is taken by the MessageType of call messages.)
+func CallTyped[Req, Resp any](c *Client, proc uint32, req Req) (Resp, error) {
+	return CallTypedContext[Req, Resp](context.Background(), c, proc, req)
+}
+
+// CallTypedContext is like CallTyped, with the context semantics of Client.CallContext.
+func CallTypedContext[Req, Resp any](ctx context.Context, c *Client, proc uint32, req Req) (Resp, error) {
+	var resp Resp
+	err := c.CallContext(ctx, proc, req, &resp)
+	return resp, err
+}
+
+// Procedure is a procedure with typed arguments and results, so that the procedure table of a
+// program can be declared once, and used by both clients and servers without type assertions
+// nor mismatches between them:
+//
+//	var (
+//		GetPort = sunrpc.Procedure[sunrpc.PortmapperMapping, uint32]{
+//			Program: sunrpc.PortmapperProgram, Version: sunrpc.PortmapperVersion, Proc: sunrpc.PortmapperPortGet,
+//		}
+//	)
+//
+//	port, err := GetPort.Call(ctx, client, mapping)
+type Procedure[Req, Resp any] struct {
+	Program uint32
+	Version uint32
+	Proc    uint32
+}
+
+// Call calls the procedure through c, whatever the program and version of c.
+func (p Procedure[Req, Resp]) Call(ctx context.Context, c *Client, req Req) (Resp, error) {
+	var resp Resp
+	err := c.CallProgramContext(ctx, p.Program, p.Version, p.Proc, req, &resp)
+	return resp, err
+}
+
+// Register serves the procedure with handler on s, which can serve other programs (see
+// RegisterProgram). Like for the other procedures, ctx carries the CallInfo of the call, and
+// errors implementing AcceptError are replied with their accept status.
+func (p Procedure[Req, Resp]) Register(s Server, handler func(ctx context.Context, req Req) (Resp, error)) {
+	s.(procedureRegisterer).registerProcedure(p.Program, p.Version, p.Proc,
+		func(ctx context.Context, req Req, reply *Resp) error {
+			resp, err := handler(ctx, req)
+			*reply = resp
+			return err
+		})
+}
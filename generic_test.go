@@ -0,0 +1,54 @@
+//go:build go1.18
+// +build go1.18
+
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type addArgs struct {
+	A, B uint32
+}
+
+var (
+	testAdd    = Procedure[addArgs, uint32]{Program: 0x20000002, Version: 1, Proc: 1}
+	testFailed = Procedure[struct{}, struct{}]{Program: 0x20000002, Version: 1, Proc: 2}
+)
+
+func TestProcedure(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg * 2
+		return nil
+	})
+	testAdd.Register(s, func(ctx context.Context, args addArgs) (uint32, error) {
+		return args.A + args.B, nil
+	})
+	testFailed.Register(s, func(ctx context.Context, args struct{}) (struct{}, error) {
+		return struct{}{}, &ErrProcUnavail{}
+	})
+
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+
+	n, err := CallTyped[uint32, uint32](c, 1, 21)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(42), n)
+
+	n, err = testAdd.Call(context.Background(), c, addArgs{A: 1, B: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), n)
+
+	_, err = testFailed.Call(context.Background(), c, struct{}{})
+	ok := errors.As(err, new(*ErrProcUnavail))
+	assert.True(t, ok)
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
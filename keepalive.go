@@ -0,0 +1,71 @@
+package sunrpc
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/Sirupsen/logrus.v0"
+)
+
+// SetKeepAlive makes the client check its connection once it has been idle for interval, by
+// calling procedure 0 (which is always reserved as a ping). If the check fails, the connection
+// is torn down and established again, so that dead servers and connections silently dropped by
+// the network (e.g. by NAT timeouts) are detected before the next call. Zero disables
+// keepalives.
+//
+// Checks are serialized with calls, and they are not performed while the client is
+// disconnected; clients created with NewClientFromConn cannot reconnect, so they are left
+// disconnected when a check fails.
+func (c *Client) SetKeepAlive(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cfg.KeepAlive = interval
+	if interval <= 0 && c.keepAlive != nil {
+		c.keepAlive.Stop()
+	}
+	c.scheduleKeepAlive()
+}
+
+// scheduleKeepAlive arms the keepalive check, after a call completed. It must be called with
+// c.mu held.
+func (c *Client) scheduleKeepAlive() {
+	if c.cfg.KeepAlive <= 0 || c.disconnected {
+		return
+	}
+
+	c.lastUsed = time.Now()
+	if c.keepAlive == nil {
+		c.keepAlive = time.AfterFunc(c.cfg.KeepAlive, c.checkAlive)
+	} else {
+		c.keepAlive.Reset(c.cfg.KeepAlive)
+	}
+}
+
+// checkAlive pings the server if the connection is idle, and reconnects if it is dead.
+func (c *Client) checkAlive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cfg.KeepAlive <= 0 || c.disconnected || time.Since(c.lastUsed) < c.cfg.KeepAlive {
+		// The connection was used or closed meanwhile
+		return
+	}
+
+	ctx := context.Background()
+	if err := c.call(ctx, c.Program, c.Version, 0, nil, nil); err != nil {
+		log.WithFields(logrus.Fields{
+			"addr": c.Addr,
+			"err":  err,
+		}).Info("Keepalive failed, reconnecting")
+
+		if err := c.reconnect(ctx); err != nil {
+			log.WithFields(logrus.Fields{
+				"addr": c.Addr,
+				"err":  err,
+			}).Info("Cannot reconnect to RPC server")
+			return
+		}
+	}
+	c.scheduleKeepAlive()
+}
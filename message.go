@@ -1,6 +1,7 @@
 package sunrpc
 
 import (
+	"fmt"
 	"sync/atomic"
 	"time"
 )
@@ -14,17 +15,23 @@ type AuthFlavor int32
 
 // All possible authentication flavors.
 const (
-	AuthFlavorNone AuthFlavor = iota
-	AuthFlavorUnix
-	AuthFlavorDes
+	AuthFlavorNone  AuthFlavor = 0
+	AuthFlavorUnix  AuthFlavor = 1
+	AuthFlavorShort AuthFlavor = 2
+	AuthFlavorDes   AuthFlavor = 3
 )
 
+// OpaqueAuth is the opaque_auth of RFC 5531: the credentials or the verifier of a message,
+// whose body is interpreted according to the flavor.
 type OpaqueAuth struct {
 	Flavor AuthFlavor
 	Body   []byte // Must be between 0 and 400 bytes
 }
 
+// AuthNone is the (empty) body of AUTH_NONE credentials.
 type AuthNone struct{}
+
+// AuthUnix is the body of AUTH_UNIX (also known as AUTH_SYS) credentials.
 type AuthUnix struct {
 	Stamp       uint32
 	MachineName string
@@ -32,6 +39,17 @@ type AuthUnix struct {
 	Gids        []uint32
 }
 
+// AuthShort is the body of an AUTH_SHORT credential: an opaque handle, previously issued by
+// the server as a reply verifier, that stands for a full credential.
+type AuthShort struct {
+	Handle []byte
+}
+
+// AuthDH is the identity of a caller authenticated through AUTH_DH.
+type AuthDH struct {
+	Netname string
+}
+
 //
 // RPC Message
 //
@@ -80,6 +98,8 @@ const (
 	InvalidReplyType ReplyType = -1
 )
 
+// ReplyBody is the discriminant of the body of an RPC "Reply" message, which is followed by
+// either an AcceptedReply or a RejectedReply. See ReplyBodyUnion for the whole body.
 type ReplyBody struct {
 	Type ReplyType
 }
@@ -97,12 +117,14 @@ const (
 	SystemErr               = 5
 )
 
-// AcceptedReply is the
+// AcceptedReply is the beginning of the body of a reply to an accepted call: the verifier of
+// the server and the status of the call. See AcceptedReplyBody for the whole body.
 type AcceptedReply struct {
 	Verf OpaqueAuth
 	Type AcceptType
 }
 
+// RejectStat tells the client why the server rejected an RPC call.
 type RejectStat uint32
 
 const (
@@ -112,55 +134,154 @@ const (
 	NoReject RejectStat = 0xFFFFFFFF
 )
 
+// AuthStat tells the client why the server rejected its authentication data.
+//
+// The values are the ones of RFC 5531. Previous releases numbered the constants from
+// AuthBadCred = 0 (which is AUTH_OK on the wire), so that every rejection was sent and
+// reported off by one; code which stored or compared the numeric values must be updated.
 type AuthStat uint32
 
 const (
-	AuthBadCred AuthStat = iota
-	AuthRejectedCred
-	AuthBadVerf
-	AUthRejectedVerf
-	AuthTooWeak
+	AuthOk           AuthStat = 0
+	AuthBadCred      AuthStat = 1 // bad credential (seal broken)
+	AuthRejectedCred AuthStat = 2 // client must begin new session
+	AuthBadVerf      AuthStat = 3 // bad verifier (seal broken)
+	AuthRejectedVerf AuthStat = 4 // verifier expired or replayed
+	AuthTooWeak      AuthStat = 5 // rejected for security reasons
+	AuthInvalidResp  AuthStat = 6 // bogus response verifier
+	AuthFailed       AuthStat = 7 // reason unknown
+
+	// Kerberos errors (RFC 5531)
+	AuthKerbGeneric AuthStat = 8  // kerberos generic error
+	AuthTimeExpire  AuthStat = 9  // time of credential expired
+	AuthTktFile     AuthStat = 10 // problem with ticket file
+	AuthDecode      AuthStat = 11 // can't decode authenticator
+	AuthNetAddr     AuthStat = 12 // wrong net address in ticket
+
+	// RPCSEC_GSS errors (RFC 2203)
+	RpcsecGssCredProblem AuthStat = 13 // no credentials for user
+	RpcsecGssCtxProblem  AuthStat = 14 // problem with context
+
+	// AUthRejectedVerf is a misspelled alias of AuthRejectedVerf, kept for compatibility.
+	AUthRejectedVerf = AuthRejectedVerf
 )
 
+var authStatNames = [...]string{
+	AuthOk:               "AUTH_OK",
+	AuthBadCred:          "AUTH_BADCRED",
+	AuthRejectedCred:     "AUTH_REJECTEDCRED",
+	AuthBadVerf:          "AUTH_BADVERF",
+	AuthRejectedVerf:     "AUTH_REJECTEDVERF",
+	AuthTooWeak:          "AUTH_TOOWEAK",
+	AuthInvalidResp:      "AUTH_INVALIDRESP",
+	AuthFailed:           "AUTH_FAILED",
+	AuthKerbGeneric:      "AUTH_KERB_GENERIC",
+	AuthTimeExpire:       "AUTH_TIMEEXPIRE",
+	AuthTktFile:          "AUTH_TKT_FILE",
+	AuthDecode:           "AUTH_DECODE",
+	AuthNetAddr:          "AUTH_NET_ADDR",
+	RpcsecGssCredProblem: "RPCSEC_GSS_CREDPROBLEM",
+	RpcsecGssCtxProblem:  "RPCSEC_GSS_CTXPROBLEM",
+}
+
+// String returns the name of the status in RFC 5531 (e.g. "AUTH_BADCRED").
+func (s AuthStat) String() string {
+	if s < AuthStat(len(authStatNames)) {
+		return authStatNames[s]
+	}
+	return fmt.Sprintf("AUTH_STAT(%d)", uint32(s))
+}
+
+// Refreshable reports whether the status asks the client to refresh its credentials before
+// retrying: to start a new session (AUTH_REJECTEDCRED), send a fresh verifier
+// (AUTH_REJECTEDVERF), or renew an expired credential or security context. Other statuses
+// mean that the credentials are invalid (e.g. AUTH_BADCRED) or insufficient (AUTH_TOOWEAK,
+// for which a stronger flavor must be used), and retrying with them is pointless.
+func (s AuthStat) Refreshable() bool {
+	switch s {
+	case AuthRejectedCred, AuthRejectedVerf, AuthTimeExpire, RpcsecGssCredProblem, RpcsecGssCtxProblem:
+		return true
+	}
+	return false
+}
+
+// RejectedReply is the beginning of the body of a reply to a rejected call. See
+// RejectedReplyBody for the whole body.
 type RejectedReply struct {
 	Stat RejectStat
 }
 
+// ProgMismatchReply holds the versions supported by the server in PROG_MISMATCH replies.
+//
+// Deprecated: the fields have a platform-dependent size, so it cannot be used for encoding;
+// use MismatchInfo instead.
 type ProgMismatchReply struct {
 	Low  uint
 	High uint
 }
 
+// MismatchInfo is the range of versions supported by the server, returned in PROG_MISMATCH
+// replies (program versions) and RPC_MISMATCH replies (RPC protocol versions).
+type MismatchInfo struct {
+	Low  uint32
+	High uint32
+}
+
+// AcceptedReplyBody is the accepted_reply of RFC 5531. On success, it is followed by the
+// results of the procedure.
+type AcceptedReplyBody struct {
+	Verf         OpaqueAuth
+	Stat         AcceptType   `xdr:"union"`
+	MismatchInfo MismatchInfo `xdr:"unioncase=2"` // ProgMismatch
+}
+
+// RejectedReplyBody is the rejected_reply of RFC 5531.
+type RejectedReplyBody struct {
+	Stat         RejectStat   `xdr:"union"`
+	MismatchInfo MismatchInfo `xdr:"unioncase=0"` // RpcMismatch
+	AuthStat     AuthStat     `xdr:"unioncase=1"` // AuthError
+}
+
+// ReplyBodyUnion is the reply_body of RFC 5531: depending on Type, either Accepted or
+// Rejected is encoded.
+type ReplyBodyUnion struct {
+	Type     ReplyType         `xdr:"union"`
+	Accepted AcceptedReplyBody `xdr:"unioncase=0"`
+	Rejected RejectedReplyBody `xdr:"unioncase=1"`
+}
+
+// RPCMessage is the complete rpc_msg of RFC 5531: the transaction ID, followed by either a
+// call or a reply body, depending on Type. The arguments of calls and the results of
+// successful replies are not part of it: they follow the message on the wire.
+type RPCMessage struct {
+	Xid   uint32
+	Type  MessageType    `xdr:"union"`
+	Call  CallBody       `xdr:"unioncase=0"`
+	Reply ReplyBodyUnion `xdr:"unioncase=1"`
+}
+
+// replyHeaderSize is the size of the header of an accepted reply with an empty verifier: xid,
+// message type, reply type, verifier flavor and length, and accept status.
+const replyHeaderSize = 6 * 4
+
 //
 // Convenience: Procedure Call
 //
 
 // ProcedureCall combines the RPC Message header with RPC Call body (except for function arguments)
-// for convenience during (de)serialization.
+// for convenience during (de)serialization. It is encoded like an RPCMessage of type Call.
 type ProcedureCall struct {
 	Header Message
 	Body   CallBody
 }
 
-// ProcedureReply is the reply to a procedure call
+// ProcedureReply is the reply to a procedure call (except for the results). It is encoded
+// like an RPCMessage of type Reply.
 type ProcedureReply struct {
 	Header   Message
-	Type     ReplyType `xdr:"union"`
-	Accepted struct {
-		Verf         OpaqueAuth
-		Stat         AcceptType `xdr:"union"`
-		MismatchInfo struct {
-			Low, High uint32
-		} `xdr:"unioncase=2"` // ProgMismatch
-		// results follow here
-	} `xdr:"unioncase=0"`
-	Rejected struct {
-		Stat         RejectStat `xdr:"union"`
-		MismatchInfo struct {
-			Low, High uint32
-		} `xdr:"unioncase=0"` // RpcMismatch
-		AuthStat AuthStat `xdr:"unioncase=0"` // AuthError
-	} `xdr:"unioncase=1"`
+	Type     ReplyType         `xdr:"union"`
+	Accepted AcceptedReplyBody `xdr:"unioncase=0"` // results follow here
+	Rejected RejectedReplyBody `xdr:"unioncase=1"`
 }
 
 var xidCounter = int32(time.Now().UnixNano())
@@ -0,0 +1,197 @@
+package sunrpc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+// Messages encoded as specified by RFC 5531, section 9.
+var rpcMessageVectors = []struct {
+	name    string
+	encoded []byte
+	msg     RPCMessage
+}{
+	{
+		name: "call",
+		encoded: []byte{
+			0x00, 0x00, 0x00, 0x01, // Xid
+			0x00, 0x00, 0x00, 0x00, // CALL
+			0x00, 0x00, 0x00, 0x02, // RPC version 2
+			0x00, 0x01, 0x86, 0xa3, // Program (NFS)
+			0x00, 0x00, 0x00, 0x03, // Version
+			0x00, 0x00, 0x00, 0x01, // Procedure
+			0x00, 0x00, 0x00, 0x01, // Cred: AUTH_UNIX
+			0x00, 0x00, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf: AUTH_NONE
+		},
+		msg: RPCMessage{
+			Xid:  1,
+			Type: Call,
+			Call: CallBody{
+				RPCVersion: 2,
+				Program:    100003,
+				Version:    3,
+				Procedure:  1,
+				Cred:       OpaqueAuth{Flavor: AuthFlavorUnix, Body: []byte{0xde, 0xad, 0xbe, 0xef}},
+				Verf:       OpaqueAuth{Flavor: AuthFlavorNone},
+			},
+		},
+	},
+	{
+		name: "success",
+		encoded: []byte{
+			0x00, 0x00, 0x00, 0x02, // Xid
+			0x00, 0x00, 0x00, 0x01, // REPLY
+			0x00, 0x00, 0x00, 0x00, // MSG_ACCEPTED
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf: AUTH_NONE
+			0x00, 0x00, 0x00, 0x00, // SUCCESS
+		},
+		msg: RPCMessage{
+			Xid:  2,
+			Type: Reply,
+			Reply: ReplyBodyUnion{
+				Type: Accepted,
+				Accepted: AcceptedReplyBody{
+					Verf: OpaqueAuth{Flavor: AuthFlavorNone},
+					Stat: Success,
+				},
+			},
+		},
+	},
+	{
+		name: "prog mismatch",
+		encoded: []byte{
+			0x00, 0x00, 0x00, 0x03, // Xid
+			0x00, 0x00, 0x00, 0x01, // REPLY
+			0x00, 0x00, 0x00, 0x00, // MSG_ACCEPTED
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf: AUTH_NONE
+			0x00, 0x00, 0x00, 0x02, // PROG_MISMATCH
+			0x00, 0x00, 0x00, 0x02, // Low
+			0x00, 0x00, 0x00, 0x04, // High
+		},
+		msg: RPCMessage{
+			Xid:  3,
+			Type: Reply,
+			Reply: ReplyBodyUnion{
+				Type: Accepted,
+				Accepted: AcceptedReplyBody{
+					Verf:         OpaqueAuth{Flavor: AuthFlavorNone},
+					Stat:         ProgMismatch,
+					MismatchInfo: MismatchInfo{Low: 2, High: 4},
+				},
+			},
+		},
+	},
+	{
+		name: "rpc mismatch",
+		encoded: []byte{
+			0x00, 0x00, 0x00, 0x04, // Xid
+			0x00, 0x00, 0x00, 0x01, // REPLY
+			0x00, 0x00, 0x00, 0x01, // MSG_DENIED
+			0x00, 0x00, 0x00, 0x00, // RPC_MISMATCH
+			0x00, 0x00, 0x00, 0x02, // Low
+			0x00, 0x00, 0x00, 0x02, // High
+		},
+		msg: RPCMessage{
+			Xid:  4,
+			Type: Reply,
+			Reply: ReplyBodyUnion{
+				Type: Denied,
+				Rejected: RejectedReplyBody{
+					Stat:         RpcMismatch,
+					MismatchInfo: MismatchInfo{Low: 2, High: 2},
+				},
+			},
+		},
+	},
+	{
+		name: "auth error",
+		encoded: []byte{
+			0x00, 0x00, 0x00, 0x05, // Xid
+			0x00, 0x00, 0x00, 0x01, // REPLY
+			0x00, 0x00, 0x00, 0x01, // MSG_DENIED
+			0x00, 0x00, 0x00, 0x01, // AUTH_ERROR
+			0x00, 0x00, 0x00, 0x05, // AUTH_TOOWEAK
+		},
+		msg: RPCMessage{
+			Xid:  5,
+			Type: Reply,
+			Reply: ReplyBodyUnion{
+				Type: Denied,
+				Rejected: RejectedReplyBody{
+					Stat:     AuthError,
+					AuthStat: AuthTooWeak,
+				},
+			},
+		},
+	},
+}
+
+func TestRPCMessageRoundTrip(t *testing.T) {
+	for _, v := range rpcMessageVectors {
+		var buf bytes.Buffer
+		_, err := xdr.Marshal(&buf, &v.msg)
+		assert.Nil(t, err, v.name)
+		assert.Equal(t, v.encoded, buf.Bytes(), v.name)
+
+		var msg RPCMessage
+		_, err = xdr.Unmarshal(bytes.NewReader(v.encoded), &msg)
+		assert.Nil(t, err, v.name)
+		assert.Equal(t, v.msg, msg, v.name)
+	}
+}
+
+func TestProcedureReplyMatchesRPCMessage(t *testing.T) {
+	for _, v := range rpcMessageVectors {
+		if v.msg.Type != Reply {
+			continue
+		}
+
+		reply, rest, err := DecodeReplyBody(v.encoded)
+		assert.Nil(t, err, v.name)
+		assert.Empty(t, rest, v.name)
+		assert.Equal(t, v.msg.Xid, reply.Header.Xid, v.name)
+		assert.Equal(t, v.msg.Reply.Type, reply.Type, v.name)
+		assert.Equal(t, v.msg.Reply.Accepted, reply.Accepted, v.name)
+		assert.Equal(t, v.msg.Reply.Rejected, reply.Rejected, v.name)
+	}
+}
+
+func TestAuthStatValues(t *testing.T) {
+	// RFC 5531, section 9 and RFC 2203, section 5.3.3.3
+	for stat, name := range []string{
+		"AUTH_OK", "AUTH_BADCRED", "AUTH_REJECTEDCRED", "AUTH_BADVERF", "AUTH_REJECTEDVERF",
+		"AUTH_TOOWEAK", "AUTH_INVALIDRESP", "AUTH_FAILED", "AUTH_KERB_GENERIC",
+		"AUTH_TIMEEXPIRE", "AUTH_TKT_FILE", "AUTH_DECODE", "AUTH_NET_ADDR",
+		"RPCSEC_GSS_CREDPROBLEM", "RPCSEC_GSS_CTXPROBLEM",
+	} {
+		assert.Equal(t, name, AuthStat(stat).String())
+	}
+	assert.Equal(t, AuthStat(1), AuthBadCred)
+	assert.Equal(t, AuthStat(5), AuthTooWeak)
+	assert.Equal(t, AuthRejectedVerf, AUthRejectedVerf)
+}
+
+func TestWriteReplyMessageRejectedAuth(t *testing.T) {
+	s := newServer(0x20000001, 1, nil)
+	for _, stat := range []AuthStat{AuthBadCred, AuthRejectedCred, AuthBadVerf, AuthRejectedVerf, AuthTooWeak} {
+		var buf bytes.Buffer
+		assert.Nil(t, s.WriteReplyMessageRejectedAuth(&buf, 5, stat))
+		assert.Equal(t, []byte{
+			0x00, 0x00, 0x00, 0x05, // Xid
+			0x00, 0x00, 0x00, 0x01, // REPLY
+			0x00, 0x00, 0x00, 0x01, // MSG_DENIED
+			0x00, 0x00, 0x00, 0x01, // AUTH_ERROR
+			0x00, 0x00, 0x00, byte(stat),
+		}, buf.Bytes(), stat.String())
+
+		reply, rest, err := DecodeReplyBody(buf.Bytes())
+		assert.Nil(t, err)
+		assert.Empty(t, rest)
+		assert.Equal(t, ReplyType(Denied), reply.Type)
+		assert.Equal(t, RejectedReplyBody{Stat: AuthError, AuthStat: stat}, reply.Rejected)
+	}
+}
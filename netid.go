@@ -0,0 +1,155 @@
+package sunrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Netid describes a transport identified by a netid, as used by rpcbind and by the netconfig
+// database of TI-RPC (e.g. "tcp6"). Along with universal addresses, netids allow higher-level
+// code to select the transport of a service symbolically.
+type Netid struct {
+	Name    string // netid, e.g. "tcp6"
+	Network string // Go network, as passed to net.Dial (e.g. "tcp6", "unix")
+	Stream  bool   // stream transport, using record marking (otherwise, datagrams)
+	Local   bool   // local transport, whose universal addresses are paths (otherwise, IP)
+
+	// DialContext opens connections over the transport (default: net.Dialer.DialContext).
+	// It is passed Network, and an address in net.Dial format.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+var netids = struct {
+	sync.RWMutex
+	m map[string]Netid
+}{
+	m: map[string]Netid{
+		"tcp":   {Name: "tcp", Network: "tcp4", Stream: true},
+		"udp":   {Name: "udp", Network: "udp4"},
+		"tcp6":  {Name: "tcp6", Network: "tcp6", Stream: true},
+		"udp6":  {Name: "udp6", Network: "udp6"},
+		"local": {Name: "local", Network: "unix", Stream: true, Local: true},
+	},
+}
+
+// RegisterNetid adds a netid to the registry, or replaces the one with the same name. This
+// allows to use the transports of netconfig entries other than the standard ones ("tcp",
+// "udp", "tcp6", "udp6" and "local"), or to dial them differently.
+func RegisterNetid(n Netid) {
+	netids.Lock()
+	defer netids.Unlock()
+	netids.m[n.Name] = n
+}
+
+// LookupNetid returns the transport registered for a netid.
+func LookupNetid(name string) (Netid, bool) {
+	netids.RLock()
+	defer netids.RUnlock()
+	n, ok := netids.m[name]
+	return n, ok
+}
+
+// Netids returns the names of the registered netids, in order.
+func Netids() []string {
+	netids.RLock()
+	defer netids.RUnlock()
+	var names []string
+	for name := range netids.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Protocol returns the framing of the messages exchanged over the transport: Tcp for
+// stream transports (including local ones), Udp for datagram transports.
+func (n Netid) Protocol() PortmapperProtocol {
+	if n.Stream {
+		return Tcp
+	}
+	return Udp
+}
+
+// Addr converts a universal address of the transport to the net.Dial format.
+func (n Netid) Addr(uaddr string) (string, error) {
+	if n.Local {
+		return uaddr, nil
+	}
+	ip, port, err := ParseUniversalAddr(uaddr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+// UniversalAddr converts an address of the transport in net.Dial format (with a numeric IP
+// address and port) to a universal address.
+func (n Netid) UniversalAddr(addr string) (string, error) {
+	if n.Local {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return "", fmt.Errorf("invalid address: %q", addr)
+	}
+	return FormatUniversalAddr(ip, uint32(p)), nil
+}
+
+// Dial connects to the universal address uaddr over the transport.
+func (n Netid) Dial(ctx context.Context, uaddr string) (net.Conn, error) {
+	addr, err := n.Addr(uaddr)
+	if err != nil {
+		return nil, err
+	}
+	return n.dial(ctx, addr)
+}
+
+func (n Netid) dial(ctx context.Context, addr string) (net.Conn, error) {
+	dial := n.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return dial(ctx, n.Network, addr)
+}
+
+// FormatUniversalAddr encodes a TCP or UDP universal address (see ParseUniversalAddr).
+func FormatUniversalAddr(ip net.IP, port uint32) string {
+	return fmt.Sprintf("%s.%d.%d", ip, port>>8&0xff, port&0xff)
+}
+
+// NewClientNetid is like NewClient, but the server is reached at the universal address uaddr,
+// over the transport identified by netid (e.g. as returned by rpcbind). The transport and
+// dialer of the netid replace the ones of cfg.
+func NewClientNetid(netid, uaddr string, program, version uint32, cfg *ClientConfig) (*Client, error) {
+	n, ok := LookupNetid(netid)
+	if !ok {
+		return nil, fmt.Errorf("unknown netid: %q", netid)
+	}
+	addr, err := n.Addr(uaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ncfg ClientConfig
+	if cfg != nil {
+		ncfg = *cfg
+	}
+	ncfg.Transport = ClientTransportUdpOnly
+	if n.Stream {
+		ncfg.Transport = ClientTransportTcpOnly
+	}
+	ncfg.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return n.dial(ctx, addr)
+	}
+	return NewClient(addr, program, version, &ncfg), nil
+}
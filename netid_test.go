@@ -0,0 +1,69 @@
+package sunrpc
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetidAddr(t *testing.T) {
+	n, ok := LookupNetid("tcp6")
+	assert.True(t, ok)
+	assert.Equal(t, Tcp, n.Protocol())
+
+	addr, err := n.Addr("::1.8.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "[::1]:2049", addr)
+
+	uaddr, err := n.UniversalAddr(addr)
+	assert.Nil(t, err)
+	assert.Equal(t, "::1.8.1", uaddr)
+
+	_, ok = NetidProtocol("local")
+	assert.False(t, ok)
+}
+
+func TestNewClientNetidLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sunrpc")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rpc.sock")
+	ln, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(args struct{}, reply *struct{}) error {
+		return nil
+	})
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.ServeConn(conn)
+		}
+	}()
+
+	c, err := NewClientNetid("local", path, 0x20000001, 1, nil)
+	assert.Nil(t, err)
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.Equal(t, uint32(2), reply)
+	c.Close()
+
+	_, err = NewClientNetid("ticlts", path, 0x20000001, 1, nil)
+	assert.NotNil(t, err)
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
@@ -0,0 +1,261 @@
+package sunrpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// Adapters between net/rpc and SunRPC. net/rpc identifies methods by name ("Service.Method"),
+// so both codecs are configured with a table mapping method names to procedure numbers of
+// a single program/version.
+
+type clientCodec struct {
+	conn    io.ReadWriteCloser
+	program uint32
+	version uint32
+	procs   map[string]uint32
+
+	mu      sync.Mutex
+	pending map[uint32]uint64 // xid -> net/rpc sequence number
+	body    *bytes.Buffer     // results of the reply being read
+}
+
+// NewClientCodec returns a net/rpc ClientCodec speaking SunRPC over a stream connection (such as
+// TCP), to the specified program and version. procs maps net/rpc method names to procedure
+// numbers. Use it with rpc.NewClientWithCodec.
+func NewClientCodec(conn io.ReadWriteCloser, program, version uint32, procs map[string]uint32) rpc.ClientCodec {
+	return &clientCodec{
+		conn:    conn,
+		program: program,
+		version: version,
+		procs:   procs,
+		pending: make(map[uint32]uint64),
+	}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, args interface{}) error {
+	proc, found := c.procs[r.ServiceMethod]
+	if !found {
+		return fmt.Errorf("unknown method %q", r.ServiceMethod)
+	}
+
+	xid := uint32(r.Seq)
+	call := ProcedureCall{
+		Header: Message{Xid: xid, Type: Call},
+		Body: CallBody{
+			RPCVersion: 2,
+			Program:    c.program,
+			Version:    c.version,
+			Procedure:  proc,
+		},
+	}
+
+	var buf bytes.Buffer
+	if _, err := xdr.Marshal(&buf, &call); err != nil {
+		return err
+	}
+	if args != nil {
+		if _, err := xdr.Marshal(&buf, args); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.pending[xid] = r.Seq
+	c.mu.Unlock()
+
+	return WriteTCPReplyMessage(c.conn, buf.Bytes())
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	record, err := ReadRecord(c.conn)
+	if err != nil {
+		return err
+	}
+
+	var reply ProcedureReply
+	if _, err := xdr.Unmarshal(record, &reply); err != nil {
+		return err
+	}
+	if reply.Header.Type != Reply {
+		return fmt.Errorf("expected a reply message")
+	}
+
+	c.mu.Lock()
+	seq, found := c.pending[reply.Header.Xid]
+	delete(c.pending, reply.Header.Xid)
+	c.mu.Unlock()
+	if !found {
+		return fmt.Errorf("reply with unknown xid %v", reply.Header.Xid)
+	}
+
+	r.Seq = seq
+	r.Error = ""
+	c.body = record
+
+	if err := replyError(&reply); err != nil {
+		r.Error = err.Error()
+	}
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	record := c.body
+	c.body = nil
+
+	if body == nil || record == nil {
+		return nil
+	}
+	_, err := xdr.Unmarshal(record, body)
+	return err
+}
+
+func (c *clientCodec) Close() error {
+	return c.conn.Close()
+}
+
+type serverCodec struct {
+	conn    io.ReadWriteCloser
+	program uint32
+	version uint32
+	methods map[uint32]string
+
+	wmu     sync.Mutex // serializes writes to conn
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*serverRequest // by net/rpc sequence number
+	args    *bytes.Buffer             // arguments of the call being read
+	argsSeq uint64                    // sequence number of the call being read
+}
+
+// serverRequest is a call being processed by the net/rpc server.
+type serverRequest struct {
+	xid     uint32
+	garbage bool // the arguments could not be decoded
+}
+
+// NewServerCodec returns a net/rpc ServerCodec speaking SunRPC over a stream connection (such as
+// TCP), serving the specified program and version. procs maps net/rpc method names to procedure
+// numbers. Use it with rpc.ServeCodec.
+//
+// Calls to other programs or versions, or to procedures missing from procs, are replied
+// directly by the codec, without involving the net/rpc server. Calls whose arguments cannot
+// be decoded are replied with GARBAGE_ARGS, and the ones for which the method returns an
+// error with SYSTEM_ERR.
+func NewServerCodec(conn io.ReadWriteCloser, program, version uint32, procs map[string]uint32) rpc.ServerCodec {
+	methods := make(map[uint32]string, len(procs))
+	for name, proc := range procs {
+		methods[proc] = name
+	}
+
+	return &serverCodec{
+		conn:    conn,
+		program: program,
+		version: version,
+		methods: methods,
+		pending: make(map[uint64]*serverRequest),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		record, err := ReadRecord(c.conn)
+		if err != nil {
+			return err
+		}
+
+		call, err := ReadProcedureCall(record)
+		if err != nil {
+			return err
+		}
+
+		var stat AcceptType = Success
+		var ret interface{}
+		method, found := c.methods[call.Body.Procedure]
+		switch {
+		case call.Body.Program != c.program:
+			stat = ProgUnavail
+		case call.Body.Version != c.version:
+			stat = ProgMismatch
+			ret = &MismatchInfo{Low: c.version, High: c.version}
+		case !found:
+			stat = ProcUnavail
+		}
+
+		if stat != Success {
+			if err := c.write(call.Header.Xid, stat, ret); err != nil {
+				return err
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		c.seq++
+		c.pending[c.seq] = &serverRequest{xid: call.Header.Xid}
+		r.Seq = c.seq
+		c.mu.Unlock()
+
+		r.ServiceMethod = method
+		c.args, c.argsSeq = record, r.Seq
+		return nil
+	}
+}
+
+func (c *serverCodec) ReadRequestBody(args interface{}) error {
+	record := c.args
+	c.args = nil
+
+	if args == nil || record == nil {
+		return nil
+	}
+	if _, err := xdr.Unmarshal(record, args); err != nil {
+		// net/rpc replies with the error, which must be reported as GARBAGE_ARGS
+		c.mu.Lock()
+		if req, found := c.pending[c.argsSeq]; found {
+			req.garbage = true
+		}
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, reply interface{}) error {
+	c.mu.Lock()
+	req, found := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+	if !found {
+		return fmt.Errorf("response for unknown request %v", r.Seq)
+	}
+
+	if req.garbage {
+		log.WithField("err", r.Error).Error("Cannot decode procedure arguments")
+		return c.write(req.xid, GarbageArgs, nil)
+	}
+	if r.Error != "" {
+		log.WithField("err", r.Error).Error("net/rpc call failed")
+		return c.write(req.xid, SystemErr, nil)
+	}
+	return c.write(req.xid, Success, reply)
+}
+
+func (c *serverCodec) Close() error {
+	return c.conn.Close()
+}
+
+func (c *serverCodec) write(xid uint32, stat AcceptType, ret interface{}) error {
+	var buf bytes.Buffer
+	if err := writeAcceptedReply(&buf, xid, OpaqueAuth{}, stat, ret); err != nil {
+		return err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return WriteTCPReplyMessage(c.conn, buf.Bytes())
+}
@@ -0,0 +1,109 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ArithArgs and Arith are served through net/rpc, which only accepts exported types.
+type ArithArgs struct {
+	A, B uint32
+}
+
+type Arith struct{}
+
+func (Arith) Mul(args ArithArgs, reply *uint32) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (Arith) Div(args ArithArgs, reply *uint32) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+// serveNetRPC serves the Arith service on one end of a pipe, returning the other one.
+func serveNetRPC(t *testing.T, procs map[string]uint32) net.Conn {
+	srv := rpc.NewServer()
+	assert.Nil(t, srv.RegisterName("Arith", Arith{}))
+	client, server := net.Pipe()
+	go srv.ServeCodec(NewServerCodec(server, 0x20000001, 1, procs))
+	return client
+}
+
+func TestNetRPCCodecs(t *testing.T) {
+	procs := map[string]uint32{"Arith.Mul": 1, "Arith.Div": 2}
+
+	// net/rpc client and server
+	c := rpc.NewClientWithCodec(NewClientCodec(serveNetRPC(t, procs), 0x20000001, 1, procs))
+	var reply uint32
+	assert.Nil(t, c.Call("Arith.Mul", ArithArgs{6, 7}, &reply))
+	assert.Equal(t, uint32(42), reply)
+	assert.Nil(t, c.Call("Arith.Div", ArithArgs{42, 6}, &reply))
+	assert.Equal(t, uint32(7), reply)
+
+	// Errors returned by methods are replied with SYSTEM_ERR
+	err := c.Call("Arith.Div", ArithArgs{42, 0}, &reply)
+	assert.Equal(t, rpc.ServerError((&RPCAcceptError{Stat: SystemErr}).Error()), err)
+	assert.Nil(t, c.Call("Arith.Mul", ArithArgs{2, 3}, &reply))
+	assert.Equal(t, uint32(6), reply)
+	assert.NotNil(t, c.Call("Arith.Add", ArithArgs{2, 3}, &reply))
+	c.Close()
+}
+
+func TestNetRPCServerCodec(t *testing.T) {
+	procs := map[string]uint32{"Arith.Mul": 1}
+	conn := serveNetRPC(t, procs)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	var reply uint32
+	assert.Nil(t, c.Call(1, ArithArgs{6, 7}, &reply))
+	assert.Equal(t, uint32(42), reply)
+
+	// Arguments which cannot be decoded
+	garbage := errors.As(c.Call(1, uint32(6), &reply), new(*ErrGarbageArgs))
+	assert.True(t, garbage)
+
+	// Calls which are not forwarded to the net/rpc server
+	unavail := errors.As(c.Call(2, ArithArgs{6, 7}, &reply), new(*ErrProcUnavail))
+	assert.True(t, unavail)
+	assert.Equal(t, &RPCAcceptError{Stat: ProgMismatch, Low: 1, High: 1}, c.CallProgram(0x20000001, 2, 1, ArithArgs{6, 7}, &reply))
+	unavail = errors.As(c.CallProgram(0x20000002, 1, 1, ArithArgs{6, 7}, &reply), new(*ErrProgUnavail))
+	assert.True(t, unavail)
+
+	assert.Nil(t, c.Call(1, ArithArgs{2, 3}, &reply))
+	assert.Equal(t, uint32(6), reply)
+	c.Close()
+}
+
+func TestNetRPCClientCodec(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(args ArithArgs, reply *uint32) error {
+		*reply = args.A + args.B
+		return nil
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := rpc.NewClientWithCodec(NewClientCodec(conn, 0x20000001, 1, map[string]uint32{"Arith.Add": 1, "Arith.Sub": 2}))
+	var reply uint32
+	assert.Nil(t, c.Call("Arith.Add", ArithArgs{6, 7}, &reply))
+	assert.Equal(t, uint32(13), reply)
+
+	// RPC errors are reported as server errors, and the connection stays usable
+	err = c.Call("Arith.Sub", ArithArgs{6, 7}, &reply)
+	assert.Equal(t, rpc.ServerError((&ErrProcUnavail{}).Error()), err)
+	assert.Nil(t, c.Call("Arith.Add", ArithArgs{1, 1}, &reply))
+	assert.Equal(t, uint32(2), reply)
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
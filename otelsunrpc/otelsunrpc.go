@@ -0,0 +1,112 @@
+// Package otelsunrpc records the calls served and performed by the sunrpc package as
+// OpenTelemetry spans, so that they show up in distributed traces.
+//
+// ONC RPC has no way to carry the context of a trace across calls, so the spans of a server
+// are not linked to the ones of its callers: they are children of the span (if any) in the
+// context the tracer is given, and client spans are children of the span in the context of
+// the call.
+//
+//	server.SetTracer(otelsunrpc.NewTracer(nil))
+//	client := sunrpc.NewClient(addr, program, version, &sunrpc.ClientConfig{
+//		Tracer: otelsunrpc.NewTracer(nil),
+//	})
+package otelsunrpc
+
+import (
+	"context"
+	"strconv"
+
+	sunrpc "github.com/mzpqnxow/go-sunrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer used to create the spans.
+const instrumentationName = "github.com/mzpqnxow/go-sunrpc/otelsunrpc"
+
+// Attributes of the spans, besides the network ones.
+const (
+	SystemKey    = attribute.Key("rpc.system")
+	ProgramKey   = attribute.Key("rpc.onc_rpc.program")
+	VersionKey   = attribute.Key("rpc.onc_rpc.version")
+	ProcedureKey = attribute.Key("rpc.onc_rpc.procedure")
+	XidKey       = attribute.Key("rpc.onc_rpc.xid")
+
+	// AcceptStatKey and RejectStatKey hold the status of the calls which are replied with an
+	// error, and AuthStatKey the reason of authentication failures.
+	AcceptStatKey = attribute.Key("rpc.onc_rpc.accept_stat")
+	RejectStatKey = attribute.Key("rpc.onc_rpc.reject_stat")
+	AuthStatKey   = attribute.Key("rpc.onc_rpc.auth_stat")
+
+	transportKey   = attribute.Key("network.transport")
+	peerAddressKey = attribute.Key("network.peer.address")
+)
+
+// NewTracer returns a CallTracer, for the SetTracer method of the servers or for
+// ClientConfig.Tracer, which records each call as a span created with tp (the global
+// provider, if nil).
+//
+// Spans are named after the program, version and procedure of the call (e.g. "100003.3/1"),
+// and have the server or client kind. Calls which fail have the error status: this includes
+// the calls replied with an error by the server, whose status is recorded as an attribute.
+func NewTracer(tp trace.TracerProvider) sunrpc.CallTracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer := tp.Tracer(instrumentationName)
+
+	return func(ctx context.Context, info *sunrpc.TraceInfo) (context.Context, func(err error)) {
+		kind := trace.SpanKindClient
+		if info.Server {
+			kind = trace.SpanKindServer
+		}
+
+		attrs := []attribute.KeyValue{
+			SystemKey.String("onc_rpc"),
+			ProgramKey.Int64(int64(info.Program)),
+			VersionKey.Int64(int64(info.Version)),
+			ProcedureKey.Int64(int64(info.Procedure)),
+			XidKey.Int64(int64(info.Xid)),
+		}
+		if info.Transport != "" {
+			attrs = append(attrs, transportKey.String(info.Transport))
+		}
+		if info.Peer != nil {
+			attrs = append(attrs, peerAddressKey.String(info.Peer.String()))
+		}
+
+		ctx, span := tracer.Start(ctx, spanName(info),
+			trace.WithSpanKind(kind),
+			trace.WithAttributes(attrs...))
+
+		return ctx, func(err error) {
+			if err != nil {
+				setError(span, err)
+			}
+			span.End()
+		}
+	}
+}
+
+func spanName(info *sunrpc.TraceInfo) string {
+	return strconv.FormatUint(uint64(info.Program), 10) + "." +
+		strconv.FormatUint(uint64(info.Version), 10) + "/" +
+		strconv.FormatUint(uint64(info.Procedure), 10)
+}
+
+// setError records the failure of a call on its span.
+func setError(span trace.Span, err error) {
+	switch e := err.(type) {
+	case sunrpc.AcceptError:
+		span.SetAttributes(AcceptStatKey.Int64(int64(e.AcceptStat())))
+	case sunrpc.RejectError:
+		span.SetAttributes(RejectStatKey.Int64(int64(e.RejectStat())))
+		if stat, ok := sunrpc.AuthErrorStat(e); ok {
+			span.SetAttributes(AuthStatKey.Int64(int64(stat)))
+		}
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
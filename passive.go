@@ -0,0 +1,232 @@
+package sunrpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// PassiveMessage is an RPC message decoded by a PassiveDecoder.
+type PassiveMessage struct {
+	Offset int64 // offset of the message in its stream (of the record marker, for records)
+
+	// Call or Reply holds the header of the message, and Body the encoded arguments (calls)
+	// or results (successful replies) that follow it.
+	Call  *ProcedureCall
+	Reply *ProcedureReply
+	Body  []byte
+
+	// Request is the call a reply answers, when the decoder saw it (e.g. on the stream of the
+	// other direction of the connection): it tells how to decode the results.
+	Request *ProcedureCall
+
+	// Err is set when no message could be decoded: the data was not an RPC message, bytes
+	// were skipped to find the boundary of the next record, or the stream could not be read.
+	// Call and Reply are then nil.
+	Err error
+}
+
+// PassiveDecoder decodes the RPC messages exchanged by other parties, e.g. captured with pcap
+// or received from a mirror port, to build traffic analyzers. The calls decoded are kept (up
+// to MaxPending of them), so that replies decoded later by the same decoder, on any stream,
+// can be matched with them by transaction ID.
+//
+// Unlike the other functions of the package, the decoder assumes the stream may be captured
+// in the middle of a message, or have gaps: until it finds a plausible call or reply, it
+// skips data one byte at a time.
+type PassiveDecoder struct {
+	// MaxRecordSize is the maximum size of the records reassembled from streams (default:
+	// 16 MB). Larger ones are assumed to be caused by a desynchronization.
+	MaxRecordSize int
+
+	// MaxPending is the maximum number of calls waiting to be matched with their reply
+	// (default: 4096). When it is reached, arbitrary calls are forgotten.
+	MaxPending int
+
+	mu      sync.Mutex
+	pending map[uint32]*ProcedureCall
+}
+
+// NewPassiveDecoder creates a decoder.
+func NewPassiveDecoder() *PassiveDecoder {
+	return &PassiveDecoder{pending: make(map[uint32]*ProcedureCall)}
+}
+
+// DecodeMessage decodes a message received without record marking (e.g. an UDP datagram).
+func (d *PassiveDecoder) DecodeMessage(b []byte) *PassiveMessage {
+	msg := &PassiveMessage{}
+	d.decode(msg, b)
+	return msg
+}
+
+func (d *PassiveDecoder) decode(msg *PassiveMessage, b []byte) {
+	if len(b) >= 8 && binary.BigEndian.Uint32(b[4:]) == uint32(Reply) {
+		if msg.Reply, msg.Body, msg.Err = DecodeReplyBody(b); msg.Err == nil {
+			msg.Request = d.match(msg.Reply.Header.Xid)
+		}
+		return
+	}
+	if msg.Call, msg.Body, msg.Err = DecodeCallBody(b); msg.Err == nil {
+		d.track(msg.Call)
+	}
+}
+
+// Decode reads the records of a stream transport (one direction of a TCP connection) from r,
+// and sends the messages they hold to the returned channel. The channel is closed once r is
+// exhausted (after a message reporting the read error, if it is not io.EOF), or ctx is done.
+func (d *PassiveDecoder) Decode(ctx context.Context, r io.Reader) <-chan *PassiveMessage {
+	ch := make(chan *PassiveMessage, 16)
+	go func() {
+		defer close(ch)
+		s := &passiveStream{d: d, br: bufio.NewReaderSize(r, 64*1024)}
+		for {
+			msg := s.next()
+			if msg == nil {
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (d *PassiveDecoder) maxRecordSize() int {
+	if d.MaxRecordSize > 0 {
+		return d.MaxRecordSize
+	}
+	return 16 << 20
+}
+
+// track records a call, to match it with its reply.
+func (d *PassiveDecoder) track(call *ProcedureCall) {
+	max := d.MaxPending
+	if max <= 0 {
+		max = 4096
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for xid := range d.pending {
+		if len(d.pending) < max {
+			break
+		}
+		delete(d.pending, xid)
+	}
+	d.pending[call.Header.Xid] = call
+}
+
+// match returns the call replied with xid, if it was seen.
+func (d *PassiveDecoder) match(xid uint32) *ProcedureCall {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	call := d.pending[xid]
+	delete(d.pending, xid)
+	return call
+}
+
+// passiveStream splits a stream into records.
+type passiveStream struct {
+	d      *PassiveDecoder
+	br     *bufio.Reader
+	offset int64
+	synced bool // the current offset is known to be a record boundary
+	done   bool
+}
+
+// next returns the next message of the stream, or nil at its end.
+func (s *passiveStream) next() *PassiveMessage {
+	if s.done {
+		return nil
+	}
+
+	if !s.synced {
+		start := s.offset
+		for !s.plausibleRecord() {
+			if _, err := s.br.Discard(1); err != nil {
+				return s.end(err)
+			}
+			s.offset++
+		}
+		s.synced = true
+		if s.offset > start {
+			return &PassiveMessage{
+				Offset: start,
+				Err:    fmt.Errorf("skipped %d bytes to find a record boundary", s.offset-start),
+			}
+		}
+	}
+
+	msg := &PassiveMessage{Offset: s.offset}
+	var record []byte
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(s.br, marker[:]); err != nil {
+			if err == io.EOF && len(record) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return s.end(err)
+		}
+		s.offset += 4
+
+		size, last := ParseRecordMarker(binary.BigEndian.Uint32(marker[:]))
+		if size == 0 || len(record)+int(size) > s.d.maxRecordSize() {
+			s.synced = false
+			return &PassiveMessage{Offset: msg.Offset, Err: fmt.Errorf("invalid record marker %#x", marker)}
+		}
+
+		start := len(record)
+		record = append(record, make([]byte, size)...)
+		n, err := io.ReadFull(s.br, record[start:])
+		s.offset += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return s.end(err)
+		}
+		if last {
+			break
+		}
+	}
+
+	s.d.decode(msg, record)
+	return msg
+}
+
+// plausibleRecord reports whether the stream looks positioned at the beginning of a record
+// holding a call (RPC version 2) or a reply (with a valid reply status).
+func (s *passiveStream) plausibleRecord() bool {
+	b, _ := s.br.Peek(16)
+	if len(b) < 16 {
+		return false
+	}
+	size, _ := ParseRecordMarker(binary.BigEndian.Uint32(b))
+	if size < 12 || int(size) > s.d.maxRecordSize() {
+		return false
+	}
+	switch binary.BigEndian.Uint32(b[8:]) {
+	case uint32(Call):
+		return binary.BigEndian.Uint32(b[12:]) == 2
+	case uint32(Reply):
+		stat := binary.BigEndian.Uint32(b[12:])
+		return stat == uint32(Accepted) || stat == uint32(Denied)
+	}
+	return false
+}
+
+// end terminates the stream, returning the message reporting err (nil at the end of the
+// stream).
+func (s *passiveStream) end(err error) *PassiveMessage {
+	s.done = true
+	if err == io.EOF {
+		return nil
+	}
+	return &PassiveMessage{Offset: s.offset, Err: err}
+}
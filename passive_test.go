@@ -0,0 +1,63 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassiveDecoder(t *testing.T) {
+	call := NewProcedureCall(PortmapperProgram, PortmapperVersion, PortmapperPortGet)
+	call.Header.Xid = 42
+	var msg bytes.Buffer
+	xdr.Marshal(&msg, call)
+	xdr.Marshal(&msg, &PortmapperMapping{Program: 100003, Version: 3, Protocol: Tcp})
+
+	// The capture of the calls starts in the middle of a record
+	var calls bytes.Buffer
+	calls.Write([]byte{0x00, 0x02, 0x00, 0x00, 0x00})
+	writeRecord(&calls, msg.Bytes())
+	calls.Write([]byte{0x80, 0x00, 0x00, 0x08, 0x00})
+
+	var reply bytes.Buffer
+	writeAcceptedReply(&reply, 42, OpaqueAuth{}, Success, uint32(2049))
+	var replies bytes.Buffer
+	writeRecord(&replies, reply.Bytes())
+
+	d := NewPassiveDecoder()
+	var got []*PassiveMessage
+	for m := range d.Decode(context.Background(), &calls) {
+		got = append(got, m)
+	}
+	for m := range d.Decode(context.Background(), &replies) {
+		got = append(got, m)
+	}
+
+	if assert.Len(t, got, 4) {
+		assert.Error(t, got[0].Err)
+		assert.EqualValues(t, 0, got[0].Offset)
+
+		if assert.NotNil(t, got[1].Call) {
+			assert.EqualValues(t, 5, got[1].Offset)
+			assert.EqualValues(t, 42, got[1].Call.Header.Xid)
+			assert.EqualValues(t, PortmapperPortGet, got[1].Call.Body.Procedure)
+			assert.Len(t, got[1].Body, 16)
+		}
+
+		// The last record is truncated
+		assert.Error(t, got[2].Err)
+
+		if assert.NotNil(t, got[3].Reply) {
+			assert.Equal(t, call, got[3].Request)
+			assert.Equal(t, []byte{0x00, 0x00, 0x08, 0x01}, got[3].Body)
+		}
+	}
+
+	m := d.DecodeMessage(reply.Bytes())
+	assert.NotNil(t, m.Reply)
+	assert.Nil(t, m.Request)
+	assert.Error(t, d.DecodeMessage([]byte{0x01}).Err)
+}
@@ -0,0 +1,243 @@
+package sunrpc
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// PipeConfig defines the network conditions simulated by Pipe.
+type PipeConfig struct {
+	Latency time.Duration // delay applied to each message, in both directions
+	Loss    float64       // probability of losing each datagram (UDP servers only)
+}
+
+// Pipe creates an in-memory connection to a server, so that clients and servers can be tested
+// together without binding ports; the server doesn't need to be started with Serve. Use the
+// returned connection with NewClientFromConn, with the protocol of the server (Tcp for a
+// TCPServer, Udp for an UDPServer). cfg is optional.
+//
+// For UDP servers, each write on the connection is a datagram, which can be delayed or lost
+// according to cfg; as with sockets, the client is expected to time out (and possibly retry)
+// when a datagram is lost. For TCP servers, only latency is simulated.
+func Pipe(s Server, cfg *PipeConfig) (net.Conn, error) {
+	if cfg == nil {
+		cfg = &PipeConfig{}
+	}
+
+	switch srv := s.(type) {
+	case *TCPServer:
+		client, server := net.Pipe()
+		if cfg.Latency > 0 {
+			client = &latencyConn{Conn: client, latency: cfg.Latency}
+			server = &latencyConn{Conn: server, latency: cfg.Latency}
+		}
+		go srv.ServeConn(server)
+		return client, nil
+
+	case *UDPServer:
+		return &pipeDatagramConn{
+			server:   srv,
+			cfg:      *cfg,
+			queue:    make(chan []byte, 64),
+			closed:   make(chan struct{}),
+			deadline: makePipeDeadline(),
+		}, nil
+
+	default:
+		return nil, errors.New("unsupported server type")
+	}
+}
+
+// latencyConn delays each write on a stream connection.
+type latencyConn struct {
+	net.Conn
+	latency time.Duration
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	time.Sleep(c.latency)
+	return c.Conn.Write(b)
+}
+
+// pipeDatagramConn is the client end of an in-memory datagram connection to an UDPServer.
+type pipeDatagramConn struct {
+	server *UDPServer
+	cfg    PipeConfig
+
+	queue     chan []byte // replies ready to be read
+	closed    chan struct{}
+	closeOnce sync.Once
+	deadline  pipeDeadline
+}
+
+func (c *pipeDatagramConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	call := append([]byte(nil), b...)
+	c.transmit(func() { c.serve(call) })
+	return len(b), nil
+}
+
+// serve handles a call received by the server.
+func (c *pipeDatagramConn) serve(call []byte) {
+	s := c.server
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.calls.Add(1)
+	s.mu.Unlock()
+
+	job := func(release func()) {
+		defer s.calls.Done()
+
+		var abandoned abandonedProc
+		reply, err := s.server.handleRecord(call, CallInfo{Remote: pipeAddr{}, abandoned: &abandoned})
+		if abandoned.done == nil {
+			release()
+		} else {
+			// A procedure given up after its call timed out holds the call, and its
+			// program concurrency slot, until it returns
+			defer func() {
+				abandoned.wait()
+				release()
+			}()
+		}
+		if err != nil {
+			s.server.log.WithField("err", err).Error("handling record")
+		}
+		c.deliver(reply.Bytes())
+	}
+
+	if ok, policy := s.dispatch(call, job); !ok {
+		reply := s.overloadReply(call, policy)
+		c.deliver(reply.Bytes())
+		s.calls.Done()
+	}
+}
+
+// deliver sends a reply back to the client.
+func (c *pipeDatagramConn) deliver(reply []byte) {
+	if len(reply) == 0 {
+		return
+	}
+	c.transmit(func() {
+		select {
+		case c.queue <- reply:
+		default:
+			// Receive buffer full: like the kernel, drop the datagram
+		}
+	})
+}
+
+// transmit performs f after the configured latency, unless the datagram is lost.
+func (c *pipeDatagramConn) transmit(f func()) {
+	if c.cfg.Loss > 0 && rand.Float64() < c.cfg.Loss {
+		return
+	}
+	if c.cfg.Latency > 0 {
+		time.AfterFunc(c.cfg.Latency, f)
+	} else {
+		go f()
+	}
+}
+
+func (c *pipeDatagramConn) Read(b []byte) (int, error) {
+	select {
+	case reply := <-c.queue:
+		return copy(b, reply), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case <-c.deadline.wait():
+		return 0, pipeTimeoutError{}
+	}
+}
+
+func (c *pipeDatagramConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *pipeDatagramConn) LocalAddr() net.Addr                { return pipeAddr{} }
+func (c *pipeDatagramConn) RemoteAddr() net.Addr               { return pipeAddr{} }
+func (c *pipeDatagramConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *pipeDatagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *pipeDatagramConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "i/o timeout" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+// pipeDeadline is a deadline which can be waited for through a channel.
+type pipeDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline expires
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer to close the channel
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.cancel:
+		expired = true
+	default:
+	}
+
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
@@ -0,0 +1,306 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipe(t *testing.T) {
+	for _, proto := range []PortmapperProtocol{Tcp, Udp} {
+		var s Server
+		if proto == Tcp {
+			s = NewTCPServer(0x20000001, 1)
+		} else {
+			s = NewUDPServer(0x20000001, 1)
+		}
+		s.Register(1, func(arg uint32, reply *uint32) error {
+			*reply = arg * 2
+			return nil
+		})
+
+		conn, err := Pipe(s, &PipeConfig{Latency: time.Millisecond})
+		assert.Nil(t, err)
+
+		c := NewClientFromConn(conn, proto, 0x20000001, 1)
+		var reply uint32
+		assert.Nil(t, c.Call(1, uint32(21), &reply))
+		assert.Equal(t, uint32(42), reply)
+
+		c.Close()
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+}
+
+func TestPipeLoss(t *testing.T) {
+	s := NewUDPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		return nil
+	})
+
+	conn, err := Pipe(s, &PipeConfig{Loss: 1})
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Udp, 0x20000001, 1)
+	c.SetCallTimeout(10 * time.Millisecond)
+
+	var reply uint32
+	err = c.Call(1, uint32(21), &reply)
+	nerr, ok := err.(net.Error)
+	if assert.True(t, ok) {
+		assert.True(t, nerr.Timeout())
+	}
+}
+
+func TestPipeTracer(t *testing.T) {
+	type traced struct {
+		info TraceInfo
+		err  error
+	}
+	var served, called []traced
+	tracer := func(list *[]traced) CallTracer {
+		return func(ctx context.Context, info *TraceInfo) (context.Context, func(error)) {
+			return ctx, func(err error) {
+				*list = append(*list, traced{*info, err})
+			}
+		}
+	}
+
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	s.SetTracer(tracer(&served))
+
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.cfg.Tracer = tracer(&called)
+
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.NotNil(t, c.Call(2, uint32(1), &reply))
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+
+	for _, list := range [][]traced{served, called} {
+		if assert.Len(t, list, 2) {
+			assert.Equal(t, uint32(1), list[0].info.Procedure)
+			assert.Nil(t, list[0].err)
+			assert.Equal(t, uint32(2), list[1].info.Procedure)
+			ok := errors.As(list[1].err, new(*ErrProcUnavail))
+			assert.True(t, ok)
+		}
+	}
+	assert.True(t, served[0].info.Server)
+	assert.Equal(t, "tcp", called[0].info.Transport)
+	assert.Equal(t, called[0].info.Xid, served[0].info.Xid)
+}
+
+func TestPipeAudit(t *testing.T) {
+	var records []AuditRecord
+	var buf bytes.Buffer
+	w := NewAuditWriter(&buf)
+
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	s.SetAuditSink(AuditFunc(func(rec *AuditRecord) {
+		records = append(records, *rec)
+		w.Audit(rec)
+	}))
+
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	c.cfg.Auth = NewClientAuthUnix("host", 1000, 100, nil)
+
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.NotNil(t, c.Call(2, uint32(1), &reply))
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "SUCCESS", records[0].Status())
+		assert.Equal(t, "PROC_UNAVAIL", records[1].Status())
+		assert.Equal(t, uint32(1000), records[0].Cred.(AuthUnix).Uid)
+		assert.Equal(t, "pipe", records[0].Transport)
+		assert.True(t, records[0].CallSize > 0 && records[0].ReplySize > 0)
+	}
+	assert.Contains(t, buf.String(), `proc=1 cred=unix uid=1000 gid=100 host="host" status=SUCCESS`)
+}
+
+func TestPipeRaw(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg * 2
+		return nil
+	})
+	// Relays the calls to procedure 1, after incrementing the argument in place
+	var backend *Client
+	s.RegisterRaw(2, func(ctx context.Context, args []byte) ([]byte, error) {
+		args[3]++
+		return backend.CallRaw(1, args)
+	})
+
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	backend = NewClientFromConn(conn, Tcp, 0x20000001, 1)
+
+	reply, err := backend.CallRaw(1, []byte{0, 0, 0, 21})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 42}, reply)
+
+	conn, err = Pipe(s, nil)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	var n uint32
+	assert.Nil(t, c.Call(2, uint32(20), &n))
+	assert.Equal(t, uint32(42), n)
+
+	_, err = c.CallRaw(3, nil)
+	ok := errors.As(err, new(*ErrProcUnavail))
+	assert.True(t, ok)
+
+	c.Close()
+	backend.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestPipeProgramConcurrency(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	s.RegisterProgram(0x20000002, 1, map[uint32]interface{}{
+		1: func(arg uint32, reply *uint32) error {
+			*reply = arg
+			return nil
+		},
+	})
+	s.SetProgramConcurrency(0x20000001, &ProgramConcurrency{MaxConcurrent: 1, Overload: OverloadReject})
+
+	client := func() *Client {
+		conn, err := Pipe(s, nil)
+		assert.Nil(t, err)
+		return NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	}
+
+	// The first call holds the only slot of the program
+	slow := client()
+	done := make(chan error)
+	go func() {
+		done <- slow.Call(1, uint32(0), nil)
+	}()
+	<-started
+
+	var reply uint32
+	err := client().Call(1, uint32(0), &reply)
+	if aerr, ok := err.(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(SystemErr), aerr.Stat)
+	}
+
+	// Other programs are not affected
+	assert.Nil(t, client().CallProgram(0x20000002, 1, 1, uint32(7), &reply))
+	assert.Equal(t, uint32(7), reply)
+
+	close(release)
+	assert.Nil(t, <-done)
+	assert.Nil(t, client().Call(1, uint32(0), &reply))
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestPipeProgramConcurrencyCallTimeout(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.SetCallTimeout(20 * time.Millisecond)
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	var served int32
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		started <- struct{}{}
+		<-release // ignores the timeout
+		return nil
+	})
+	s.Register(2, func(arg uint32, reply *uint32) error {
+		atomic.AddInt32(&served, 1)
+		return nil
+	})
+	s.SetProgramConcurrency(0x20000001, &ProgramConcurrency{MaxConcurrent: 1, Overload: OverloadReject})
+
+	client := func() *Client {
+		conn, err := Pipe(s, nil)
+		assert.Nil(t, err)
+		return NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	}
+
+	// The call times out, but its procedure keeps the slot of the program
+	if e, ok := client().Call(1, uint32(0), nil).(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(SystemErr), e.Stat)
+	}
+	<-started
+
+	c := client()
+	if e, ok := c.Call(2, uint32(0), nil).(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(SystemErr), e.Stat)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&served))
+
+	// The slot is released when the procedure returns
+	close(release)
+	for i := 0; i < 100 && c.Call(2, uint32(0), nil) != nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&served))
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestPipeProcedureSettingsScope(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	echo := func(arg string, reply *string) error {
+		*reply = arg
+		return nil
+	}
+	s.Register(1, echo)
+	s.RegisterProgram(0x20000002, 1, map[uint32]interface{}{1: echo})
+	s.RegisterProgram(0x20000003, 1, map[uint32]interface{}{1: echo})
+	s.SetMaxArgSize(1, 16)
+	s.SetProgramAuth(0x20000002, 1, func(proc uint32, cred interface{}) bool {
+		return false
+	})
+
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+
+	// The limit only applies to the program the server was created for
+	var reply string
+	err = c.Call(1, "larger than 16 bytes", &reply)
+	garbage := errors.As(err, new(*ErrGarbageArgs))
+	assert.True(t, garbage)
+	assert.Nil(t, c.Call(1, "short", &reply))
+	assert.Nil(t, c.CallProgram(0x20000003, 1, 1, "larger than 16 bytes", &reply))
+
+	// The authentication function only applies to the other program
+	err = c.CallProgram(0x20000002, 1, 1, "short", &reply)
+	stat, ok := AuthErrorStat(err)
+	assert.True(t, ok)
+	assert.Equal(t, AuthBadCred, stat)
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
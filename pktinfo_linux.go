@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package sunrpc
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const sourcePinningSupported = true
+
+// enablePacketInfo makes the socket receive the local address of each datagram (IP_PKTINFO).
+func enablePacketInfo(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// replyControl returns the control message making a reply leave from the local address the
+// call was received on, given the control messages received with the call, or nil if the
+// address is unknown.
+func replyControl(oob []byte) []byte {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_PKTINFO ||
+			len(m.Data) < syscall.SizeofInet4Pktinfo {
+			continue
+		}
+		in := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+
+		// ipi_spec_dst is the local address of the datagram: the interface is left to the
+		// routing table
+		out := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&out[0]))
+		h.Level = syscall.IPPROTO_IP
+		h.Type = syscall.IP_PKTINFO
+		h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&out[syscall.CmsgLen(0)]))
+		info.Spec_dst = in.Spec_dst
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPSourcePinning(t *testing.T) {
+	s := NewUDPServer(0x20000001, 1)
+	s.Register(0, func(args struct{}, reply *struct{}) error {
+		return nil
+	})
+	s.SetSourcePinning(true)
+
+	conn, port, err := s.listen("0.0.0.0:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	go s.serve(conn)
+	defer s.Shutdown(context.Background())
+
+	// Replies to calls sent to another address than the one of the default route of the
+	// destination are only accepted by the connected socket of the client if they come
+	// from that address
+	addr := net.JoinHostPort("127.0.0.2", strconv.Itoa(port))
+	c := NewClient(addr, 0x20000001, 1, &ClientConfig{
+		Transport: ClientTransportUdpOnly,
+		Timeout:   time.Second,
+	})
+	defer c.Close()
+	assert.Nil(t, c.Call(0, nil, nil))
+}
+
+func TestPlatformCapabilities(t *testing.T) {
+	caps := PlatformCapabilities()
+	assert.True(t, caps.SourcePinning)
+	assert.True(t, caps.UnixSockets)
+	assert.True(t, caps.Syslog)
+}
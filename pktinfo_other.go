@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package sunrpc
+
+import (
+	"errors"
+	"net"
+)
+
+const sourcePinningSupported = false
+
+func enablePacketInfo(conn *net.UDPConn) error {
+	return errors.New("source address pinning is not supported on this platform")
+}
+
+func replyControl(oob []byte) []byte {
+	return nil
+}
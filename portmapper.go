@@ -15,6 +15,11 @@ const (
 	PortmapperPortSet   = 1
 	PortmapperPortUnset = 2
 	PortmapperPortGet   = 3
+	PortmapperPortDump  = 4
+
+	rpcbindVersion3 = 3
+	rpcbindUnset    = 2
+	rpcbindDump     = 4
 )
 
 // PortmapperProtocol is an enumeration denoting whether the RPC server we are registering runs over
@@ -28,13 +33,23 @@ const (
 	Udp PortmapperProtocol = 17
 )
 
-type pmapMapping struct {
+// PortmapperMapping is a registration of an RPC service in the portmapper.
+type PortmapperMapping struct {
 	Program  uint32
 	Version  uint32
 	Protocol PortmapperProtocol
 	Port     uint32
 }
 
+// RpcbindMapping is the rpcbind (version 3 and 4) equivalent of PortmapperMapping.
+type RpcbindMapping struct {
+	Program uint32
+	Version uint32
+	Netid   string
+	Addr    string
+	Owner   string
+}
+
 var pmapInit sync.Once
 var pmapClient *Client
 
@@ -95,7 +110,7 @@ func PortmapperAvailable() bool {
 func PortmapperSet(program uint32, version uint32, protocol PortmapperProtocol, port uint32) error {
 	PortmapperInit()
 
-	mapping := pmapMapping{
+	mapping := PortmapperMapping{
 		Program:  program,
 		Version:  version,
 		Protocol: protocol,
@@ -117,7 +132,7 @@ func PortmapperSet(program uint32, version uint32, protocol PortmapperProtocol,
 func PortmapperUnset(program uint32, version uint32) error {
 	PortmapperInit()
 
-	mapping := pmapMapping{
+	mapping := PortmapperMapping{
 		Program: program,
 		Version: version,
 	}
@@ -134,10 +149,41 @@ func PortmapperUnset(program uint32, version uint32) error {
 	return nil
 }
 
+// portmapperUnsetProtocol is like PortmapperUnset, but only removes the registration for the
+// specified protocol. This requires rpcbind version 3; with older portmappers, it falls back
+// to removing the registrations for all protocols.
+func portmapperUnsetProtocol(program uint32, version uint32, protocol PortmapperProtocol) error {
+	PortmapperInit()
+
+	mapping := RpcbindMapping{
+		Program: program,
+		Version: version,
+		Netid:   "tcp",
+	}
+	if protocol == Udp {
+		mapping.Netid = "udp"
+	}
+
+	var ok bool
+	err := pmapClient.CallProgram(PortmapperProgram, rpcbindVersion3, rpcbindUnset, &mapping, &ok)
+	if e, ok := err.(*RPCAcceptError); ok && e.Stat == ProgMismatch {
+		return PortmapperUnset(program, version)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot deregister from rpcbind server: %v", err)
+	}
+
+	if !ok {
+		return ErrorPortmapperServiceDoesntExist
+	}
+
+	return nil
+}
+
 func PortmapperGet(program uint32, version uint32, protocol PortmapperProtocol) (uint32, error) {
 	PortmapperInit()
 
-	mapping := pmapMapping{
+	mapping := PortmapperMapping{
 		Program:  program,
 		Version:  version,
 		Protocol: protocol,
@@ -0,0 +1,162 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPortmapper is an in-memory portmapper, serving versions 2 and 3 (UNSET only) of the
+// protocol. While it is installed, the Portmapper functions talk to it instead of the
+// rpcbind server of the host.
+type testPortmapper struct {
+	mu   sync.Mutex
+	port map[PortmapperMapping]uint32 // indexed with Port set to zero
+}
+
+func newTestPortmapper(t *testing.T) *testPortmapper {
+	p := &testPortmapper{port: make(map[PortmapperMapping]uint32)}
+	s := NewTCPServer(PortmapperProgram, PortmapperVersion)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(PortmapperPortSet, func(m PortmapperMapping, reply *bool) error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		port := m.Port
+		m.Port = 0
+		if _, found := p.port[m]; !found {
+			p.port[m] = port
+			*reply = true
+		}
+		return nil
+	})
+	s.Register(PortmapperPortUnset, func(m PortmapperMapping, reply *uint32) error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for k := range p.port {
+			if k.Program == m.Program && k.Version == m.Version {
+				delete(p.port, k)
+				*reply = 1
+			}
+		}
+		return nil
+	})
+	s.Register(PortmapperPortGet, func(m PortmapperMapping, reply *uint32) error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		m.Port = 0
+		*reply = p.port[m]
+		return nil
+	})
+	s.RegisterProgram(PortmapperProgram, rpcbindVersion3, map[uint32]interface{}{
+		rpcbindUnset: func(m RpcbindMapping, reply *bool) error {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			k := PortmapperMapping{Program: m.Program, Version: m.Version, Protocol: Tcp}
+			if m.Netid == "udp" {
+				k.Protocol = Udp
+			}
+			_, *reply = p.port[k]
+			delete(p.port, k)
+			return nil
+		},
+	})
+
+	PortmapperInit()
+	prev := pmapClient
+	pmapClient = NewClient("portmapper", PortmapperProgram, PortmapperVersion, &ClientConfig{
+		Transport: ClientTransportTcpOnly,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return Pipe(s, nil)
+		},
+	})
+	t.Cleanup(func() {
+		pmapClient.Close()
+		pmapClient = prev
+		s.Shutdown(context.Background())
+	})
+	return p
+}
+
+// get returns the port registered for a program version, or zero.
+func (p *testPortmapper) get(program, version uint32, protocol PortmapperProtocol) uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.port[PortmapperMapping{Program: program, Version: version, Protocol: protocol}]
+}
+
+func TestRegisterAndAnnounce(t *testing.T) {
+	pmap := newTestPortmapper(t)
+
+	// A stale registration (nothing listens on port 1) is taken over
+	assert.Nil(t, PortmapperSet(0x20000001, 1, Tcp, 1))
+
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg * 2
+		return nil
+	})
+	assert.Nil(t, s.RegisterAndAnnounce("127.0.0.1:0"))
+
+	port, err := PortmapperGet(0x20000001, 1, Tcp)
+	assert.Nil(t, err)
+	assert.NotEqual(t, uint32(1), port)
+	assert.Equal(t, s.listener.Addr().(*net.TCPAddr).Port, int(port))
+
+	c := NewClient("127.0.0.1:"+strconv.Itoa(int(port)), 0x20000001, 1, &ClientConfig{Transport: ClientTransportTcpOnly})
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(21), &reply))
+	assert.Equal(t, uint32(42), reply)
+	c.Close()
+
+	// Shutdown removes the registration
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Equal(t, uint32(0), pmap.get(0x20000001, 1, Tcp))
+}
+
+func TestRegisterAndAnnounceLiveService(t *testing.T) {
+	newTestPortmapper(t)
+
+	first := NewUDPServer(0x20000001, 1)
+	first.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	assert.Nil(t, first.RegisterAndAnnounce("127.0.0.1:0"))
+
+	// The registration of a running server is not taken over
+	second := NewUDPServer(0x20000001, 1)
+	second.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	assert.Equal(t, ErrorPortmapperServiceExists, second.RegisterAndAnnounce("127.0.0.1:0"))
+
+	assert.Nil(t, first.Shutdown(context.Background()))
+}
+
+func TestRegisterAndAnnouncePrograms(t *testing.T) {
+	pmap := newTestPortmapper(t)
+
+	s := NewUDPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.RegisterProgram(0x20000002, 3, map[uint32]interface{}{})
+	s.SetStatsProgram(0x20000003)
+	assert.Nil(t, s.RegisterAndAnnounce("127.0.0.1:0"))
+	port := uint32(s.conn.LocalAddr().(*net.UDPAddr).Port)
+
+	// Every program served is registered, including the statistics one
+	assert.Equal(t, port, pmap.get(0x20000001, 1, Udp))
+	assert.Equal(t, port, pmap.get(0x20000002, 3, Udp))
+	assert.Equal(t, port, pmap.get(0x20000003, 1, Udp))
+
+	// The programs registered and unregistered later are kept in sync
+	s.RegisterProgram(0x20000004, 1, map[uint32]interface{}{})
+	assert.Equal(t, port, pmap.get(0x20000004, 1, Udp))
+	s.Unregister(0x20000002, 3)
+	assert.Equal(t, uint32(0), pmap.get(0x20000002, 3, Udp))
+
+	// Shutdown removes all of them
+	assert.Nil(t, s.Shutdown(context.Background()))
+	for _, program := range []uint32{0x20000001, 0x20000003, 0x20000004} {
+		assert.Equal(t, uint32(0), pmap.get(program, 1, Udp))
+	}
+}
@@ -0,0 +1,179 @@
+package sunrpc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// PortmapperList is the list of services returned by the DUMP procedure of the portmapper
+// (version 2). It can be used as the reply of a call to PortmapperPortDump.
+type PortmapperList []PortmapperMapping
+
+// RpcbindList is the list of services returned by the DUMP procedure of rpcbind (version 3
+// and 4). It can be used as the reply of a call to the DUMP procedure of those versions.
+type RpcbindList []RpcbindMapping
+
+// replyDecoder is implemented by replies that cannot be decoded through reflection.
+type replyDecoder interface {
+	decodeReply(r io.Reader) error
+}
+
+func (l *PortmapperList) decodeReply(r io.Reader) (err error) {
+	*l, err = ParsePortmapperList(r)
+	return err
+}
+
+func (l *RpcbindList) decodeReply(r io.Reader) (err error) {
+	*l, err = ParseRpcbindList(r)
+	return err
+}
+
+// ParsePortmapperList decodes a pmaplist, as returned by the DUMP procedure of the portmapper.
+func ParsePortmapperList(r io.Reader) (PortmapperList, error) {
+	var list PortmapperList
+	err := decodeOptionalList(r, func(decode func(v interface{}) error) error {
+		var m PortmapperMapping
+		if err := decode(&m); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
+	return list, err
+}
+
+// ParseRpcbindList decodes a rpcblist, as returned by the DUMP procedure of rpcbind.
+func ParseRpcbindList(r io.Reader) (RpcbindList, error) {
+	var list RpcbindList
+	err := decodeOptionalList(r, func(decode func(v interface{}) error) error {
+		var m RpcbindMapping
+		if err := decode(&m); err != nil {
+			return err
+		}
+		list = append(list, m)
+		return nil
+	})
+	return list, err
+}
+
+// decodeOptionalList decodes a linked list encoded as XDR optional-data: each item is
+// preceded by a boolean telling whether it is present. Variable-length items (netids,
+// addresses) are bounded by the size of the record, when known, so that forged lengths are
+// detected before allocating memory for them.
+func decodeOptionalList(r io.Reader, item func(decode func(v interface{}) error) error) error {
+	limit := uint(math.MaxUint32)
+	if record, ok := r.(interface{ Len() int }); ok {
+		limit = uint(record.Len())
+	}
+	decode := func(v interface{}) error {
+		_, err := xdr.UnmarshalLimited(r, v, limit)
+		return err
+	}
+
+	for {
+		var more bool
+		if err := decode(&more); err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+		if err := item(decode); err != nil {
+			return err
+		}
+	}
+}
+
+// Portmapper translates the list into the portmapper format. Only the services reachable over
+// TCP or UDP are kept.
+func (l RpcbindList) Portmapper() PortmapperList {
+	var list PortmapperList
+	for _, m := range l {
+		prot, ok := NetidProtocol(m.Netid)
+		if !ok {
+			continue
+		}
+		_, port, err := ParseUniversalAddr(m.Addr)
+		if err != nil {
+			continue
+		}
+		list = append(list, PortmapperMapping{
+			Program:  m.Program,
+			Version:  m.Version,
+			Protocol: prot,
+			Port:     port,
+		})
+	}
+	return list
+}
+
+// FindService looks up the registration of the specified service in a list.
+func FindService(list PortmapperList, program, version uint32, protocol PortmapperProtocol) (PortmapperMapping, bool) {
+	for _, m := range list {
+		if m.Program == program && m.Version == version && m.Protocol == protocol {
+			return m, true
+		}
+	}
+	return PortmapperMapping{}, false
+}
+
+// NetidProtocol returns the protocol corresponding to a netid (as used by rpcbind), or false
+// if the netid does not denote a TCP or UDP transport.
+func NetidProtocol(netid string) (PortmapperProtocol, bool) {
+	n, ok := LookupNetid(netid)
+	if !ok || n.Local {
+		return 0, false
+	}
+	return n.Protocol(), true
+}
+
+// ParseUniversalAddr decodes a TCP or UDP universal address (RFC 5665), whose format is the
+// IP address followed by the two bytes of the port, in decimal notation: for instance,
+// "127.0.0.1.0.111" for port 111 of localhost.
+func ParseUniversalAddr(uaddr string) (net.IP, uint32, error) {
+	i := strings.LastIndexByte(uaddr, '.')
+	if i < 0 {
+		return nil, 0, fmt.Errorf("invalid universal address: %q", uaddr)
+	}
+	j := strings.LastIndexByte(uaddr[:i], '.')
+	if j < 0 {
+		return nil, 0, fmt.Errorf("invalid universal address: %q", uaddr)
+	}
+
+	ip := net.ParseIP(uaddr[:j])
+	hi, herr := strconv.ParseUint(uaddr[j+1:i], 10, 8)
+	lo, lerr := strconv.ParseUint(uaddr[i+1:], 10, 8)
+	if ip == nil || herr != nil || lerr != nil {
+		return nil, 0, fmt.Errorf("invalid universal address: %q", uaddr)
+	}
+
+	return ip, uint32(hi<<8 | lo), nil
+}
+
+// PortmapperDump returns the services registered to the portmapper running on the current
+// host. rpcbind (version 3) is queried first, so that services registered over IPv6 are
+// included as well; older portmappers are queried with version 2.
+func PortmapperDump() (PortmapperList, error) {
+	PortmapperInit()
+
+	var rlist RpcbindList
+	err := pmapClient.CallProgram(PortmapperProgram, rpcbindVersion3, rpcbindDump, nil, &rlist)
+	if err == nil {
+		return rlist.Portmapper(), nil
+	}
+	if e, ok := err.(*RPCAcceptError); !ok || e.Stat != ProgMismatch {
+		return nil, fmt.Errorf("cannot query rpcbind server: %v", err)
+	}
+
+	var list PortmapperList
+	if err := pmapClient.Call(PortmapperPortDump, nil, &list); err != nil {
+		return nil, fmt.Errorf("cannot query rpcbind server: %v", err)
+	}
+	return list, nil
+}
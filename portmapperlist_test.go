@@ -0,0 +1,69 @@
+package sunrpc
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortmapperList(t *testing.T) {
+	dump := bytes.NewReader([]byte{
+		0x00, 0x00, 0x00, 0x01, // Value follows
+		0x00, 0x01, 0x86, 0xa0, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x6f,
+		0x00, 0x00, 0x00, 0x01, // Value follows
+		0x00, 0x01, 0x86, 0xa3, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x11, 0x00, 0x00, 0x08, 0x01,
+		0x00, 0x00, 0x00, 0x00, // No value follows
+	})
+
+	list, err := ParsePortmapperList(dump)
+	assert.Nil(t, err)
+	assert.Equal(t, PortmapperList{
+		{Program: 100000, Version: 2, Protocol: Tcp, Port: 111},
+		{Program: 100003, Version: 3, Protocol: Udp, Port: 2049},
+	}, list)
+
+	m, found := FindService(list, 100003, 3, Udp)
+	assert.True(t, found)
+	assert.Equal(t, uint32(2049), m.Port)
+
+	_, found = FindService(list, 100003, 3, Tcp)
+	assert.False(t, found)
+}
+
+func TestParseRpcbindListForgedLength(t *testing.T) {
+	dump := bytes.NewReader([]byte{
+		0x00, 0x00, 0x00, 0x01, // Value follows
+		0x00, 0x01, 0x86, 0xa0, 0x00, 0x00, 0x00, 0x04,
+		0x7f, 0xff, 0xff, 0xff, // netid much longer than the record
+	})
+	_, err := ParseRpcbindList(dump)
+	if assert.NotNil(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "exceeds max slice limit"), "%v", err)
+	}
+}
+
+func TestRpcbindListPortmapper(t *testing.T) {
+	list := RpcbindList{
+		{Program: 100000, Version: 4, Netid: "tcp6", Addr: "::.0.111", Owner: "superuser"},
+		{Program: 100000, Version: 4, Netid: "local", Addr: "/run/rpcbind.sock", Owner: "superuser"},
+		{Program: 100003, Version: 3, Netid: "udp", Addr: "0.0.0.0.8.1", Owner: "superuser"},
+	}
+
+	assert.Equal(t, PortmapperList{
+		{Program: 100000, Version: 4, Protocol: Tcp, Port: 111},
+		{Program: 100003, Version: 3, Protocol: Udp, Port: 2049},
+	}, list.Portmapper())
+}
+
+func TestParseUniversalAddr(t *testing.T) {
+	ip, port, err := ParseUniversalAddr("127.0.0.1.0.111")
+	assert.Nil(t, err)
+	assert.True(t, ip.Equal(net.IPv4(127, 0, 0, 1)))
+	assert.Equal(t, uint32(111), port)
+
+	_, _, err = ParseUniversalAddr("127.0.0.1")
+	assert.NotNil(t, err)
+}
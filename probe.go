@@ -0,0 +1,69 @@
+package sunrpc
+
+import (
+	"math"
+	"net"
+)
+
+// maxProbedVersions bounds the number of versions checked by ProbeVersions, so that a bogus
+// PROG_MISMATCH range cannot make it run forever.
+const maxProbedVersions = 64
+
+// ProbeVersions returns the versions of a program supported by the RPC server at addr (in
+// net.Dial format), like "rpcinfo -T" does. The server is first called with a version it
+// is unlikely to support, to learn the supported range from the PROG_MISMATCH reply; each
+// version of the range is then checked by calling the NULL procedure.
+func ProbeVersions(addr string, program uint32, protocol PortmapperProtocol) ([]uint32, error) {
+	network := "tcp"
+	if protocol == Udp {
+		network = "udp"
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClientFromConn(conn, protocol, program, 0)
+	defer c.Close()
+
+	low, high, err := probeVersionRange(c, program)
+	if err != nil {
+		return nil, err
+	}
+	if high-low >= maxProbedVersions {
+		high = low + maxProbedVersions - 1
+	}
+
+	var versions []uint32
+	for v := low; v <= high; v++ {
+		err := c.CallProgram(program, v, 0, nil, nil)
+		if e, ok := err.(*RPCAcceptError); ok && e.Stat == ProgMismatch {
+			// gap in the range
+		} else if err != nil {
+			return versions, err
+		} else {
+			versions = append(versions, v)
+		}
+		if v == math.MaxUint32 {
+			break
+		}
+	}
+
+	return versions, nil
+}
+
+// probeVersionRange returns the range of versions of program supported by the server.
+func probeVersionRange(c *Client, program uint32) (low, high uint32, err error) {
+	for _, v := range []uint32{0, math.MaxUint32} {
+		err = c.CallProgram(program, v, 0, nil, nil)
+		if e, ok := err.(*RPCAcceptError); ok && e.Stat == ProgMismatch {
+			return e.Low, e.High, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Both the lowest and the highest version are supported
+	return 0, math.MaxUint32, nil
+}
@@ -0,0 +1,44 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeVersions(t *testing.T) {
+	null := func(arg struct{}, reply *struct{}) error { return nil }
+	for _, protocol := range []PortmapperProtocol{Tcp, Udp} {
+		// Versions 2 and 4 are served, with a gap in between
+		var s Server
+		var addr string
+		if protocol == Udp {
+			us := NewUDPServer(0x20000001, 2)
+			us.RegisterProgram(0x20000001, 4, map[uint32]interface{}{0: null})
+			conn, _, err := us.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go us.serve(conn)
+			s, addr = us, conn.LocalAddr().String()
+		} else {
+			ts := NewTCPServer(0x20000001, 2)
+			ts.RegisterProgram(0x20000001, 4, map[uint32]interface{}{0: null})
+			ln, _, err := ts.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go ts.serve(ln)
+			s, addr = ts, ln.Addr().String()
+		}
+		s.Register(0, null)
+
+		versions, err := ProbeVersions(addr, 0x20000001, protocol)
+		assert.Nil(t, err)
+		assert.Equal(t, []uint32{2, 4}, versions)
+
+		_, err = ProbeVersions(addr, 0x20000002, protocol)
+		unavail := errors.As(err, new(*ErrProgUnavail))
+		assert.True(t, unavail)
+
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+}
@@ -0,0 +1,169 @@
+package sunrpc
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// progVers identifies a version of a program.
+type progVers struct {
+	program uint32
+	version uint32
+}
+
+// procKey identifies a procedure of a program version.
+type procKey struct {
+	progVers
+	proc uint32
+}
+
+// procTable holds the procedures of a program version. Tables are never modified once
+// installed: updates replace them (copy-on-write), so that calls being dispatched are not
+// affected.
+type procTable struct {
+	procedures map[uint32]interface{}
+	names      map[uint32]string
+}
+
+// programTable maps the programs served by a server to their procedures. Like procTable,
+// it is replaced on each update.
+type programTable map[progVers]*procTable
+
+// programRegistry holds the program table of a server, allowing lock-free lookups while
+// programs are registered and unregistered.
+type programRegistry struct {
+	mu    sync.Mutex // serializes updates
+	table atomic.Value
+}
+
+func newProgramRegistry(program, version uint32) *programRegistry {
+	reg := &programRegistry{}
+	reg.table.Store(programTable{
+		{program, version}: {
+			procedures: make(map[uint32]interface{}),
+			names:      make(map[uint32]string),
+		},
+	})
+	return reg
+}
+
+func (reg *programRegistry) load() programTable {
+	return reg.table.Load().(programTable)
+}
+
+// update applies f to a copy of the program table, and installs the result.
+func (reg *programRegistry) update(f func(t programTable)) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	old := reg.load()
+	t := make(programTable, len(old)+1)
+	for pv, procs := range old {
+		t[pv] = procs
+	}
+	f(t)
+	reg.table.Store(t)
+}
+
+// versions returns the range of versions registered for a program.
+func (t programTable) versions(program uint32) (low, high uint32, found bool) {
+	for pv := range t {
+		if pv.program != program {
+			continue
+		}
+		if !found || pv.version < low {
+			low = pv.version
+		}
+		if !found || pv.version > high {
+			high = pv.version
+		}
+		found = true
+	}
+	return low, high, found
+}
+
+// programList returns the program versions registered to a server, in order.
+func (s *server) programList() []progVers {
+	var list []progVers
+	for pv := range s.programs.load() {
+		list = append(list, pv)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].program != list[j].program {
+			return list[i].program < list[j].program
+		}
+		return list[i].version < list[j].version
+	})
+	return list
+}
+
+// register adds a procedure to a program version (creating it if needed).
+func (reg *programRegistry) register(program, version, proc uint32, rcvr interface{}, name string) {
+	reg.update(func(t programTable) {
+		procs := &procTable{
+			procedures: make(map[uint32]interface{}),
+			names:      make(map[uint32]string),
+		}
+		if old := t[progVers{program, version}]; old != nil {
+			for p, f := range old.procedures {
+				procs.procedures[p] = f
+			}
+			for p, n := range old.names {
+				procs.names[p] = n
+			}
+		}
+
+		procs.procedures[proc] = rcvr
+		if name != "" {
+			procs.names[proc] = name
+		}
+		t[progVers{program, version}] = procs
+	})
+}
+
+// procedureRegisterer is implemented by the servers of the package, to register procedures
+// of any program.
+type procedureRegisterer interface {
+	registerProcedure(program, version, proc uint32, rcvr interface{})
+}
+
+func (s *server) registerProcedure(program, version, proc uint32, rcvr interface{}) {
+	s.programs.register(program, version, proc, rcvr, "")
+	s.syncAnnounce(progVers{program, version}, true)
+}
+
+// RegisterProgram installs the procedures of a version of a program, atomically replacing the
+// ones registered before for that version (if any). It can be called while the server is
+// running: calls being processed complete with the previous procedures, subsequent ones are
+// dispatched to the new ones, and connections are not affected.
+//
+// This also allows a server to serve programs and versions other than the ones it was
+// created for, e.g. to host several related programs on a single port: calls are dispatched
+// by program and version, and all of them are registered to the portmapper by Serve and
+// RegisterAndAnnounce. When the server was started with RegisterAndAnnounce, programs
+// registered (or unregistered) later are also registered to (or removed from) the portmapper.
+func (s *server) RegisterProgram(program, version uint32, procs map[uint32]interface{}) {
+	table := &procTable{
+		procedures: make(map[uint32]interface{}, len(procs)),
+		names:      make(map[uint32]string),
+	}
+	for proc, rcvr := range procs {
+		table.procedures[proc] = rcvr
+	}
+
+	s.programs.update(func(t programTable) {
+		t[progVers{program, version}] = table
+	})
+	s.syncAnnounce(progVers{program, version}, true)
+}
+
+// Unregister stops serving a version of a program. Subsequent calls to it are replied with
+// PROG_MISMATCH (if other versions of the program are still served) or PROG_UNAVAIL. The
+// registration done by RegisterAndAnnounce for it, if any, is removed from the portmapper.
+func (s *server) Unregister(program, version uint32) {
+	s.programs.update(func(t programTable) {
+		delete(t, progVers{program, version})
+	})
+	s.syncAnnounce(progVers{program, version}, false)
+}
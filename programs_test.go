@@ -0,0 +1,92 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterProgramReplace(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		close(started)
+		<-release
+		*reply = 1
+		return nil
+	})
+	client := func() *Client {
+		conn, err := Pipe(s, nil)
+		assert.Nil(t, err)
+		return NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	}
+
+	slow := client()
+	var pending uint32
+	called := make(chan error, 1)
+	go func() {
+		called <- slow.Call(1, uint32(0), &pending)
+	}()
+	<-started
+
+	// The call being processed completes with the previous procedure, while subsequent ones
+	// are dispatched to the new one
+	s.RegisterProgram(0x20000001, 1, map[uint32]interface{}{
+		1: func(arg uint32, reply *uint32) error {
+			*reply = 2
+			return nil
+		},
+	})
+	c := client()
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(0), &reply))
+	assert.Equal(t, uint32(2), reply)
+
+	close(release)
+	assert.Nil(t, <-called)
+	assert.Equal(t, uint32(1), pending)
+
+	slow.Close()
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestUnregister(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	for vers := uint32(1); vers <= 2; vers++ {
+		vers := vers
+		s.RegisterProgram(0x20000001, vers, map[uint32]interface{}{
+			1: func(arg uint32, reply *uint32) error {
+				*reply = vers
+				return nil
+			},
+		})
+	}
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+
+	var reply uint32
+	assert.Nil(t, c.CallProgram(0x20000001, 2, 1, uint32(0), &reply))
+	assert.Equal(t, uint32(2), reply)
+
+	// While other versions are served, calls to an unregistered one get PROG_MISMATCH
+	s.Unregister(0x20000001, 2)
+	err = c.CallProgram(0x20000001, 2, 1, uint32(0), &reply)
+	if e, ok := err.(*RPCAcceptError); assert.True(t, ok && e.Stat == ProgMismatch, "%v", err) {
+		assert.Equal(t, uint32(1), e.Low)
+		assert.Equal(t, uint32(1), e.High)
+	}
+	assert.Nil(t, c.Call(1, uint32(0), &reply))
+	assert.Equal(t, uint32(1), reply)
+
+	// Once no version is left, they get PROG_UNAVAIL
+	s.Unregister(0x20000001, 1)
+	ok := errors.As(c.Call(1, uint32(0), &reply), new(*ErrProgUnavail))
+	assert.True(t, ok)
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
@@ -0,0 +1,358 @@
+package sunrpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/Sirupsen/logrus.v0"
+)
+
+// Proxy forwards the RPC messages received on a transport to an upstream server, possibly
+// over another transport: for instance, to let legacy UDP-only clients reach TCP-only
+// servers. Messages are relayed verbatim, with the framing of each transport (record marking
+// on TCP, datagrams on UDP): XIDs and credentials are preserved, so the upstream server sees
+// the calls as sent by the clients.
+//
+// Each caller (TCP connection, or UDP address) gets its own upstream connection, so that the
+// XIDs of different callers cannot collide. The upstream connections of UDP callers are
+// closed after IdleTimeout without traffic. Unlike with RawHandler, calls are not decoded:
+// all the programs served upstream are reachable through the proxy.
+//
+// Proxies must be created with NewProxy; their settings can be changed before serving.
+type Proxy struct {
+	Upstream         string             // address of the upstream server, in net.Dial format
+	UpstreamProtocol PortmapperProtocol // transport used to reach the upstream server
+
+	// DialTimeout bounds the time spent connecting to the upstream server (default: 5s).
+	DialTimeout time.Duration
+
+	// IdleTimeout is the time after which the upstream connections of UDP callers are
+	// closed, if no message was exchanged (default: 1 min).
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	conns    map[io.Closer]bool // listeners and connections, closed by Close
+	sessions map[string]*proxySession
+	log      *logrus.Entry
+}
+
+// proxySession is the upstream connection of an UDP caller.
+type proxySession struct {
+	up    net.Conn
+	timer *time.Timer // closes up when idle
+}
+
+// NewProxy creates a proxy to the server at upstream, reached over the prot transport.
+func NewProxy(upstream string, prot PortmapperProtocol) *Proxy {
+	return &Proxy{
+		Upstream:         upstream,
+		UpstreamProtocol: prot,
+		conns:            make(map[io.Closer]bool),
+		sessions:         make(map[string]*proxySession),
+		log:              log.WithFields(logrus.Fields{"upstream": upstream}),
+	}
+}
+
+var errProxyClosed = errors.New("proxy closed")
+
+// Serve starts accepting the messages to forward on addr, over the prot transport, and returns
+// the address listened on (e.g. to find out the port, when it is 0 in addr).
+func (p *Proxy) Serve(prot PortmapperProtocol, addr string) (net.Addr, error) {
+	switch prot {
+	case Tcp:
+		ln, err := net.Listen("tcp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		go p.ServeListener(ln)
+		return ln.Addr(), nil
+
+	case Udp:
+		conn, err := net.ListenPacket("udp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		go p.ServePacketConn(conn)
+		return conn.LocalAddr(), nil
+
+	default:
+		return nil, errors.New("unsupported transport")
+	}
+}
+
+// ServeListener forwards the messages received on the connections accepted by ln, until ln is
+// closed or the proxy is closed.
+func (p *Proxy) ServeListener(ln net.Listener) error {
+	if !p.track(ln) {
+		ln.Close()
+		return errProxyClosed
+	}
+	defer p.untrack(ln)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn forwards the records received on a stream connection, and the replies to them,
+// until either end closes its connection.
+func (p *Proxy) ServeConn(conn net.Conn) {
+	if !p.track(conn) {
+		conn.Close()
+		return
+	}
+	defer p.untrack(conn)
+	defer conn.Close()
+
+	up, err := p.dial()
+	if err != nil {
+		p.log.WithField("err", err).Error("Unable to connect to the upstream server")
+		return
+	}
+	defer p.untrack(up)
+	defer up.Close()
+
+	// Replies are sent back as they arrive
+	go func() {
+		p.relayReplies(up, func(msg []byte) error {
+			return writeRecord(conn, msg)
+		})
+		conn.Close()
+	}()
+
+	for {
+		record, err := ReadRecord(conn)
+		if err != nil {
+			if err != io.EOF && !p.isClosed() {
+				p.log.WithField("err", err).Debug("Unable to read a record")
+			}
+			return
+		}
+		if err := p.forward(up, record.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// ServePacketConn forwards the datagrams received on conn, and the replies to them, until conn
+// is closed or the proxy is closed.
+func (p *Proxy) ServePacketConn(conn net.PacketConn) error {
+	if !p.track(conn) {
+		conn.Close()
+		return errProxyClosed
+	}
+	defer p.untrack(conn)
+
+	buf := make([]byte, MaxUdpSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if p.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		session := p.session(conn, addr)
+		if session == nil {
+			continue
+		}
+		if err := p.forward(session.up, buf[:n]); err != nil {
+			session.up.Close()
+		}
+	}
+}
+
+// session returns the upstream connection of an UDP caller, connecting it if needed.
+func (p *Proxy) session(conn net.PacketConn, addr net.Addr) *proxySession {
+	key := conn.LocalAddr().String() + "/" + addr.String()
+
+	p.mu.Lock()
+	session := p.sessions[key]
+	p.mu.Unlock()
+	if session != nil {
+		session.timer.Reset(p.idleTimeout())
+		return session
+	}
+
+	up, err := p.dial()
+	if err != nil {
+		p.log.WithField("err", err).Error("Unable to connect to the upstream server")
+		return nil
+	}
+
+	session = &proxySession{up: up}
+	session.timer = time.AfterFunc(p.idleTimeout(), func() {
+		up.Close()
+	})
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		up.Close()
+		return nil
+	}
+	p.sessions[key] = session
+	p.mu.Unlock()
+
+	go func() {
+		p.relayReplies(up, func(msg []byte) error {
+			if len(msg) > MaxUdpSize {
+				p.log.WithField("size", len(msg)).Info("Dropping reply too large for a datagram")
+				return nil
+			}
+			session.timer.Reset(p.idleTimeout())
+			_, err := conn.WriteTo(msg, addr)
+			return err
+		})
+
+		session.timer.Stop()
+		up.Close()
+		p.mu.Lock()
+		if p.sessions[key] == session {
+			delete(p.sessions, key)
+		}
+		delete(p.conns, up)
+		p.mu.Unlock()
+	}()
+	return session
+}
+
+// dial connects to the upstream server.
+func (p *Proxy) dial() (net.Conn, error) {
+	timeout := p.DialTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	network := "tcp"
+	if p.UpstreamProtocol == Udp {
+		network = "udp"
+	}
+	up, err := net.DialTimeout(network, p.Upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !p.track(up) {
+		up.Close()
+		return nil, errProxyClosed
+	}
+	return up, nil
+}
+
+func (p *Proxy) idleTimeout() time.Duration {
+	if p.IdleTimeout == 0 {
+		return time.Minute
+	}
+	return p.IdleTimeout
+}
+
+// forward sends a message to the upstream server, with the framing of its transport.
+func (p *Proxy) forward(up net.Conn, msg []byte) error {
+	if p.UpstreamProtocol == Udp {
+		if len(msg) > MaxUdpSize {
+			p.log.WithField("size", len(msg)).Info("Dropping call too large for a datagram")
+			return nil
+		}
+		_, err := up.Write(msg)
+		return err
+	}
+	return writeRecord(up, msg)
+}
+
+// relayReplies reads the messages sent by the upstream server on up, and passes them to send,
+// until up is closed or send fails.
+func (p *Proxy) relayReplies(up net.Conn, send func(msg []byte) error) {
+	var buf []byte
+	if p.UpstreamProtocol == Udp {
+		buf = make([]byte, MaxUdpSize)
+	}
+
+	for {
+		var msg []byte
+		if p.UpstreamProtocol == Udp {
+			n, err := up.Read(buf)
+			if err != nil {
+				return
+			}
+			msg = buf[:n]
+		} else {
+			record, err := ReadRecord(up)
+			if err != nil {
+				return
+			}
+			msg = record.Bytes()
+		}
+
+		if err := send(msg); err != nil {
+			return
+		}
+	}
+}
+
+// writeRecord writes a message as a record, split in fragments if needed.
+func writeRecord(w io.Writer, msg []byte) error {
+	rw := NewRecordWriter(w)
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+	return rw.Close()
+}
+
+// Close stops the proxy, closing the listeners and all connections.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = make(map[io.Closer]bool)
+	for _, session := range p.sessions {
+		session.timer.Stop()
+	}
+	p.mu.Unlock()
+
+	for c := range conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// track registers a listener or connection to close on Close, returning false if the proxy
+// is already closed.
+func (p *Proxy) track(c io.Closer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[c] = true
+	return true
+}
+
+func (p *Proxy) untrack(c io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c)
+}
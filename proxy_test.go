@@ -0,0 +1,72 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy(t *testing.T) {
+	for _, up := range []PortmapperProtocol{Tcp, Udp} {
+		var s Server
+		var addr net.Addr
+		if up == Tcp {
+			ts := NewTCPServer(0x20000001, 1)
+			ln, _, err := ts.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go ts.serve(ln)
+			s, addr = ts, ln.Addr()
+		} else {
+			us := NewUDPServer(0x20000001, 1)
+			conn, _, err := us.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go us.serve(conn)
+			s, addr = us, conn.LocalAddr()
+		}
+
+		var xids []uint32
+		s.Register(0, func(args struct{}, reply *struct{}) error {
+			return nil
+		})
+		s.Register(1, func(ctx context.Context, arg uint32, reply *uint32) error {
+			xids = append(xids, CallInfoFromContext(ctx).Xid)
+			*reply = arg * 2
+			return nil
+		})
+
+		// Clients use the other transport
+		p := NewProxy(addr.String(), up)
+		down, transport := Udp, ClientTransportUdpOnly
+		if up == Udp {
+			down, transport = Tcp, ClientTransportTcpOnly
+		}
+		paddr, err := p.Serve(down, "127.0.0.1:0")
+		assert.Nil(t, err)
+
+		var sent []uint32
+		c := NewClient(paddr.String(), 0x20000001, 1, &ClientConfig{
+			Transport: transport,
+			Tracer: func(ctx context.Context, info *TraceInfo) (context.Context, func(error)) {
+				sent = append(sent, info.Xid)
+				return ctx, func(error) {}
+			},
+		})
+
+		var reply uint32
+		for i := uint32(1); i <= 3; i++ {
+			assert.Nil(t, c.Call(1, i, &reply))
+			assert.Equal(t, 2*i, reply)
+		}
+
+		c.Close()
+		assert.Nil(t, p.Close())
+		assert.Nil(t, s.Shutdown(context.Background()))
+
+		// Skip the ping done when connecting
+		if assert.Len(t, sent, 4) {
+			assert.Equal(t, sent[1:], xids)
+		}
+	}
+}
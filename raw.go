@@ -0,0 +1,63 @@
+package sunrpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// RawHandler is a procedure handling pre-encoded data: it receives the XDR-encoded arguments
+// of the call, and returns the XDR-encoded results, which are sent verbatim. This allows to
+// relay calls (e.g. from a proxy) without decoding them. The results must have a size
+// multiple of 4 bytes, as all XDR data.
+//
+// ctx carries the CallInfo of the call, like for the other procedures.
+type RawHandler func(ctx context.Context, args []byte) ([]byte, error)
+
+// RegisterRaw binds a procedure ID to a RawHandler. Raw handlers can also be passed to
+// RegisterProgram.
+func (server *server) RegisterRaw(proc uint32, handler RawHandler) {
+	server.programs.register(server.program, server.version, proc, handler, "")
+}
+
+// rawMessage holds the XDR-encoded arguments or results of a call, which are sent and received
+// verbatim.
+type rawMessage []byte
+
+func (m *rawMessage) decodeReply(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	*m = b
+	return err
+}
+
+// callRaw calls a RawHandler with the rest of the call as arguments.
+func (s *server) callRaw(ctx context.Context, r io.Reader, handler RawHandler) (interface{}, error) {
+	args, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &ErrGarbageArgs{}
+	}
+
+	return runProcedure(ctx, func() (interface{}, error) {
+		reply, err := handler(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		return rawMessage(reply), nil
+	}, nil)
+}
+
+// CallRaw calls the specified proc with already XDR-encoded arguments, and returns the
+// XDR-encoded results, without decoding them. Errors are reported like for Call.
+func (c *Client) CallRaw(proc uint32, args []byte) ([]byte, error) {
+	return c.CallProgramRawContext(context.Background(), c.Program, c.Version, proc, args)
+}
+
+// CallProgramRawContext is like CallRaw, with the program, version and context semantics of
+// CallProgramContext.
+func (c *Client) CallProgramRawContext(ctx context.Context, program, version, proc uint32, args []byte) ([]byte, error) {
+	var reply rawMessage
+	if err := c.CallProgramContext(ctx, program, version, proc, rawMessage(args), &reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,255 @@
+package sunrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// recordFragmentSize is the size of the fragments sent by RecordWriter and ReplyStream, well
+// below the maximum size of the fragments accepted by the package.
+const recordFragmentSize = replyStreamChunkSize
+
+// RecordReader reads the payload of a record from a stream transport, across its fragments,
+// without reading the whole record into memory. Read returns io.EOF at the end of the record,
+// after which another RecordReader must be created to read the following one.
+//
+// WriteTo copies the fragments directly to the destination, so that the payload can be
+// spliced into it (e.g. from a socket into a file) when both ends support it.
+type RecordReader struct {
+	r       io.Reader
+	left    int64 // bytes left in the current fragment
+	last    bool  // the current fragment is the last one
+	started bool
+	err     error
+}
+
+// NewRecordReader creates a reader for the record starting at the current position of r.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: r}
+}
+
+// next moves to the next fragment of the record, returning io.EOF at the end of the record.
+func (rr *RecordReader) next() error {
+	if rr.err != nil {
+		return rr.err
+	}
+	if rr.started && rr.last {
+		rr.err = io.EOF
+		return rr.err
+	}
+
+	size, last, err := readFragmentHeader(rr.r, nil)
+	if err != nil {
+		if err == io.EOF && rr.started {
+			err = io.ErrUnexpectedEOF
+		}
+		rr.err = err
+		return err
+	}
+	rr.left, rr.last, rr.started = int64(size), last, true
+	return nil
+}
+
+func (rr *RecordReader) Read(p []byte) (int, error) {
+	for rr.left == 0 {
+		if err := rr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > rr.left {
+		p = p[:rr.left]
+	}
+	n, err := rr.r.Read(p)
+	rr.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		rr.err = err
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo, copying the rest of the record to w.
+func (rr *RecordReader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		if rr.left == 0 {
+			if err := rr.next(); err == io.EOF {
+				return total, nil
+			} else if err != nil {
+				return total, err
+			}
+			continue
+		}
+
+		n, err := io.CopyN(w, rr.r, rr.left)
+		total += n
+		rr.left -= n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			rr.err = err
+			return total, err
+		}
+	}
+}
+
+// RecordWriter writes a record to a stream transport, as a series of fragments of up to 16 KB,
+// without buffering the whole record in memory. The record is terminated by Close.
+//
+// ReadFrom sends regular files (and in-memory readers) without copying them, so that they can
+// be sent with sendfile when w is a TCP connection.
+type RecordWriter struct {
+	w   io.Writer
+	buf bytes.Buffer // data of the last fragment, which cannot be empty
+	err error
+}
+
+// NewRecordWriter creates a writer for a record sent to w.
+func NewRecordWriter(w io.Writer) *RecordWriter {
+	return &RecordWriter{w: w}
+}
+
+var errRecordClosed = errors.New("record already terminated")
+
+func (rw *RecordWriter) Write(p []byte) (int, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+
+	rw.buf.Write(p)
+	for rw.buf.Len() > recordFragmentSize {
+		if rw.err = writeFragment(rw.w, rw.buf.Next(recordFragmentSize), false); rw.err != nil {
+			return 0, rw.err
+		}
+	}
+	return len(p), nil
+}
+
+// ReadFrom implements io.ReaderFrom, appending the data read from r to the record.
+func (rw *RecordWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+
+	if src, n, lr, ok := sizedSource(r); ok && n > recordFragmentSize {
+		send := func(r io.Reader, n int64) error {
+			return writeFragmentFrom(rw.w, r, n, false)
+		}
+		written, err := sendSized(send, &rw.buf, src, n)
+		if lr != nil {
+			lr.N -= written
+		}
+		if err != nil {
+			rw.err = err
+		}
+		return written, err
+	}
+
+	// Hide ReadFrom from io.Copy, which would call it again
+	return io.Copy(struct{ io.Writer }{rw}, r)
+}
+
+// Close writes the last fragment of the record. Records cannot be empty.
+func (rw *RecordWriter) Close() error {
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.buf.Len() == 0 {
+		return errors.New("A TCP record must be at least one byte in size")
+	}
+
+	if err := writeFragment(rw.w, rw.buf.Bytes(), true); err != nil {
+		rw.err = err
+		return err
+	}
+	rw.buf.Reset()
+	rw.err = errRecordClosed
+	return nil
+}
+
+// sizedSource returns the number of bytes left in r when they can be known without reading
+// them, i.e. for regular files and in-memory readers (possibly wrapped by an io.LimitedReader,
+// which is returned so that its limit can be updated). src is the reader to copy them from.
+func sizedSource(r io.Reader) (src io.Reader, n int64, lr *io.LimitedReader, ok bool) {
+	limit := int64(-1)
+	if l, isLimited := r.(*io.LimitedReader); isLimited {
+		r, lr, limit = l.R, l, l.N
+	}
+
+	switch f := r.(type) {
+	case *os.File:
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil, 0, nil, false
+		}
+		off, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, nil, false
+		}
+		if n = fi.Size() - off; n < 0 {
+			n = 0
+		}
+	case interface{ Len() int }:
+		n = int64(f.Len())
+	default:
+		return nil, 0, nil, false
+	}
+
+	if limit >= 0 && limit < n {
+		n = limit
+	}
+	return r, n, lr, true
+}
+
+// sendSized sends the n bytes left in r as record fragments through send, except for the last
+// ones (up to recordFragmentSize), which are appended to tail so that the record can still be
+// terminated. The data buffered in tail before is sent first.
+func sendSized(send func(r io.Reader, n int64) error, tail *bytes.Buffer, r io.Reader, n int64) (int64, error) {
+	if tail.Len() > 0 {
+		if err := send(tail, int64(tail.Len())); err != nil {
+			return 0, err
+		}
+	}
+
+	var written int64
+	full := (n - 1) / recordFragmentSize * recordFragmentSize
+	for written < full {
+		if err := send(r, recordFragmentSize); err != nil {
+			return written, err
+		}
+		written += recordFragmentSize
+	}
+
+	m, err := tail.ReadFrom(io.LimitReader(r, n-full))
+	written += m
+	if err == nil && m < n-full {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
+
+// writeFragmentFrom writes a record fragment made of the next n bytes of r. The payload is
+// copied with io.CopyN, so that w can use its ReadFrom method (e.g. sendfile for TCP
+// connections).
+func writeFragmentFrom(w io.Writer, r io.Reader, n int64, last bool) error {
+	var marker [4]byte
+	binary.BigEndian.PutUint32(marker[:], NewRecordMarker(uint32(n), last))
+	if err := writeFull(w, marker[:]); err != nil {
+		return err
+	}
+
+	if m, err := io.CopyN(w, r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return &ErrPartialWrite{Written: len(marker) + int(m), Total: len(marker) + int(n), Err: err}
+	}
+	return nil
+}
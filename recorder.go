@@ -0,0 +1,264 @@
+package sunrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// FrameDirection tells whether a recorded frame was sent or received.
+type FrameDirection uint32
+
+const (
+	FrameSent     FrameDirection = iota // sent by the recording side (calls, for a client)
+	FrameReceived                       // received by the recording side (replies, for a client)
+)
+
+// RecordedFrame is an RPC message captured by a Recorder. Data holds the whole message, without
+// record marking: recordings are thus independent of the transport.
+type RecordedFrame struct {
+	Dir  FrameDirection
+	Data []byte
+}
+
+// Recorder is a connection which captures the RPC messages going through it. Each message is
+// written to the recording as an XDR-encoded RecordedFrame, as soon as it is complete; use
+// ReadRecording to load them back.
+//
+// A Recorder can be used both on the client side (see NewClientFromConn) and on the server side.
+type Recorder struct {
+	net.Conn
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+	in  frameSplitter
+	out frameSplitter
+}
+
+// NewRecorder wraps conn, recording the messages exchanged over it to w. proto tells whether
+// conn is a stream transport (Tcp) or a datagram one (Udp).
+func NewRecorder(conn net.Conn, proto PortmapperProtocol, w io.Writer) *Recorder {
+	return &Recorder{
+		Conn: conn,
+		w:    w,
+		in:   frameSplitter{proto: proto},
+		out:  frameSplitter{proto: proto},
+	}
+}
+
+func (r *Recorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		r.capture(FrameReceived, &r.in, b[:n])
+	}
+	return n, err
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	if n > 0 {
+		r.capture(FrameSent, &r.out, b[:n])
+	}
+	return n, err
+}
+
+// Err returns the first error that occurred writing the recording, if any. Once an error
+// occurs, no more frames are recorded.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) capture(dir FrameDirection, split *frameSplitter, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, data := range split.push(b) {
+		if r.err != nil {
+			return
+		}
+		_, r.err = xdr.Marshal(r.w, &RecordedFrame{Dir: dir, Data: data})
+	}
+}
+
+// ReadRecording loads the frames written by a Recorder.
+func ReadRecording(r io.Reader) ([]RecordedFrame, error) {
+	br := bufio.NewReader(r)
+
+	var frames []RecordedFrame
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return frames, nil
+		}
+
+		var frame RecordedFrame
+		if _, err := xdr.Unmarshal(br, &frame); err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// ReplayConn is a connection which plays back a recording captured on the client side, so that
+// a Client can be run against it without a server (see NewClientFromConn).
+//
+// Each message written to the connection must match the next sent frame of the recording; the
+// transaction ID is ignored, since it changes from run to run. The received frames that follow
+// it are then returned by Read, with the transaction ID of the message that was written.
+type ReplayConn struct {
+	mu     sync.Mutex
+	frames []RecordedFrame
+	next   int
+	proto  PortmapperProtocol
+	split  frameSplitter
+	udp    [][]byte
+	stream bytes.Buffer
+	closed bool
+}
+
+// NewReplayConn creates a connection playing back frames. proto tells whether the connection
+// must behave as a stream transport (Tcp) or a datagram one (Udp).
+func NewReplayConn(frames []RecordedFrame, proto PortmapperProtocol) *ReplayConn {
+	return &ReplayConn{
+		frames: frames,
+		proto:  proto,
+		split:  frameSplitter{proto: proto},
+	}
+}
+
+func (c *ReplayConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	for _, data := range c.split.push(b) {
+		if c.next >= len(c.frames) || c.frames[c.next].Dir != FrameSent || !sameMessage(c.frames[c.next].Data, data) {
+			return 0, &ErrReplayMismatch{Frame: c.next}
+		}
+		c.next++
+
+		for ; c.next < len(c.frames) && c.frames[c.next].Dir == FrameReceived; c.next++ {
+			reply := append([]byte(nil), c.frames[c.next].Data...)
+			if len(reply) >= 4 && len(data) >= 4 {
+				copy(reply[:4], data[:4])
+			}
+
+			if c.proto == Udp {
+				c.udp = append(c.udp, reply)
+			} else {
+				WriteTCPReplyMessage(&c.stream, reply)
+			}
+		}
+	}
+
+	return len(b), nil
+}
+
+// Read returns the replies to the messages written so far. Since nothing else can arrive,
+// it returns io.EOF instead of blocking when there is nothing to read.
+func (c *ReplayConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if c.proto == Udp {
+		if len(c.udp) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(b, c.udp[0])
+		c.udp = c.udp[1:]
+		return n, nil
+	}
+
+	return c.stream.Read(b)
+}
+
+// Done reports whether all the frames of the recording have been played back.
+func (c *ReplayConn) Done() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.next == len(c.frames)
+}
+
+func (c *ReplayConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *ReplayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (c *ReplayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (c *ReplayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *ReplayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+// sameMessage compares two RPC messages, ignoring their transaction IDs.
+func sameMessage(a, b []byte) bool {
+	if len(a) < 4 || len(b) < 4 {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(a[4:], b[4:])
+}
+
+// frameSplitter reassembles the RPC messages going through a connection.
+type frameSplitter struct {
+	proto PortmapperProtocol
+	buf   bytes.Buffer
+}
+
+// push feeds data read from or written to the connection, and returns the messages
+// completed by it (if any).
+func (f *frameSplitter) push(b []byte) [][]byte {
+	if f.proto == Udp {
+		return [][]byte{append([]byte(nil), b...)}
+	}
+
+	f.buf.Write(b)
+
+	var frames [][]byte
+	for {
+		data := f.buf.Bytes()
+
+		var msg []byte
+		var off int
+		var complete bool
+		for off+4 <= len(data) {
+			size, last := ParseRecordMarker(binary.BigEndian.Uint32(data[off:]))
+			if off+4+int(size) > len(data) {
+				break
+			}
+			msg = append(msg, data[off+4:off+4+int(size)]...)
+			off += 4 + int(size)
+			if last {
+				complete = true
+				break
+			}
+		}
+
+		if !complete {
+			return frames
+		}
+		f.buf.Next(off)
+		frames = append(frames, msg)
+	}
+}
@@ -0,0 +1,70 @@
+package sunrpc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorderReplay(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	// Fake server, doubling its argument
+	go func() {
+		for {
+			record, err := ReadRecord(serverConn)
+			if err != nil {
+				return
+			}
+			call := record.Bytes()
+			reply := []byte{
+				call[0], call[1], call[2], call[3], // Xid
+				0x00, 0x00, 0x00, 0x01, // Reply
+				0x00, 0x00, 0x00, 0x00, // Accepted
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+				0x00, 0x00, 0x00, 0x00, // Success
+				0x00, 0x00, 0x00, call[len(call)-1] * 2,
+			}
+			WriteTCPReplyMessage(serverConn, reply)
+		}
+	}()
+
+	var recording bytes.Buffer
+	rec := NewRecorder(clientConn, Tcp, &recording)
+	c := NewClientFromConn(rec, Tcp, 0x20000001, 1)
+
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(21), &reply))
+	assert.Equal(t, uint32(42), reply)
+	assert.Nil(t, rec.Err())
+	c.Close()
+
+	frames, err := ReadRecording(&recording)
+	assert.Nil(t, err)
+	if assert.Len(t, frames, 2) {
+		assert.Equal(t, FrameSent, frames[0].Dir)
+		assert.Equal(t, FrameReceived, frames[1].Dir)
+	}
+
+	// Play the recording back, for both transports
+	for _, proto := range []PortmapperProtocol{Tcp, Udp} {
+		replay := NewReplayConn(frames, proto)
+		c = NewClientFromConn(replay, proto, 0x20000001, 1)
+
+		reply = 0
+		assert.Nil(t, c.Call(1, uint32(21), &reply))
+		assert.Equal(t, uint32(42), reply)
+		assert.True(t, replay.Done())
+	}
+
+	// Calls differing from the recording are detected
+	c = NewClientFromConn(NewReplayConn(frames, Tcp), Tcp, 0x20000001, 1)
+	err = c.Call(1, uint32(20), &reply)
+	if terr, ok := err.(*TransportError); assert.True(t, ok) {
+		_, mismatch := terr.Err.(*ErrReplayMismatch)
+		assert.True(t, mismatch)
+	}
+}
@@ -0,0 +1,131 @@
+package sunrpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// replyStreamChunkSize is the amount of data buffered by a ReplyStream before it is sent
+// as a record fragment.
+const replyStreamChunkSize = 16 * 1024
+
+// ReplyStream lets a procedure send its results incrementally, instead of materializing them
+// in memory all at once. Procedures opt in by taking a *ReplyStream instead of a reply
+// pointer:
+//
+//	func (t *T) MethodName(argType T1, reply *sunrpc.ReplyStream) error
+//
+// The results are written as XDR-encoded data, through Encode or Write. On stream transports,
+// they are sent as successive record fragments as they are produced; on datagram transports,
+// they are sent as a single datagram when the procedure returns.
+//
+// Once some data was sent, a procedure can no longer report a failure to the client: if it
+// returns an error, the connection is closed instead.
+type ReplyStream struct {
+	mu        sync.Mutex // protects the stream from procedures writing after being given up
+	buf       bytes.Buffer
+	flush     func(fragment []byte) error      // sends a fragment, or nil if the transport cannot stream
+	flushFrom func(r io.Reader, n int64) error // sends the next n bytes of r as a fragment
+	sent      bool
+	err       error
+}
+
+var replyStreamType = reflect.TypeOf((*ReplyStream)(nil))
+
+// Encode writes v, XDR-encoded, to the results.
+func (rs *ReplyStream) Encode(v interface{}) error {
+	_, err := xdr.Marshal(rs, v)
+	return err
+}
+
+// Write appends already XDR-encoded data to the results.
+func (rs *ReplyStream) Write(p []byte) (int, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.err != nil {
+		return 0, rs.err
+	}
+
+	rs.buf.Write(p)
+	if rs.flush == nil {
+		return len(p), nil
+	}
+
+	// Some data is always kept for the last fragment, which cannot be empty
+	for rs.buf.Len() > replyStreamChunkSize {
+		if rs.err = rs.flush(rs.buf.Next(replyStreamChunkSize)); rs.err != nil {
+			return 0, rs.err
+		}
+		rs.sent = true
+	}
+	return len(p), nil
+}
+
+// ReadFrom implements io.ReaderFrom, appending already XDR-encoded data read from r to the
+// results: for instance, the contents of a file, preceded by their length and followed by
+// their padding to a multiple of 4 bytes, to return them as an opaque.
+//
+// On stream transports, regular files are sent without being copied into the stream, so that
+// the data can be sent with sendfile. Their size must not change while they are sent.
+func (rs *ReplyStream) ReadFrom(r io.Reader) (int64, error) {
+	rs.mu.Lock()
+	if rs.err != nil {
+		rs.mu.Unlock()
+		return 0, rs.err
+	}
+
+	if rs.flushFrom != nil {
+		if src, n, lr, ok := sizedSource(r); ok && n > recordFragmentSize {
+			defer rs.mu.Unlock()
+
+			rs.sent = true
+			written, err := sendSized(rs.flushFrom, &rs.buf, src, n)
+			if lr != nil {
+				lr.N -= written
+			}
+			if err != nil {
+				rs.err = err
+			}
+			return written, err
+		}
+	}
+	rs.mu.Unlock()
+
+	// Hide ReadFrom from io.Copy, which would call it again
+	return io.Copy(struct{ io.Writer }{rs}, r)
+}
+
+var errReplyStreamAborted = errors.New("streamed reply aborted")
+
+// abort makes the subsequent writes to the stream fail, once the call has been given up. When
+// it returns, the stream is no longer modified by the procedure.
+func (rs *ReplyStream) abort() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.err == nil {
+		rs.err = errReplyStreamAborted
+	}
+}
+
+// isStreamingProcedure reports whether a procedure sends its results through a ReplyStream.
+func isStreamingProcedure(receiverFunc interface{}) bool {
+	funcType := reflect.TypeOf(receiverFunc)
+	return funcType.NumIn() > 0 && funcType.In(funcType.NumIn()-1) == replyStreamType
+}
+
+// writeFragment writes a record fragment.
+func writeFragment(w io.Writer, fragment []byte, last bool) error {
+	buf := bytes.NewBuffer(make([]byte, 0, len(fragment)+4))
+	if err := WriteRecordMarker(buf, uint32(len(fragment)), last); err != nil {
+		return err
+	}
+	buf.Write(fragment)
+
+	return writeFull(w, buf.Bytes())
+}
@@ -0,0 +1,121 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+// readFragments reads a record from r, returning its data and the size of its fragments.
+func readFragments(t *testing.T, r io.Reader) ([]byte, []int) {
+	var record bytes.Buffer
+	var sizes []int
+	for {
+		size, last, err := ReadRecordMarker(r)
+		if !assert.Nil(t, err) {
+			return nil, nil
+		}
+		_, err = io.CopyN(&record, r, int64(size))
+		assert.Nil(t, err)
+		sizes = append(sizes, int(size))
+		if last {
+			return record.Bytes(), sizes
+		}
+	}
+}
+
+func streamingServer(s Server) {
+	s.Register(1, func(n uint32, reply *ReplyStream) error {
+		if err := reply.Encode(n); err != nil {
+			return err
+		}
+		for i := uint32(0); i < n; i++ {
+			if err := reply.Encode(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.Register(2, func(n uint32, reply *ReplyStream) error {
+		for i := uint32(0); i < n; i++ {
+			if err := reply.Encode(i); err != nil {
+				return err
+			}
+		}
+		return errors.New("failed")
+	})
+}
+
+func TestReplyStreamFragments(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	streamingServer(s)
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	var msg bytes.Buffer
+	_, err = xdr.Marshal(&msg, NewProcedureCall(0x20000001, 1, 1))
+	assert.Nil(t, err)
+	_, err = xdr.Marshal(&msg, uint32(10000))
+	assert.Nil(t, err)
+	assert.Nil(t, WriteTCPReplyMessage(conn, msg.Bytes()))
+
+	// The results are sent in chunks, as they are produced
+	record, sizes := readFragments(t, conn)
+	if assert.True(t, len(sizes) > 2) {
+		for _, size := range sizes[1 : len(sizes)-1] {
+			assert.Equal(t, replyStreamChunkSize, size)
+		}
+	}
+
+	reply, results, err := DecodeReplyBody(record)
+	assert.Nil(t, err)
+	assert.Equal(t, AcceptType(Success), reply.Accepted.Stat)
+	var values []uint32
+	_, err = xdr.Unmarshal(bytes.NewReader(results), &values)
+	assert.Nil(t, err)
+	if assert.Len(t, values, 10000) {
+		assert.Equal(t, uint32(9999), values[9999])
+	}
+	conn.Close()
+	s.Shutdown(context.Background())
+}
+
+func TestReplyStreamErrors(t *testing.T) {
+	for _, protocol := range []PortmapperProtocol{Tcp, Udp} {
+		var s Server
+		if protocol == Tcp {
+			s = NewTCPServer(0x20000001, 1)
+		} else {
+			s = NewUDPServer(0x20000001, 1)
+		}
+		streamingServer(s)
+		conn, err := Pipe(s, nil)
+		assert.Nil(t, err)
+		c := NewClientFromConn(conn, protocol, 0x20000001, 1)
+
+		// On datagram transports, the results are sent at once
+		var values []uint32
+		assert.Nil(t, c.Call(1, uint32(100), &values))
+		assert.Len(t, values, 100)
+
+		// Errors are replied while nothing was sent
+		err = c.Call(2, uint32(100), &values)
+		if e, ok := err.(*RPCAcceptError); assert.True(t, ok) {
+			assert.Equal(t, AcceptType(SystemErr), e.Stat)
+		}
+
+		// Once fragments were sent, the connection is closed instead
+		if protocol == Tcp {
+			err = c.Call(2, uint32(10000), &values)
+			_, transport := err.(*TransportError)
+			assert.True(t, transport)
+		}
+		c.Close()
+		s.Shutdown(context.Background())
+	}
+}
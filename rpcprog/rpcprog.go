@@ -0,0 +1,228 @@
+// Package rpcprog maps the names of ONC RPC programs to their numbers, like the /etc/rpc
+// database of Unix systems. It provides the numbers of well-known programs as constants, and
+// registries to look them up by name (or alias) and number:
+//
+//	prog, ok := rpcprog.Number("mount")    // 100005
+//	name, ok := rpcprog.Name(100003)       // "nfs"
+//
+// The default registry holds the well-known programs; LoadSystem adds the ones listed in the
+// /etc/rpc file of the host.
+package rpcprog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Numbers of well-known programs.
+const (
+	Portmapper = 100000 // portmapper and rpcbind
+	Rstatd     = 100001
+	Rusersd    = 100002
+	NFS        = 100003
+	Ypserv     = 100004
+	Mountd     = 100005
+	Ypbind     = 100007
+	Walld      = 100008
+	Yppasswdd  = 100009
+	Rquotad    = 100011
+	Sprayd     = 100012
+	Rexd       = 100017
+	Nlockmgr   = 100021
+	Statmon    = 100023
+	Status     = 100024 // network status monitor (statd)
+	Bootparam  = 100026
+	Ypupdated  = 100028
+	Keyserv    = 100029
+	Ypxfrd     = 100069
+	NFSACL     = 100227
+	Pcnfsd     = 150001
+)
+
+// Entry describes a program, as listed in /etc/rpc.
+type Entry struct {
+	Name    string
+	Number  uint32
+	Aliases []string
+}
+
+// Registry maps program names and aliases to numbers, and numbers to names. It is safe for
+// concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	byName   map[string]*Entry // by name and alias
+	byNumber map[uint32]*Entry
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		byName:   make(map[string]*Entry),
+		byNumber: make(map[uint32]*Entry),
+	}
+}
+
+// Default is the registry used by the functions of the package. It holds the well-known
+// programs, with the names and aliases of the /etc/rpc file of most systems.
+var Default = NewRegistry()
+
+func init() {
+	for _, e := range []Entry{
+		{"portmapper", Portmapper, []string{"portmap", "sunrpc", "rpcbind"}},
+		{"rstatd", Rstatd, []string{"rstat", "rstat_svc", "rup", "perfmeter"}},
+		{"rusersd", Rusersd, []string{"rusers"}},
+		{"nfs", NFS, []string{"nfsprog"}},
+		{"ypserv", Ypserv, []string{"ypprog"}},
+		{"mountd", Mountd, []string{"mount", "showmount"}},
+		{"ypbind", Ypbind, nil},
+		{"walld", Walld, []string{"rwall", "shutdown"}},
+		{"yppasswdd", Yppasswdd, []string{"yppasswd"}},
+		{"rquotad", Rquotad, []string{"rquotaprog", "quota", "rquota"}},
+		{"sprayd", Sprayd, []string{"spray"}},
+		{"rexd", Rexd, []string{"rex"}},
+		{"nlockmgr", Nlockmgr, nil},
+		{"statmon", Statmon, nil},
+		{"status", Status, nil},
+		{"bootparam", Bootparam, nil},
+		{"ypupdated", Ypupdated, []string{"ypupdate"}},
+		{"keyserv", Keyserv, []string{"keyserver"}},
+		{"ypxfrd", Ypxfrd, nil},
+		{"nfs_acl", NFSACL, nil},
+		{"pcnfsd", Pcnfsd, nil},
+	} {
+		Default.Add(e)
+	}
+}
+
+// Add registers a program. An entry already registered with the same number is replaced, and
+// its name and aliases removed, unless they are also used by other programs.
+func (reg *Registry) Add(e Entry) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if old := reg.byNumber[e.Number]; old != nil {
+		for _, name := range append([]string{old.Name}, old.Aliases...) {
+			if reg.byName[name] == old {
+				delete(reg.byName, name)
+			}
+		}
+	}
+
+	entry := &Entry{Name: e.Name, Number: e.Number, Aliases: append([]string(nil), e.Aliases...)}
+	reg.byNumber[e.Number] = entry
+	for _, alias := range entry.Aliases {
+		reg.byName[alias] = entry
+	}
+	reg.byName[entry.Name] = entry
+}
+
+// Lookup returns the program registered with a name or alias.
+func (reg *Registry) Lookup(name string) (Entry, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	e, ok := reg.byName[name]
+	if !ok {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// LookupNumber returns the program registered with a number.
+func (reg *Registry) LookupNumber(number uint32) (Entry, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	e, ok := reg.byNumber[number]
+	if !ok {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// Entries returns the registered programs, by number.
+func (reg *Registry) Entries() []Entry {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	list := make([]Entry, 0, len(reg.byNumber))
+	for _, e := range reg.byNumber {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Number < list[j].Number })
+	return list
+}
+
+// Parse reads programs in the format of /etc/rpc (a name, a number and optional aliases per
+// line, with comments starting with '#'), and adds them to the registry.
+func (reg *Registry) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("line %v: missing program number", line)
+		}
+
+		number, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("line %v: invalid program number %q", line, fields[1])
+		}
+		reg.Add(Entry{Name: fields[0], Number: uint32(number), Aliases: fields[2:]})
+	}
+	return scanner.Err()
+}
+
+// Load adds the programs listed in a file in the format of /etc/rpc to the registry.
+func (reg *Registry) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := reg.Parse(f); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// SystemFile is the path of the program database of the host.
+const SystemFile = "/etc/rpc"
+
+// LoadSystem adds the programs listed in the /etc/rpc file of the host to the default
+// registry, replacing the well-known ones with the same numbers.
+func LoadSystem() error {
+	return Default.Load(SystemFile)
+}
+
+// Number returns the number of a program of the default registry, from its name or alias.
+func Number(name string) (uint32, bool) {
+	e, ok := Default.Lookup(name)
+	return e.Number, ok
+}
+
+// Name returns the name of a program of the default registry.
+func Name(number uint32) (string, bool) {
+	e, ok := Default.LookupNumber(number)
+	return e.Name, ok
+}
+
+// String returns the name of a program of the default registry, or its number in decimal
+// notation if it is not registered. It is convenient to describe programs in logs.
+func String(number uint32) string {
+	if name, ok := Name(number); ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(number), 10)
+}
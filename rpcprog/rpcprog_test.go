@@ -0,0 +1,46 @@
+package rpcprog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefault(t *testing.T) {
+	number, ok := Number("showmount")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(Mountd), number)
+
+	name, ok := Name(NFS)
+	assert.True(t, ok)
+	assert.Equal(t, "nfs", name)
+
+	e, ok := Default.Lookup("rpcbind")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(Portmapper), e.Number)
+	assert.Equal(t, "536870913", String(0x20000001))
+}
+
+func TestParse(t *testing.T) {
+	reg := NewRegistry()
+	assert.Nil(t, reg.Parse(strings.NewReader(`
+# comment
+portmapper	100000	portmap sunrpc rpcbind
+fypxfrd		600100069	freebsd-ypxfrd  # trailing comment
+tfsd		100037 
+`)))
+
+	e, ok := reg.Lookup("freebsd-ypxfrd")
+	assert.True(t, ok)
+	assert.Equal(t, Entry{Name: "fypxfrd", Number: 600100069, Aliases: []string{"freebsd-ypxfrd"}}, e)
+	assert.Len(t, reg.Entries(), 3)
+
+	// Replacing a program drops its old names
+	reg.Add(Entry{Name: "rpcbind", Number: 100000})
+	_, ok = reg.Lookup("portmap")
+	assert.False(t, ok)
+
+	assert.NotNil(t, reg.Parse(strings.NewReader("nfs\n")))
+	assert.NotNil(t, reg.Parse(strings.NewReader("nfs abc\n")))
+}
@@ -2,40 +2,136 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
+	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"gopkg.in/Sirupsen/logrus.v0"
 )
 
 type server struct {
-	program    uint32
-	version    uint32
-	procedures map[uint32]interface{}
-	procnames  map[uint32]string
-	log        *logrus.Entry
-	authFun    func(proc uint32, cred interface{}) bool
+	program       uint32
+	version       uint32
+	programs      *programRegistry
+	replyHints    map[procKey]int
+	maxArgSizes   map[procKey]int
+	log           *logrus.Entry
+	authFun       func(proc uint32, cred interface{}) bool
+	authFuns      map[progVers]func(proc uint32, cred interface{}) bool
+	authenticator Authenticator
+	authPolicies  map[uint32]*AuthPolicy
+	squash        *SquashRules
+	shortCache    AuthShortCache
+	authDH        *AuthDHServer
+	pool          *workerPool
+	limiters      map[uint32]*programLimiter
+	acl           AccessControlFunc
+	aclDeny       AccessDenyMode
+	stats         *serverStats
+	statsProgram  uint32
+	callTimeout   time.Duration
+	tracer        CallTracer
+	audit         AuditSink
+	baseCtx       context.Context // parent of the contexts of the calls, canceled on Shutdown
+	cancelCalls   context.CancelFunc
+
+	mu         sync.Mutex
+	closed     bool
+	announced  bool
+	prot       PortmapperProtocol
+	port       int
+	registered map[progVers]bool // registrations done by announce
 }
 
 func newServer(program uint32, version uint32, f logrus.Fields) server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return server{
-		program:    program,
-		version:    version,
-		procedures: make(map[uint32]interface{}),
-		procnames:  make(map[uint32]string),
-		log:        logrus.WithField("package", "sunrpc").WithFields(f),
+		program:      program,
+		version:      version,
+		programs:     newProgramRegistry(program, version),
+		replyHints:   make(map[procKey]int),
+		maxArgSizes:  make(map[procKey]int),
+		authFuns:     make(map[progVers]func(uint32, interface{}) bool),
+		authPolicies: make(map[uint32]*AuthPolicy),
+		limiters:     make(map[uint32]*programLimiter),
+		log:          logrus.WithField("package", "sunrpc").WithFields(f),
+		stats:        newServerStats(),
+		baseCtx:      ctx,
+		cancelCalls:  cancel,
 	}
 }
 
-// Register binds a new RPC procedure ID to a function.
+// Register binds a new RPC procedure ID to a function. The function can take a context.Context
+// as first argument, to access the CallInfo of the call being served.
 func (server *server) Register(proc uint32, rcvr interface{}) {
-	server.procedures[proc] = rcvr
+	server.programs.register(server.program, server.version, proc, rcvr, "")
 }
 
 func (server *server) RegisterWithName(proc uint32, rcvr interface{}, name string) {
-	server.procedures[proc] = rcvr
-	server.procnames[proc] = name
+	server.programs.register(server.program, server.version, proc, rcvr, name)
+}
+
+// SetReplySizeHint declares the expected size (in bytes) of the results of a procedure of the
+// program and version the server was created for, so that reply buffers can be allocated
+// upfront instead of being grown while results are encoded. This is useful for procedures
+// returning large results of predictable size. Use SetProgramReplySizeHint for the other
+// programs served. Hints must be declared before the server is started.
+func (server *server) SetReplySizeHint(proc uint32, size int) {
+	server.SetProgramReplySizeHint(server.program, server.version, proc, size)
+}
+
+// SetProgramReplySizeHint is like SetReplySizeHint, for a procedure of any program version.
+func (server *server) SetProgramReplySizeHint(program, version, proc uint32, size int) {
+	server.replyHints[procKey{progVers{program, version}, proc}] = size
+}
+
+// SetMaxArgSize limits the size (in bytes) of the encoded arguments of a procedure of the
+// program and version the server was created for. Calls with larger arguments are replied
+// with GARBAGE_ARGS without being decoded. Independently of this limit, the length of each
+// variable-length item (opaque data, strings, arrays) in the arguments is bounded by the size
+// of the call, so that forged lengths cannot trigger large allocations. Use
+// SetProgramMaxArgSize for the other programs served. Limits must be set before the server
+// is started.
+func (server *server) SetMaxArgSize(proc uint32, size int) {
+	server.SetProgramMaxArgSize(server.program, server.version, proc, size)
+}
+
+// SetProgramMaxArgSize is like SetMaxArgSize, for a procedure of any program version.
+func (server *server) SetProgramMaxArgSize(program, version, proc uint32, size int) {
+	server.maxArgSizes[procKey{progVers{program, version}, proc}] = size
+}
+
+// SetCallTimeout limits the time procedures have to complete. The context passed to the
+// procedures taking one expires after timeout, and when it does, SYSTEM_ERR is replied without
+// waiting for the procedure to return: the procedure is expected to notice that the context is
+// done, and give up. Zero (the default) means no timeout, and procedures run on the goroutine
+// dispatching the call. It must be called before the server is started.
+//
+// With a timeout, procedures run on their own goroutine. A procedure which keeps running after
+// its call was replied is not stopped, but it still holds the resources of the call until it
+// returns: its program concurrency slot (see SetProgramConcurrency), and its worker (see
+// SetWorkerPool) or, without a worker pool, the connection (or the UDP socket) it was received
+// on, which does not dispatch other calls meanwhile. The number of such procedures is thus
+// bounded like the number of calls being processed.
+//
+// Independently of this timeout, the contexts of the calls still being processed are canceled
+// when Shutdown returns.
+func (server *server) SetCallTimeout(timeout time.Duration) {
+	server.callTimeout = timeout
 }
 
+// callContext returns the context of a call being dispatched, derived from parent (which is
+// either the base context of the server, or derived from it).
+func (server *server) callContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if server.callTimeout > 0 {
+		return context.WithTimeout(parent, server.callTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// registerToPortmapper registers the programs served by the server to the portmapper.
 func (server *server) registerToPortmapper(prot PortmapperProtocol, port int) error {
 	// Check if the portmapper server is available, to return a proper high-level error
 	// rather than a generic socket error.
@@ -43,6 +139,16 @@ func (server *server) registerToPortmapper(prot PortmapperProtocol, port int) er
 		return ErrorPortmapperNotFound
 	}
 
+	for _, pv := range server.servedPrograms() {
+		if err := server.registerProgram(pv, prot, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerProgram registers a version of a program to the portmapper.
+func (server *server) registerProgram(pv progVers, prot PortmapperProtocol, port int) error {
 	// First check if there's a mapping already. We do this because Linux rpcbind server (but not OSX)
 	// is smart enough to use this call to also verify whether a registered service
 	// is still alive (listening on that port), and if it doesn't, it returns zero.
@@ -51,13 +157,13 @@ func (server *server) registerToPortmapper(prot PortmapperProtocol, port int) er
 	// this would allow the user to run the application more than one time with different ports,
 	// without getting errors, as the call to PortmapperGet() would effectively deregister the
 	// previous registration automatically.
-	getport, err := PortmapperGet(server.program, server.version, prot)
+	getport, err := PortmapperGet(pv.program, pv.version, prot)
 	switch {
 	case err != nil:
 		return err
 	case getport == 0:
 		// no service found, we need to register again
-		return PortmapperSet(server.program, server.version, prot, uint32(port))
+		return PortmapperSet(pv.program, pv.version, prot, uint32(port))
 	case getport != uint32(port):
 		// found a service with a different port, returns error
 		return ErrorPortmapperServiceExists
@@ -67,62 +173,274 @@ func (server *server) registerToPortmapper(prot PortmapperProtocol, port int) er
 	}
 }
 
-func (s *server) handleRecord(record []byte) (bytes.Buffer, error) {
+// servedPrograms returns the program versions served by the server, including the statistics
+// program (if enabled).
+func (s *server) servedPrograms() []progVers {
+	programs := s.programList()
+	if s.statsProgram != 0 {
+		programs = append(programs, progVers{s.statsProgram, StatsVersion})
+	}
+	return programs
+}
+
+// announce is like registerToPortmapper, but it also takes over registrations left behind
+// by servers that are not running anymore (e.g. after a crash). The registrations are removed
+// on Shutdown, and they are kept in sync with the programs registered and unregistered while
+// the server is running.
+func (s *server) announce(prot PortmapperProtocol, port int) error {
+	if !PortmapperAvailable() {
+		return ErrorPortmapperNotFound
+	}
+
+	s.mu.Lock()
+	s.announced = true
+	s.prot = prot
+	s.port = port
+	s.registered = make(map[progVers]bool)
+	s.mu.Unlock()
+
+	for _, pv := range s.servedPrograms() {
+		if err := s.announceProgram(pv); err != nil {
+			s.unannounce()
+			return err
+		}
+	}
+	return nil
+}
+
+// announceProgram registers a version of a program on behalf of announce.
+func (s *server) announceProgram(pv progVers) error {
+	s.mu.Lock()
+	prot, port := s.prot, s.port
+	s.mu.Unlock()
+
+	err := s.registerProgram(pv, prot, port)
+	if err == ErrorPortmapperServiceExists {
+		getport, gerr := PortmapperGet(pv.program, pv.version, prot)
+		if gerr != nil {
+			return gerr
+		}
+		if s.serviceAlive(pv, prot, getport) {
+			return err
+		}
+
+		s.log.WithFields(logrus.Fields{
+			"prog": strconv.Itoa(int(pv.program)),
+			"vers": strconv.Itoa(int(pv.version)),
+			"port": getport,
+		}).Info("Replacing stale rpcbind registration")
+		if err := portmapperUnsetProtocol(pv.program, pv.version, prot); err != nil {
+			return err
+		}
+		err = PortmapperSet(pv.program, pv.version, prot, uint32(port))
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.registered != nil {
+		s.registered[pv] = true
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// syncAnnounce updates the registrations done by announce, after a program version was
+// registered (served) or unregistered.
+func (s *server) syncAnnounce(pv progVers, served bool) {
+	s.mu.Lock()
+	announced, registered, prot := s.announced, s.registered[pv], s.prot
+	s.mu.Unlock()
+
+	var err error
+	switch {
+	case !announced:
+		return
+	case served && !registered:
+		err = s.announceProgram(pv)
+	case !served && registered:
+		s.mu.Lock()
+		delete(s.registered, pv)
+		s.mu.Unlock()
+		err = portmapperUnsetProtocol(pv.program, pv.version, prot)
+	}
+
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"prog": strconv.Itoa(int(pv.program)),
+			"vers": strconv.Itoa(int(pv.version)),
+			"err":  err,
+		}).Error("Cannot update rpcbind registration")
+	}
+}
+
+// release frees the resources of a server which has been shut down, and removes the
+// registrations done by announce, if any.
+func (s *server) release() error {
+	s.cancelCalls()
+	if s.pool != nil {
+		s.pool.stop()
+	}
+	for _, l := range s.limiters {
+		if l.pool != nil {
+			l.pool.stop()
+		}
+	}
+	return s.unannounce()
+}
+
+// unannounce removes the registrations done by announce, if any.
+func (s *server) unannounce() error {
+	s.mu.Lock()
+	registered, prot := s.registered, s.prot
+	s.announced = false
+	s.registered = nil
+	s.mu.Unlock()
 
-	var reply bytes.Buffer
+	var err error
+	for pv := range registered {
+		if uerr := portmapperUnsetProtocol(pv.program, pv.version, prot); err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// serviceAlive checks whether a program is being served on the specified local port.
+func (s *server) serviceAlive(pv progVers, prot PortmapperProtocol, port uint32) bool {
+	transport := ClientTransportTcpOnly
+	if prot == Udp {
+		transport = ClientTransportUdpOnly
+	}
+
+	c := NewClient("127.0.0.1:"+strconv.Itoa(int(port)), pv.program, pv.version, &ClientConfig{
+		Transport: transport,
+		Timeout:   time.Second,
+	})
+	defer c.Close()
+
+	return c.Call(0, nil, nil) == nil
+}
+
+func (s *server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *server) handleRecord(record []byte, info CallInfo) (reply bytes.Buffer, err error) {
 	r := bytes.NewReader(record)
 
-	call, err := ReadProcedureCall(r)
+	call, err := readCallHeader(r)
 	if err != nil {
 		s.log.WithField("err", err).Error("Cannot read RPC Call message")
 		return reply, err
 	}
 
-	if call.Body.Program != s.program {
-		s.log.WithFields(logrus.Fields{
-			"expected": s.program,
-			"was":      call.Body.Program,
-		}).Error("Mismatched program number")
+	// We only speak version 2 of the RPC protocol
+	if call.Body.RPCVersion != 2 {
+		s.log.WithField("was", call.Body.RPCVersion).Error("Mismatched RPC version")
 
-		err := s.WriteReplyMessage(&reply, call.Header.Xid, ProgUnavail, nil)
+		err := s.WriteReplyMessageRejectedRpcMismatch(&reply, call.Header.Xid, 2, 2)
 		return reply, err
 	}
 
-	if call.Body.Version != s.version {
-		s.log.WithFields(logrus.Fields{
-			"expected": s.version,
-			"was":      call.Body.Version,
-		}).Error("Mismatched program version")
+	info.Xid = call.Header.Xid
+	info.Program = call.Body.Program
+	info.Version = call.Body.Version
+	info.Procedure = call.Body.Procedure
 
-		ret := ProgMismatchReply{
-			Low:  uint(s.version),
-			High: uint(s.version),
-		}
-		err := s.WriteReplyMessage(&reply, call.Header.Xid, ProgMismatch, &ret)
+	success := false
+	if s.audit != nil {
+		start := time.Now()
+		defer func() {
+			s.audit.Audit(&AuditRecord{
+				Time:      start,
+				Duration:  time.Since(start),
+				Remote:    info.Remote,
+				Transport: addrNetwork(info.Remote),
+				Xid:       info.Xid,
+				Program:   info.Program,
+				Version:   info.Version,
+				Procedure: info.Procedure,
+				Cred:      info.Cred,
+				Identity:  info.Identity,
+				Err:       replyResult(reply.Bytes(), success, err),
+				CallSize:  len(record),
+				ReplySize: reply.Len(),
+			})
+		}()
+	}
+
+	parent := s.baseCtx
+	if s.tracer != nil {
+		var end func(err error)
+		parent, end = s.tracer(parent, &TraceInfo{
+			Server:    true,
+			Program:   info.Program,
+			Version:   info.Version,
+			Procedure: info.Procedure,
+			Xid:       info.Xid,
+			Transport: addrNetwork(info.Remote),
+			Peer:      info.Remote,
+		})
+		defer func() {
+			end(replyResult(reply.Bytes(), success, err))
+		}()
+	}
+
+	if allowed, err := s.checkAccess(&reply, call, &info); !allowed {
 		return reply, err
 	}
 
-	// Handle authentication (if the user requested so)
-	if s.authFun != nil {
-		auth, err := call.Body.Cred.Decode()
-		if err != nil {
-			s.log.WithField("err", err).Error("cannot decode authentication")
-			err := s.WriteReplyMessageRejectedAuth(&reply, call.Header.Xid, AuthBadCred)
+	if s.statsProgram != 0 && call.Body.Program == s.statsProgram {
+		err := s.handleStatsCall(&reply, call)
+		return reply, err
+	}
+
+	defer func() {
+		key := procKey{progVers{call.Body.Program, call.Body.Version}, call.Body.Procedure}
+		_, registered := s.programs.load()[key.progVers]
+		s.stats.record(key, registered, success)
+	}()
+
+	programs := s.programs.load()
+	procs, found := programs[progVers{call.Body.Program, call.Body.Version}]
+	if !found {
+		low, high, found := programs.versions(call.Body.Program)
+		if !found {
+			s.log.WithField("was", call.Body.Program).Error("Unsupported program number")
+
+			err := s.WriteReplyMessage(&reply, call.Header.Xid, ProgUnavail, nil)
 			return reply, err
 		}
 
-		if !s.authFun(call.Body.Procedure, auth) {
-			s.log.WithFields(logrus.Fields{
-				"proc": strconv.Itoa(int(call.Body.Procedure)),
-				"prog": strconv.Itoa(int(call.Body.Program)),
-			}).Info("authentication rejected by user")
-			err := s.WriteReplyMessageRejectedAuth(&reply, call.Header.Xid, AuthBadCred)
-			return reply, err
+		s.log.WithFields(logrus.Fields{
+			"prog": call.Body.Program,
+			"was":  call.Body.Version,
+		}).Error("Unsupported program version")
+
+		ret := MismatchInfo{
+			Low:  low,
+			High: high,
 		}
+		err := s.WriteReplyMessage(&reply, call.Header.Xid, ProgMismatch, &ret)
+		return reply, err
+	}
+
+	verf, authenticated, err := s.authenticate(&reply, call, &info)
+	if !authenticated {
+		return reply, err
+	}
+
+	if cred, ok := info.Cred.(AuthUnix); ok && s.squash != nil {
+		id := s.squash.Apply(cred)
+		info.Identity = &id
 	}
 
 	// Resolve function type from function table
-	receiverFunc, found := s.procedures[call.Body.Procedure]
+	receiverFunc, found := procs.procedures[call.Body.Procedure]
 	if !found {
 		s.log.WithFields(logrus.Fields{
 			"proc": strconv.Itoa(int(call.Body.Procedure)),
@@ -135,15 +453,199 @@ func (s *server) handleRecord(record []byte) (bytes.Buffer, error) {
 
 	s.log.WithFields(logrus.Fields{
 		"proc": strconv.Itoa(int(call.Body.Procedure)),
-		"name": s.procnames[call.Body.Procedure],
-	}).Debug("RPC ", s.procnames[call.Body.Procedure])
+		"name": procs.names[call.Body.Procedure],
+	}).Debug("RPC ", procs.names[call.Body.Procedure])
+	key := procKey{progVers{call.Body.Program, call.Body.Version}, call.Body.Procedure}
+	if max, found := s.maxArgSizes[key]; found && r.Len() > max {
+		s.log.WithFields(logrus.Fields{
+			"proc": strconv.Itoa(int(call.Body.Procedure)),
+			"size": r.Len(),
+		}).Info("Procedure arguments too large")
+
+		err := s.WriteReplyMessage(&reply, call.Header.Xid, GarbageArgs, nil)
+		return reply, err
+	}
+
+	// Procedures streaming their results write them after the reply header
+	var stream *ReplyStream
+	if isStreamingProcedure(receiverFunc) {
+		stream = &ReplyStream{flush: info.fragment, flushFrom: info.fragmentFrom}
+		if err := writeAcceptedReply(&stream.buf, call.Header.Xid, verf, Success, nil); err != nil {
+			return reply, err
+		}
+	}
+
+	ctx, cancel := s.callContext(parent)
+	defer cancel()
+
 	acceptType := Success
-	ret, err := s.callFunc(r, receiverFunc)
-	if err != nil {
+	ret, err := s.callFunc(context.WithValue(ctx, callInfoKey{}, &info), r, receiverFunc, stream)
+	if _, garbage := err.(*ErrGarbageArgs); garbage {
+		s.log.WithField("proc", strconv.Itoa(int(call.Body.Procedure))).Info("Cannot decode procedure arguments")
+		acceptType = GarbageArgs
+	} else if aerr, ok := err.(AcceptError); ok && aerr.AcceptStat() > Success && aerr.AcceptStat() <= SystemErr {
+		s.log.WithFields(logrus.Fields{
+			"proc": strconv.Itoa(int(call.Body.Procedure)),
+			"err":  err,
+		}).Info("Procedure failed with RPC error")
+		acceptType = aerr.AcceptStat()
+		ret = nil
+		if acceptType == ProgMismatch {
+			ret = mismatchInfo(err, programs, call.Body.Program)
+		}
+	} else if err != nil {
 		s.log.WithField("err", err).Error("Unable to perform procedure call")
 		acceptType = SystemErr
 	}
 
-	err = s.WriteReplyMessage(&reply, call.Header.Xid, acceptType, ret)
-	return reply, err
+	if stream != nil {
+		switch {
+		case acceptType == Success:
+			success = stream.err == nil
+			return stream.buf, stream.err
+		case stream.sent:
+			return reply, errReplyStreamAborted
+		}
+	}
+
+	if hint := s.replyHints[key]; hint > 0 && acceptType == Success {
+		reply.Grow(replyHeaderSize + len(verf.Body) + hint)
+	}
+
+	err = writeAcceptedReply(&reply, call.Header.Xid, verf, acceptType, ret)
+	if err != nil {
+		s.log.WithField("err", err).Error("Cannot encode procedure results")
+		reply.Reset()
+		return reply, writeAcceptedReply(&reply, call.Header.Xid, verf, SystemErr, nil)
+	}
+	success = acceptType == Success
+	return reply, nil
+}
+
+// checkAccess applies the access control function and the authentication policies to a call.
+// If the call is not allowed, the rejection (if any) is written to reply.
+func (s *server) checkAccess(reply *bytes.Buffer, call *ProcedureCall, info *CallInfo) (bool, error) {
+	// Check whether the caller is allowed to perform this call
+	if s.acl != nil && !s.acl(info.Remote, call.Body.Program, call.Body.Version, call.Body.Procedure) {
+		s.log.WithFields(logrus.Fields{
+			"remote": addrString(info.Remote),
+			"prog":   strconv.Itoa(int(call.Body.Program)),
+			"proc":   strconv.Itoa(int(call.Body.Procedure)),
+		}).Info("Call rejected by access control")
+
+		if s.aclDeny == AccessDenyDrop {
+			return false, nil
+		}
+		err := s.WriteReplyMessageRejectedAuth(reply, call.Header.Xid, AuthTooWeak)
+		return false, err
+	}
+
+	// Check that the caller authenticated with an acceptable flavor
+	if policy := s.authPolicies[call.Body.Program]; policy != nil && !policy.allows(call.Body.Procedure, call.Body.Cred.Flavor) {
+		s.log.WithFields(logrus.Fields{
+			"flavor": call.Body.Cred.Flavor,
+			"prog":   strconv.Itoa(int(call.Body.Program)),
+			"proc":   strconv.Itoa(int(call.Body.Procedure)),
+		}).Info("Authentication flavor rejected by policy")
+
+		err := s.WriteReplyMessageRejectedAuth(reply, call.Header.Xid, AuthTooWeak)
+		return false, err
+	}
+	return true, nil
+}
+
+// authenticate checks the credential of a call (if the user requested so), storing it into
+// info, and returns the verifier of the reply. If the call is not authenticated, the
+// rejection is written to reply.
+func (s *server) authenticate(reply *bytes.Buffer, call *ProcedureCall, info *CallInfo) (verf OpaqueAuth, ok bool, err error) {
+	if s.authFun != nil || len(s.authFuns) > 0 || s.authenticator != nil || s.shortCache != nil || s.authDH != nil {
+		cred := call.Body.Cred
+
+		// Resolve AUTH_SHORT credentials into the full credential they stand for
+		if cred.Flavor == AuthFlavorShort {
+			full, found := OpaqueAuth{}, false
+			if s.shortCache != nil {
+				full, found = s.shortCache.Get(cred.Body)
+			}
+			if !found {
+				s.log.Debug("unknown or stale AUTH_SHORT credential")
+				err := s.WriteReplyMessageRejectedAuth(reply, call.Header.Xid, AuthRejectedCred)
+				return verf, false, err
+			}
+			cred = full
+		}
+
+		if cred.Flavor == AuthFlavorDes && s.authDH != nil {
+			var stat AuthStat
+			if info.Cred, verf, stat = s.authDH.verify(cred, call.Body.Verf); stat != AuthOk {
+				s.log.WithField("stat", stat).Info("AUTH_DH credential rejected")
+				err := s.WriteReplyMessageRejectedAuth(reply, call.Header.Xid, stat)
+				return verf, false, err
+			}
+		} else if info.Cred, err = cred.Decode(); err != nil {
+			s.log.WithField("err", err).Error("cannot decode authentication")
+			err := s.WriteReplyMessageRejectedAuth(reply, call.Header.Xid, AuthBadCred)
+			return verf, false, err
+		}
+
+		if s.authenticator != nil {
+			auth, err := s.authenticator(info)
+			if err != nil {
+				s.log.WithFields(logrus.Fields{
+					"remote": addrString(info.Remote),
+					"err":    err,
+				}).Info("authentication rejected by authenticator")
+				err := s.WriteReplyMessageRejectedAuth(reply, call.Header.Xid, AuthBadCred)
+				return verf, false, err
+			}
+			if auth != nil {
+				info.Cred = auth
+			}
+		}
+
+		authFun, found := s.authFuns[progVers{call.Body.Program, call.Body.Version}]
+		if !found {
+			authFun = s.authFun
+		}
+		if authFun != nil && !authFun(call.Body.Procedure, info.Cred) {
+			s.log.WithFields(logrus.Fields{
+				"proc": strconv.Itoa(int(call.Body.Procedure)),
+				"prog": strconv.Itoa(int(call.Body.Program)),
+			}).Info("authentication rejected by user")
+			err := s.WriteReplyMessageRejectedAuth(reply, call.Header.Xid, AuthBadCred)
+			return verf, false, err
+		}
+
+		// Issue an AUTH_SHORT handle only once the full credential was accepted
+		if call.Body.Cred.Flavor == AuthFlavorUnix && s.shortCache != nil {
+			if handle, err := s.shortCache.Put(call.Body.Cred); err != nil {
+				s.log.WithField("err", err).Warn("Cannot issue AUTH_SHORT handle")
+			} else {
+				verf = OpaqueAuth{Flavor: AuthFlavorShort, Body: handle}
+			}
+		}
+	} else {
+		// Nobody is checking credentials: decode them for the procedures, if possible
+		info.Cred, _ = call.Body.Cred.Decode()
+	}
+	return verf, true, nil
+}
+
+// mismatchInfo returns the range of versions replied in PROG_MISMATCH replies caused by err.
+func mismatchInfo(err error, programs programTable, program uint32) *MismatchInfo {
+	switch e := err.(type) {
+	case *ErrProgMismatch:
+		return &MismatchInfo{Low: e.Low, High: e.High}
+	case *RPCAcceptError:
+		return &MismatchInfo{Low: e.Low, High: e.High}
+	}
+	low, high, _ := programs.versions(program)
+	return &MismatchInfo{Low: low, High: high}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
 }
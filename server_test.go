@@ -0,0 +1,433 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRecordRpcMismatch(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+
+	call := []byte{
+		0x54, 0x88, 0x7d, 0x26, // Xid
+		0x00, 0x00, 0x00, 0x00, // Call
+		0x00, 0x00, 0x00, 0x03, // RPC version 3
+		0x00, 0x01, 0x86, 0xa0, // Program
+		0x00, 0x00, 0x00, 0x02, // Version
+		0x00, 0x00, 0x00, 0x00, // Procedure
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Cred
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+	}
+
+	expected := []byte{
+		0x54, 0x88, 0x7d, 0x26, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x01, // Denied
+		0x00, 0x00, 0x00, 0x00, // RpcMismatch
+		0x00, 0x00, 0x00, 0x02, // Low
+		0x00, 0x00, 0x00, 0x02, // High
+	}
+
+	reply, err := s.handleRecord(call, CallInfo{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reply.Bytes())
+}
+
+func TestHandleTCPRecordRpcMismatch(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+
+	frame := bytes.NewBuffer([]byte{
+		0x80, 0x00, 0x00, 0x28 /**/, 0x00, 0x00, 0x00, 0x2a,
+		0x00, 0x00, 0x00, 0x00 /**/, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x01, 0x86, 0xa0 /**/, 0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x00 /**/, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00 /**/, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	})
+
+	expected := []byte{
+		0x80, 0x00, 0x00, 0x18 /**/, 0x00, 0x00, 0x00, 0x2a,
+		0x00, 0x00, 0x00, 0x01 /**/, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x00 /**/, 0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x02,
+	}
+
+	record, err := ReadRecord(frame)
+	assert.Nil(t, err)
+
+	reply, err := s.handleRecord(record.Bytes(), CallInfo{})
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	assert.Nil(t, WriteTCPReplyMessage(&out, reply.Bytes()))
+	assert.Equal(t, expected, out.Bytes())
+}
+
+func TestHandleRecordCallInfo(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+
+	var info *CallInfo
+	s.Register(3, func(ctx context.Context, arg uint32, reply *uint32) error {
+		info = CallInfoFromContext(ctx)
+		*reply = arg + 1
+		return nil
+	})
+	s.SetAuthenticator(func(info *CallInfo) (interface{}, error) {
+		return "mapped", nil
+	})
+
+	call := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x00, // Call
+		0x00, 0x00, 0x00, 0x02, // RPC version 2
+		0x00, 0x01, 0x86, 0xa0, // Program
+		0x00, 0x00, 0x00, 0x02, // Version
+		0x00, 0x00, 0x00, 0x03, // Procedure
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Cred
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x07, // Argument
+	}
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x00, // Accepted
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x00, // Success
+		0x00, 0x00, 0x00, 0x08, // Result
+	}
+
+	reply, err := s.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reply.Bytes())
+
+	if assert.NotNil(t, info) {
+		assert.Equal(t, uint32(0x2a), info.Xid)
+		assert.Equal(t, uint32(3), info.Procedure)
+		assert.Equal(t, "mapped", info.Cred)
+	}
+}
+
+func TestHandleRecordGarbageArgs(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+	s.Register(3, func(arg []byte, reply *uint32) error {
+		*reply = uint32(len(arg))
+		return nil
+	})
+	s.Register(4, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	s.SetMaxArgSize(4, 2)
+
+	header := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x00, // Call
+		0x00, 0x00, 0x00, 0x02, // RPC version 2
+		0x00, 0x01, 0x86, 0xa0, // Program
+		0x00, 0x00, 0x00, 0x02, // Version
+		0x00, 0x00, 0x00, 0x03, // Procedure
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Cred
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+	}
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x00, // Accepted
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x04, // GarbageArgs
+	}
+
+	// Opaque data claiming to be 2GB long
+	call := append(append([]byte{}, header...), 0x7f, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00)
+	reply, err := s.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reply.Bytes())
+
+	// Arguments larger than the configured limit
+	call = append(append([]byte{}, header...), 0x00, 0x00, 0x00, 0x07)
+	call[23] = 0x04
+	reply, err = s.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reply.Bytes())
+}
+
+func TestHandleRecordForgedCredentials(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+	s.Register(3, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+
+	header := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x00, // Call
+		0x00, 0x00, 0x00, 0x02, // RPC version 2
+		0x00, 0x01, 0x86, 0xa0, // Program
+		0x00, 0x00, 0x00, 0x02, // Version
+		0x00, 0x00, 0x00, 0x03, // Procedure
+	}
+
+	// Credential claiming to be 2GB long: the call is dropped
+	call := append(append([]byte{}, header...),
+		0x00, 0x00, 0x00, 0x01, 0x7f, 0xff, 0xff, 0xff, // Cred
+		0x00, 0x00, 0x00, 0x00)
+	reply, err := s.handleRecord(call, CallInfo{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, reply.Len())
+
+	// Credential larger than the RFC 5531 limit, even if the record holds it
+	call = append(append([]byte{}, header...), 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x94)
+	call = append(call, make([]byte, 404+8+4)...)
+	reply, err = s.handleRecord(call, CallInfo{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, reply.Len())
+
+	// AUTH_UNIX credential with too many groups
+	s.SetAuth(func(proc uint32, cred interface{}) bool { return true })
+	cred := []byte{
+		0x00, 0x00, 0x00, 0x00, // Stamp
+		0x00, 0x00, 0x00, 0x00, // Machine name
+		0x00, 0x00, 0x00, 0x00, // Uid
+		0x00, 0x00, 0x00, 0x00, // Gid
+		0x00, 0x00, 0x00, 0x11, // 17 gids
+	}
+	cred = append(cred, make([]byte, 17*4)...)
+	call = append(append([]byte{}, header...), 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, byte(len(cred)))
+	call = append(append(call, cred...), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	call = append(call, 0x00, 0x00, 0x00, 0x07)
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x01, // Denied
+		0x00, 0x00, 0x00, 0x01, // AuthError
+		0x00, 0x00, 0x00, 0x01, // AuthBadCred
+	}
+	reply, err = s.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reply.Bytes())
+}
+
+func TestHandleRecordUnmarshalableResults(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+	s.Register(3, func(arg uint32, reply *chan int) error {
+		return nil
+	})
+
+	call := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x00, // Call
+		0x00, 0x00, 0x00, 0x02, // RPC version 2
+		0x00, 0x01, 0x86, 0xa0, // Program
+		0x00, 0x00, 0x00, 0x02, // Version
+		0x00, 0x00, 0x00, 0x03, // Procedure
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Cred
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x07, // Argument
+	}
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x00, // Accepted
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x05, // SystemErr
+	}
+
+	reply, err := s.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reply.Bytes())
+
+	// Nothing is left in the buffer when encoding fails
+	var buf bytes.Buffer
+	buf.WriteString("prefix")
+	assert.NotNil(t, writeAcceptedReply(&buf, 42, OpaqueAuth{}, Success, make(chan int)))
+	assert.Equal(t, "prefix", buf.String())
+}
+
+func TestHandleRecordCallTimeout(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+	s.SetCallTimeout(10 * time.Millisecond)
+
+	release := make(chan struct{})
+	defer close(release)
+	s.Register(3, func(ctx context.Context, arg uint32, reply *uint32) error {
+		<-release // ignores ctx
+		return nil
+	})
+
+	call := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x00, // Call
+		0x00, 0x00, 0x00, 0x02, // RPC version 2
+		0x00, 0x01, 0x86, 0xa0, // Program
+		0x00, 0x00, 0x00, 0x02, // Version
+		0x00, 0x00, 0x00, 0x03, // Procedure
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Cred
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x01, // Argument
+	}
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x00, // Accepted
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+		0x00, 0x00, 0x00, 0x05, // SystemErr
+	}
+
+	reply, err := s.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reply.Bytes())
+}
+
+func TestHandleRecordAcceptError(t *testing.T) {
+	s := newServer(PortmapperProgram, PortmapperVersion, nil)
+	s.Register(3, func(arg uint32, reply *uint32) error {
+		switch arg {
+		case 1:
+			return &ErrProcUnavail{}
+		case 2:
+			return &ErrProgMismatch{Low: 2, High: 4}
+		default:
+			return &RPCAcceptError{Stat: GarbageArgs}
+		}
+	})
+
+	call := func(arg byte) []byte {
+		return []byte{
+			0x00, 0x00, 0x00, 0x2a, // Xid
+			0x00, 0x00, 0x00, 0x00, // Call
+			0x00, 0x00, 0x00, 0x02, // RPC version 2
+			0x00, 0x01, 0x86, 0xa0, // Program
+			0x00, 0x00, 0x00, 0x02, // Version
+			0x00, 0x00, 0x00, 0x03, // Procedure
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Cred
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+			0x00, 0x00, 0x00, arg, // Argument
+		}
+	}
+
+	header := []byte{
+		0x00, 0x00, 0x00, 0x2a, // Xid
+		0x00, 0x00, 0x00, 0x01, // Reply
+		0x00, 0x00, 0x00, 0x00, // Accepted
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Verf
+	}
+
+	for _, tc := range []struct {
+		arg      byte
+		expected []byte
+	}{
+		{1, []byte{0x00, 0x00, 0x00, 0x03}}, // ProcUnavail
+		{2, []byte{
+			0x00, 0x00, 0x00, 0x02, // ProgMismatch
+			0x00, 0x00, 0x00, 0x02, // Low
+			0x00, 0x00, 0x00, 0x04, // High
+		}},
+		{3, []byte{0x00, 0x00, 0x00, 0x04}}, // GarbageArgs
+	} {
+		reply, err := s.handleRecord(call(tc.arg), CallInfo{})
+		assert.Nil(t, err)
+		assert.Equal(t, append(append([]byte{}, header...), tc.expected...), reply.Bytes())
+	}
+}
+
+// addCall returns a call to procedure 1 of program 0x20000001, adding a and b.
+func addCall(a, b uint32) []byte {
+	var call bytes.Buffer
+	xdr.Marshal(&call, NewProcedureCall(0x20000001, 1, 1))
+	xdr.Marshal(&call, &struct{ A, B uint32 }{a, b})
+	return call.Bytes()
+}
+
+func addReflect(args struct{ A, B uint32 }, reply *uint32) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func addDispatcher(ctx context.Context, args *xdr.Decoder, results *xdr.Encoder) error {
+	a, _, err := args.DecodeUint()
+	if err != nil {
+		return err
+	}
+	b, _, err := args.DecodeUint()
+	if err != nil {
+		return err
+	}
+	_, err = results.EncodeUint(a + b)
+	return err
+}
+
+func TestHandleRecordDispatcher(t *testing.T) {
+	reflected := newServer(0x20000001, 1, nil)
+	reflected.Register(1, addReflect)
+	dispatched := newServer(0x20000001, 1, nil)
+	dispatched.RegisterDispatcher(1, addDispatcher)
+
+	call := addCall(1, 2)
+	expected, err := reflected.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	reply, err := dispatched.handleRecord(call, CallInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Bytes(), reply.Bytes())
+
+	// Truncated arguments
+	reply, err = dispatched.handleRecord(call[:len(call)-4], CallInfo{})
+	assert.Nil(t, err)
+	if r, _, err := DecodeReplyBody(reply.Bytes()); assert.Nil(t, err) {
+		assert.Equal(t, AcceptType(GarbageArgs), r.Accepted.Stat)
+	}
+
+	// Dispatchers must remain cheaper than reflection
+	allocs := func(s *server) float64 {
+		return testing.AllocsPerRun(100, func() {
+			s.handleRecord(call, CallInfo{})
+		})
+	}
+	reflectAllocs, dispatchAllocs := allocs(&reflected), allocs(&dispatched)
+	assert.True(t, dispatchAllocs < reflectAllocs, "%v allocations, %v with reflection", dispatchAllocs, reflectAllocs)
+
+	// Without a call timeout, a Dispatcher runs inline, decoding straight from the record: the
+	// only allocations are the decoder, the encoder and the results
+	noop := Dispatcher(func(ctx context.Context, args *xdr.Decoder, results *xdr.Encoder) error {
+		return nil
+	})
+	args := bytes.NewReader(nil)
+	callAllocs := testing.AllocsPerRun(100, func() {
+		args.Reset(call)
+		dispatched.callDispatcher(context.Background(), args, noop)
+	})
+	assert.True(t, callAllocs <= 3, "%v allocations to call a dispatcher", callAllocs)
+}
+
+func BenchmarkHandleRecordReflect(b *testing.B) {
+	s := newServer(0x20000001, 1, nil)
+	s.Register(1, addReflect)
+	benchmarkHandleRecord(b, &s)
+}
+
+func BenchmarkHandleRecordDispatcher(b *testing.B) {
+	s := newServer(0x20000001, 1, nil)
+	s.RegisterDispatcher(1, addDispatcher)
+	benchmarkHandleRecord(b, &s)
+}
+
+func benchmarkHandleRecord(b *testing.B, s *server) {
+	call := addCall(1, 2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.handleRecord(call, CallInfo{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
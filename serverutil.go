@@ -2,28 +2,60 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"reflect"
 
 	"github.com/rasky/go-xdr/xdr2"
 )
 
+// Server is implemented by TCPServer and UDPServer. Their constructors return the concrete
+// types, which hold the other registration methods and the settings.
 type Server interface {
 	Register(proc uint32, rcvr interface{})
 	RegisterWithName(proc uint32, rcvr interface{}, name string)
 	SetAuth(authFun func(proc uint32, cred interface{}) bool)
 	Serve(string) error
+
+	// Shutdown stops the server, closing the listening socket and all client connections,
+	// and removes the registration performed by RegisterAndAnnounce.
+	Shutdown(ctx context.Context) error
 }
 
 // ReadProcedureCall reads an RPC "call" message from the given reader, ensuring the RPC message is
 // of the "call" type and specifies version '2' of the RPC protocol.
 func ReadProcedureCall(r io.Reader) (*ProcedureCall, error) {
+	message, err := readCallHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// We can only read RPCv2 messages
+	if message.Body.RPCVersion != 2 {
+		return nil, errors.New("Expected an RPC version 2 message")
+	}
+
+	return message, nil
+}
+
+// readCallHeader is like ReadProcedureCall, but doesn't check the RPC version.
+func readCallHeader(r io.Reader) (*ProcedureCall, error) {
 	// Read RPC message header
 	message := ProcedureCall{}
 
-	if _, err := xdr.Unmarshal(r, &message); err != nil {
-		return nil, errors.New("")
+	// The only variable-length items are the credential and verifier, which cannot exceed
+	// maxOpaqueAuthSize: bound them (and by the size of the record, when known) before
+	// allocating memory for them
+	limit := uint(maxOpaqueAuthSize)
+	if br, ok := r.(*bytes.Reader); ok && uint(br.Len()) < limit {
+		limit = uint(br.Len())
+	}
+	if _, err := xdr.NewDecoderLimited(r, limit).Decode(&message); err != nil {
+		return nil, fmt.Errorf("cannot decode RPC call header: %v", err)
 	}
 
 	// Make sure this is a "Call" message
@@ -31,18 +63,80 @@ func ReadProcedureCall(r io.Reader) (*ProcedureCall, error) {
 		return nil, errors.New("Expected a call message")
 	}
 
-	// We can only read RPCv2 messages
-	if message.Body.RPCVersion != 2 {
-		return nil, errors.New("Expected an RPC version 2 message")
+	return &message, nil
+}
+
+// ReadCallMessage reads a whole RPC call from r, and decodes its header (after checking it
+// with ReadProcedureCall). The returned reader is positioned at the procedure arguments.
+//
+// If r is a UDP socket, a single datagram is read; otherwise, r is assumed to be a stream
+// transport and a whole record is read. This allows to build custom dispatchers on top of
+// the package. To also get the address of the caller on unconnected UDP sockets, use
+// ReadCallMessageFrom.
+func ReadCallMessage(r io.Reader) (*ProcedureCall, *bytes.Reader, error) {
+	var record []byte
+
+	if conn, ok := r.(*net.UDPConn); ok {
+		buf := make([]byte, MaxUdpSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		record = buf[:n]
+	} else {
+		buf, err := ReadRecord(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		record = buf.Bytes()
 	}
 
-	return &message, nil
+	return decodeCallMessage(record)
+}
+
+// ReadCallMessageFrom is like ReadCallMessage for datagram transports: it reads a single
+// datagram from conn, and also returns the address of the caller.
+func ReadCallMessageFrom(conn net.PacketConn) (*ProcedureCall, *bytes.Reader, net.Addr, error) {
+	buf := make([]byte, MaxUdpSize)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	call, args, err := decodeCallMessage(buf[:n])
+	return call, args, addr, err
+}
+
+func decodeCallMessage(record []byte) (*ProcedureCall, *bytes.Reader, error) {
+	r := bytes.NewReader(record)
+	call, err := ReadProcedureCall(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return call, r, nil
 }
 
 // WriteReplyMessage writes an "Accepted" RPC reply of type "Success", indicating that the procedure
 // call was successful. The given return data is written right after the RPC response header.
 func (s *server) WriteReplyMessage(w io.Writer, xid uint32, acceptType AcceptType, ret interface{}) error {
-	var buf bytes.Buffer
+	return writeAcceptedReply(w, xid, OpaqueAuth{}, acceptType, ret)
+}
+
+// writeAcceptedReply is like WriteReplyMessage, but also sends the specified verifier to the client.
+// When w is a bytes.Buffer, the reply is encoded directly into it; if encoding fails, the
+// buffer is left as it was.
+func writeAcceptedReply(w io.Writer, xid uint32, verf OpaqueAuth, acceptType AcceptType, ret interface{}) (err error) {
+	buf, direct := w.(*bytes.Buffer)
+	if !direct {
+		buf = new(bytes.Buffer)
+	} else {
+		start := buf.Len()
+		defer func() {
+			if err != nil {
+				buf.Truncate(start)
+			}
+		}()
+	}
 
 	// Header
 	header := Message{
@@ -50,32 +144,49 @@ func (s *server) WriteReplyMessage(w io.Writer, xid uint32, acceptType AcceptTyp
 		Type: Reply,
 	}
 
-	if _, err := xdr.Marshal(&buf, header); err != nil {
+	if _, err := xdr.Marshal(buf, header); err != nil {
 		return err
 	}
 
 	// "Accepted"
-	if _, err := xdr.Marshal(&buf, ReplyBody{Type: Accepted}); err != nil {
+	if _, err := xdr.Marshal(buf, ReplyBody{Type: Accepted}); err != nil {
 		return err
 	}
 
 	// "Success"
-	if _, err := xdr.Marshal(&buf, AcceptedReply{Type: acceptType}); err != nil {
+	if _, err := xdr.Marshal(buf, AcceptedReply{Verf: verf, Type: acceptType}); err != nil {
 		return err
 	}
 
 	// Return data
-	if ret != nil {
-		if _, err := xdr.Marshal(&buf, ret); err != nil {
+	if raw, ok := ret.(rawMessage); ok {
+		buf.Write(raw)
+	} else if ret != nil {
+		if _, err := xdr.Marshal(buf, ret); err != nil {
 			return err
 		}
 	}
 
-	_, err := w.Write(buf.Bytes())
+	if direct {
+		return nil
+	}
+	_, err = w.Write(buf.Bytes())
 	return err
 }
 
 func (s *server) WriteReplyMessageRejectedAuth(w io.Writer, xid uint32, auth AuthStat) error {
+	return writeRejectedReply(w, xid, AuthError, &auth)
+}
+
+// WriteReplyMessageRejectedRpcMismatch writes a "Denied" RPC reply, telling the client that the
+// version of the RPC protocol it used is not supported, and which ones are.
+func (s *server) WriteReplyMessageRejectedRpcMismatch(w io.Writer, xid uint32, low, high uint32) error {
+	info := struct{ Low, High uint32 }{low, high}
+	return writeRejectedReply(w, xid, RpcMismatch, &info)
+}
+
+// writeRejectedReply writes a "Denied" RPC reply, followed by the data associated with the reason.
+func writeRejectedReply(w io.Writer, xid uint32, stat RejectStat, data interface{}) error {
 	var buf bytes.Buffer
 
 	// Header
@@ -93,45 +204,87 @@ func (s *server) WriteReplyMessageRejectedAuth(w io.Writer, xid uint32, auth Aut
 		return err
 	}
 
-	// "AuthError"
-	if _, err := xdr.Marshal(&buf, RejectedReply{Stat: AuthError}); err != nil {
+	if _, err := xdr.Marshal(&buf, RejectedReply{Stat: stat}); err != nil {
 		return err
 	}
 
-	if _, err := xdr.Marshal(&buf, &auth); err != nil {
+	if _, err := xdr.Marshal(&buf, data); err != nil {
 		return err
 	}
 
-	return nil
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // callFunc Resolves and calls a real Go function given a procedure ID. The method must look
-// schematically like this (but no conformance checks are performed at runtime):
+// schematically like one of these (but no conformance checks are performed at runtime):
 //
 //     func (t *T) MethodName(argType T1, replyType *T2) error
-func (s *server) callFunc(r io.Reader, receiverFunc interface{}) (interface{}, error) {
+//     func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+//
+// In the second form, ctx carries the CallInfo of the call (see CallInfoFromContext). In both
+// forms, replyType can be a *ReplyStream, in which case stream is passed to the function and
+// no results are returned. The function can also be a RawHandler, which is passed the
+// arguments as they were received, or a Dispatcher.
+func (s *server) callFunc(ctx context.Context, r io.Reader, receiverFunc interface{}, stream *ReplyStream) (interface{}, error) {
+	switch f := receiverFunc.(type) {
+	case RawHandler:
+		return s.callRaw(ctx, r, f)
+	case Dispatcher:
+		return s.callDispatcher(ctx, r, f)
+	}
 
 	// Resolve function's type
 	funcType := reflect.TypeOf(receiverFunc)
+	var in []reflect.Value
+	if funcType.NumIn() == 3 {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	argIndex := len(in)
 
 	// Deserialize arguments read from procedure call body
-	funcArg := reflect.New(funcType.In(0)).Interface()
+	funcArg := reflect.New(funcType.In(argIndex)).Interface()
 
-	if _, err := xdr.Unmarshal(r, &funcArg); err != nil {
-		return nil, err
+	// Bound variable-length items by the size of the arguments, so that bogus lengths are
+	// detected before allocating memory for them
+	limit := uint(math.MaxUint32)
+	if br, ok := r.(*bytes.Reader); ok {
+		limit = uint(br.Len())
+	}
+	if _, err := xdr.NewDecoderLimited(r, limit).Decode(&funcArg); err != nil {
+		s.log.WithField("err", err).Debug("Cannot unmarshal arguments")
+		return nil, &ErrGarbageArgs{}
 	}
 
 	// Call function
 	funcValue := reflect.ValueOf(receiverFunc)
 	funcArgValue := reflect.Indirect(reflect.ValueOf(funcArg))
-	funcRetValue := reflect.New(funcType.In(1).Elem())
+	var funcRetValue reflect.Value
+	if stream != nil {
+		funcRetValue = reflect.ValueOf(stream)
+	} else {
+		funcRetValue = reflect.New(funcType.In(argIndex + 1).Elem())
+	}
 
 	s.log.Debugf("-> %+v", funcArgValue)
-	funcRetError := funcValue.Call([]reflect.Value{funcArgValue, funcRetValue})[0]
+
+	_, err := runProcedure(ctx, func() (interface{}, error) {
+		if funcRetError := funcValue.Call(append(in, funcArgValue, funcRetValue))[0]; !funcRetError.IsNil() {
+			return nil, funcRetError.Interface().(error)
+		}
+		return nil, nil
+	}, func() {
+		if stream != nil {
+			stream.abort()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
 	s.log.Debugf("<- %+v", funcRetValue)
 
-	if !funcRetError.IsNil() {
-		return nil, funcRetError.Interface().(error)
+	if stream != nil {
+		return nil, nil
 	}
 
 	// Return result computed by the actual function. This is what should be sent back to the remote
@@ -145,11 +298,16 @@ func (o *OpaqueAuth) Decode() (interface{}, error) {
 		return AuthNone{}, nil
 	case AuthFlavorUnix:
 		auth := AuthUnix{}
-		_, err := xdr.Unmarshal(bytes.NewReader(o.Body), &auth)
+		_, err := xdr.UnmarshalLimited(bytes.NewReader(o.Body), &auth, uint(len(o.Body)))
 		if err != nil {
 			return nil, err
 		}
+		if len(auth.MachineName) > maxAuthUnixMachineName || len(auth.Gids) > maxAuthUnixGids {
+			return nil, errors.New("AUTH_UNIX credential too large")
+		}
 		return auth, nil
+	case AuthFlavorShort:
+		return AuthShort{Handle: o.Body}, nil
 	case AuthFlavorDes:
 		return nil, errors.New("unsupported DES authentication")
 	default:
@@ -157,6 +315,37 @@ func (o *OpaqueAuth) Decode() (interface{}, error) {
 	}
 }
 
+// SetAuth installs a function checking the credentials of the calls, which are rejected with
+// AUTH_BADCRED when it returns false. It is passed the procedure called, and checks the calls
+// to all the programs served, except the program versions which have their own function (see
+// SetProgramAuth). It must be called before the server is started.
 func (s *server) SetAuth(authFun func(uint32, interface{}) bool) {
 	s.authFun = authFun
 }
+
+// SetProgramAuth is like SetAuth, for the calls to a single program version: authFun replaces
+// the function installed by SetAuth for them. A nil authFun removes it. Like SetAuth, it must
+// be called before the server is started.
+func (s *server) SetProgramAuth(program, version uint32, authFun func(proc uint32, cred interface{}) bool) {
+	if authFun == nil {
+		delete(s.authFuns, progVers{program, version})
+		return
+	}
+	s.authFuns[progVers{program, version}] = authFun
+}
+
+// SetAuthShortCache enables AUTH_SHORT support. The server issues a short-hand verifier for
+// each AUTH_UNIX credential it receives, and accepts it as credential on subsequent calls
+// by resolving it through the cache. Short credentials missing from the cache are rejected
+// with AUTH_REJECTEDCRED, so that clients fall back to their full credential. It must be
+// called before the server is started.
+func (s *server) SetAuthShortCache(cache AuthShortCache) {
+	s.shortCache = cache
+}
+
+// SetAuthDH enables verification of AUTH_DH credentials. Callers authenticated this way are
+// passed to the function registered with SetAuth as an AuthDH value. It must be called before
+// the server is started.
+func (s *server) SetAuthDH(verifier *AuthDHServer) {
+	s.authDH = verifier
+}
@@ -0,0 +1,116 @@
+package sunrpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// ClientSession is a connection of a Client to its server, as seen by the session hooks and
+// SessionAuth flavors, which run before the application calls are sent over it.
+type ClientSession struct {
+	Protocol PortmapperProtocol // transport of the connection
+
+	// Resumed is set when the client was connected before, i.e. the state established on
+	// the previous connections may have been lost by the server.
+	Resumed bool
+
+	c *Client
+}
+
+// Call performs a call over the connection of the session. Hooks must use it rather than the
+// methods of the Client, which would wait for the connection to be established.
+func (s *ClientSession) Call(ctx context.Context, program, version, proc uint32, args, reply interface{}) error {
+	return s.c.call(ctx, program, version, proc, args, reply)
+}
+
+// SessionHook restores the state an application keeps on the server (or on the connection),
+// each time the client connects. An error fails the connection attempt.
+//
+// Backchannel handlers are out of scope: Client never serves calls from the server over its
+// connections, so there is nothing to re-issue on them. Applications receiving callbacks run
+// a separate server, and use a hook to tell the server about it again (e.g. by calling their
+// callback registration procedure, or with PortmapperSetHook).
+type SessionHook func(ctx context.Context, s *ClientSession) error
+
+// SessionAuth is implemented by flavors with state bound to the server or to the connection
+// (AUTH_SHORT handles, AUTH_DH nicknames, RPCSEC_GSS contexts). ResumeSession is called each
+// time the client connects, before any call is sent, to drop that state or establish it again.
+type SessionAuth interface {
+	ClientAuth
+	ResumeSession(ctx context.Context, s *ClientSession) error
+}
+
+// AddSessionHook registers a hook run each time the client connects to the server (including
+// the first time), after the connection was checked with procedure 0, so that applications
+// get a durable client instead of replaying their setup after each reconnection. Hooks run
+// in the order they were added. They are not run by clients created with NewClientFromConn,
+// which never connect.
+func (c *Client) AddSessionHook(hook SessionHook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks = append(c.hooks, hook)
+}
+
+// startSession prepares a new connection, before it is used for application calls. It must be
+// called with c.mu held.
+func (c *Client) startSession(ctx context.Context) error {
+	session := &ClientSession{Protocol: c.proto, Resumed: c.resumed, c: c}
+
+	if a, ok := c.cfg.Auth.(SessionAuth); ok {
+		if err := a.ResumeSession(ctx, session); err != nil {
+			return err
+		}
+	}
+
+	// Check with procedure 0, which is always reserved as a ping
+	if err := c.call(ctx, c.Program, c.Version, 0, nil, nil); err != nil {
+		return err
+	}
+
+	if c.proto == Tcp && c.cfg.Compression != nil {
+		if err := c.negotiateCompression(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, hook := range c.hooks {
+		if err := hook(ctx, session); err != nil {
+			return err
+		}
+	}
+	c.resumed = true
+	return nil
+}
+
+// PortmapperSetHook returns a session hook registering mappings to the portmapper the client
+// is connected to, so that they are restored if the portmapper restarted. Mappings which are
+// already registered are left as they are.
+func PortmapperSetHook(mappings ...PortmapperMapping) SessionHook {
+	return func(ctx context.Context, s *ClientSession) error {
+		for _, m := range mappings {
+			var ok bool
+			if err := s.Call(ctx, PortmapperProgram, PortmapperVersion, PortmapperPortSet, &m, &ok); err != nil {
+				return fmt.Errorf("cannot register to rpcbind server: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// ResumeSession drops the short-hand credential (if any), which the server may not know
+// anymore, so that the full credential is sent on the new connection.
+func (a *ClientAuthUnix) ResumeSession(ctx context.Context, s *ClientSession) error {
+	if s.Resumed {
+		a.Refresh(AuthRejectedCred)
+	}
+	return nil
+}
+
+// ResumeSession drops the nickname (if any), so that the full credential is sent on the new
+// connection, establishing a new conversation key if the server lost the previous one.
+func (a *ClientAuthDH) ResumeSession(ctx context.Context, s *ClientSession) error {
+	if s.Resumed {
+		a.Refresh(AuthRejectedCred)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientSessionResume(t *testing.T) {
+	newServer := func() Server {
+		s := NewTCPServer(0x20000001, 1)
+		s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+		s.Register(1, func(arg uint32, reply *uint32) error {
+			*reply = arg
+			return nil
+		})
+		s.SetAuthShortCache(NewAuthShortCache(16))
+		return s
+	}
+
+	var mu sync.Mutex
+	s := newServer()
+	var conn net.Conn
+	c := NewClient("pipe", 0x20000001, 1, &ClientConfig{
+		Transport: ClientTransportTcpOnly,
+		Auth:      NewClientAuthUnix("host", 1000, 1000, nil),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var err error
+			conn, err = Pipe(s, nil)
+			return conn, err
+		},
+	})
+	defer c.Close()
+
+	var sessions []bool
+	c.AddSessionHook(func(ctx context.Context, session *ClientSession) error {
+		sessions = append(sessions, session.Resumed)
+		var reply uint32
+		return session.Call(ctx, 0x20000001, 1, 1, uint32(7), &reply)
+	})
+
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.Nil(t, c.Call(1, uint32(2), &reply))
+	assert.Equal(t, []bool{false}, sessions)
+
+	// The new server does not know the short-hand credential obtained from the first one
+	mu.Lock()
+	s.Shutdown(context.Background())
+	s = newServer()
+	conn.Close()
+	mu.Unlock()
+	defer s.Shutdown(context.Background())
+
+	assert.NotNil(t, c.Call(1, uint32(3), &reply))
+	assert.Nil(t, c.Call(1, uint32(4), &reply))
+	assert.EqualValues(t, 4, reply)
+	assert.Equal(t, []bool{false, true}, sessions)
+}
@@ -0,0 +1,71 @@
+package sunrpc
+
+// AnonymousId is the uid and gid conventionally used for anonymous callers ("nobody").
+const AnonymousId = 65534
+
+// SquashRules define how the identity of AUTH_UNIX callers is mapped, like the root_squash,
+// all_squash, anonuid and anongid options of NFS exports.
+type SquashRules struct {
+	RootSquash bool   // map uid 0 and gid 0 to the anonymous identity
+	AllSquash  bool   // map every caller to the anonymous identity
+	AnonUid    uint32 // uid of the anonymous identity
+	AnonGid    uint32 // gid of the anonymous identity
+}
+
+// DefaultSquashRules returns the rules applied by default by NFS servers: root is squashed
+// to AnonymousId.
+func DefaultSquashRules() *SquashRules {
+	return &SquashRules{
+		RootSquash: true,
+		AnonUid:    AnonymousId,
+		AnonGid:    AnonymousId,
+	}
+}
+
+// Identity is the effective identity of a caller, after squashing.
+type Identity struct {
+	Uid      uint32
+	Gid      uint32
+	Gids     []uint32
+	Squashed bool // the identity was (at least partially) mapped to the anonymous one
+}
+
+// Apply maps AUTH_UNIX credentials to the effective identity of the caller.
+func (r *SquashRules) Apply(cred AuthUnix) Identity {
+	if r.AllSquash {
+		return Identity{Uid: r.AnonUid, Gid: r.AnonGid, Squashed: true}
+	}
+
+	id := Identity{
+		Uid:  cred.Uid,
+		Gid:  cred.Gid,
+		Gids: make([]uint32, len(cred.Gids)),
+	}
+	copy(id.Gids, cred.Gids)
+
+	if r.RootSquash {
+		if id.Uid == 0 {
+			id.Uid = r.AnonUid
+			id.Squashed = true
+		}
+		if id.Gid == 0 {
+			id.Gid = r.AnonGid
+			id.Squashed = true
+		}
+		for i, gid := range id.Gids {
+			if gid == 0 {
+				id.Gids[i] = r.AnonGid
+				id.Squashed = true
+			}
+		}
+	}
+
+	return id
+}
+
+// SetSquashRules makes the server compute the effective identity of AUTH_UNIX callers according
+// to rules, and expose it in the Identity field of CallInfo. It must be called before the
+// server is started.
+func (s *server) SetSquashRules(rules *SquashRules) {
+	s.squash = rules
+}
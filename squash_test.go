@@ -0,0 +1,22 @@
+package sunrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSquashRules(t *testing.T) {
+	root := AuthUnix{Uid: 0, Gid: 0, Gids: []uint32{0, 10}}
+	user := AuthUnix{Uid: 1000, Gid: 100, Gids: []uint32{10}}
+
+	rules := DefaultSquashRules()
+	assert.Equal(t, Identity{Uid: AnonymousId, Gid: AnonymousId, Gids: []uint32{AnonymousId, 10}, Squashed: true}, rules.Apply(root))
+	assert.Equal(t, Identity{Uid: 1000, Gid: 100, Gids: []uint32{10}}, rules.Apply(user))
+
+	rules = &SquashRules{AllSquash: true, AnonUid: 500, AnonGid: 501}
+	assert.Equal(t, Identity{Uid: 500, Gid: 501, Squashed: true}, rules.Apply(user))
+
+	rules = &SquashRules{}
+	assert.Equal(t, Identity{Uid: 0, Gid: 0, Gids: []uint32{0, 10}}, rules.Apply(root))
+}
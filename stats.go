@@ -0,0 +1,133 @@
+package sunrpc
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Version and procedures of the statistics program, which can be enabled on a server with
+// SetStatsProgram.
+const (
+	StatsVersion = 1
+	StatsProcGet = 1 // returns the ServerStats of the server
+)
+
+// ServerStats is a snapshot of the statistics of a server.
+type ServerStats struct {
+	Calls  uint64      // calls received
+	Errors uint64      // calls that were not replied with SUCCESS
+	Uptime uint64      // seconds since the server was created
+	Procs  []ProcStats // sorted by program, version and procedure
+}
+
+// ProcStats holds the statistics of a procedure of one of the programs registered to the
+// server.
+type ProcStats struct {
+	Program uint32
+	Version uint32
+	Proc    uint32
+	Calls   uint64
+	Errors  uint64
+}
+
+type serverStats struct {
+	mu      sync.Mutex
+	started time.Time
+	calls   uint64
+	errors  uint64
+	procs   map[procKey]*ProcStats
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		started: time.Now(),
+		procs:   make(map[procKey]*ProcStats),
+	}
+}
+
+// record accounts for a call. Per-procedure counters are kept only for the program versions
+// registered to the server, so that calls to arbitrary programs don't add counters.
+func (st *serverStats) record(key procKey, registered, success bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.calls++
+	if !success {
+		st.errors++
+	}
+	if !registered {
+		return
+	}
+
+	ps := st.procs[key]
+	if ps == nil {
+		ps = &ProcStats{Program: key.program, Version: key.version, Proc: key.proc}
+		st.procs[key] = ps
+	}
+	ps.Calls++
+	if !success {
+		ps.Errors++
+	}
+}
+
+// Stats returns the statistics of the server.
+func (s *server) Stats() ServerStats {
+	st := s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	stats := ServerStats{
+		Calls:  st.calls,
+		Errors: st.errors,
+		Uptime: uint64(time.Since(st.started) / time.Second),
+		Procs:  make([]ProcStats, 0, len(st.procs)),
+	}
+	for _, ps := range st.procs {
+		stats.Procs = append(stats.Procs, *ps)
+	}
+	sort.Slice(stats.Procs, func(i, j int) bool {
+		a, b := stats.Procs[i], stats.Procs[j]
+		if a.Program != b.Program {
+			return a.Program < b.Program
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Proc < b.Proc
+	})
+	return stats
+}
+
+// SetStatsProgram makes the server also serve the statistics program (version StatsVersion)
+// under the specified program number, on the same port as the server program. Calls to the
+// statistics program are subject to access control, but not to authentication. A program
+// number of zero disables it (which is the default). It must be called before the server is
+// started.
+func (s *server) SetStatsProgram(program uint32) {
+	s.statsProgram = program
+}
+
+// handleStatsCall serves a call to the statistics program.
+func (s *server) handleStatsCall(reply *bytes.Buffer, call *ProcedureCall) error {
+	xid := call.Header.Xid
+
+	if call.Body.Version != StatsVersion {
+		ret := MismatchInfo{
+			Low:  StatsVersion,
+			High: StatsVersion,
+		}
+		return s.WriteReplyMessage(reply, xid, ProgMismatch, &ret)
+	}
+
+	switch call.Body.Procedure {
+	case 0:
+		return s.WriteReplyMessage(reply, xid, Success, nil)
+	case StatsProcGet:
+		stats := s.Stats()
+		return s.WriteReplyMessage(reply, xid, Success, &stats)
+	default:
+		return s.WriteReplyMessage(reply, xid, ProcUnavail, nil)
+	}
+}
@@ -0,0 +1,63 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerStats(t *testing.T) {
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		if arg == 0 {
+			return errors.New("zero")
+		}
+		*reply = arg
+		return nil
+	})
+	s.Register(2, func(arg uint32, reply *uint32) error { return nil })
+	s.RegisterProgram(0x20000003, 2, map[uint32]interface{}{
+		1: func(arg uint32, reply *uint32) error { return nil },
+	})
+	s.SetStatsProgram(0x20000002)
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.NotNil(t, c.Call(1, uint32(0), &reply))
+	assert.Nil(t, c.Call(2, uint32(0), &reply))
+	assert.NotNil(t, c.Call(3, uint32(0), &reply))
+	assert.Nil(t, c.CallProgram(0x20000003, 2, 1, uint32(0), &reply))
+	assert.NotNil(t, c.CallProgram(0x20000004, 1, 1, uint32(0), &reply))
+
+	// The statistics program, served on the same connection
+	var stats ServerStats
+	assert.Nil(t, c.CallProgram(0x20000002, StatsVersion, StatsProcGet, nil, &stats))
+	assert.Equal(t, uint64(6), stats.Calls)
+	assert.Equal(t, uint64(3), stats.Errors)
+
+	// Procedures are counted for each program registered
+	assert.Equal(t, []ProcStats{
+		{Program: 0x20000001, Version: 1, Proc: 1, Calls: 2, Errors: 1},
+		{Program: 0x20000001, Version: 1, Proc: 2, Calls: 1},
+		{Program: 0x20000001, Version: 1, Proc: 3, Calls: 1, Errors: 1},
+		{Program: 0x20000003, Version: 2, Proc: 1, Calls: 1},
+	}, stats.Procs)
+
+	assert.Equal(t, &RPCAcceptError{Stat: ProgMismatch, Low: StatsVersion, High: StatsVersion},
+		c.CallProgram(0x20000002, StatsVersion+1, StatsProcGet, nil, &stats))
+	unavail := errors.As(c.CallProgram(0x20000002, StatsVersion, 2, nil, &stats), new(*ErrProcUnavail))
+	assert.True(t, unavail)
+
+	// Calls to the statistics program are not counted
+	now := s.Stats()
+	assert.Equal(t, stats.Calls, now.Calls)
+	assert.Equal(t, stats.Procs, now.Procs)
+
+	c.Close()
+	s.Shutdown(context.Background())
+}
@@ -0,0 +1,48 @@
+// Package sunrpcbench measures the performance of the sunrpc package: it provides a synthetic
+// echo program, a load generator calling it at a target rate, and latency histograms.
+//
+// A typical benchmark serves the echo program, and runs the load against it:
+//
+//	s := sunrpc.NewTCPServer(sunrpcbench.EchoProgram, sunrpcbench.EchoVersion)
+//	sunrpcbench.RegisterEcho(s)
+//	go s.Serve(":7777")
+//
+//	res, err := sunrpcbench.Run(ctx, func() (*sunrpc.Client, error) {
+//		return sunrpc.NewClient("localhost:7777", sunrpcbench.EchoProgram, sunrpcbench.EchoVersion, nil), nil
+//	}, sunrpcbench.Config{Concurrency: 8, QPS: 5000, PayloadSize: 1024, Duration: 10 * time.Second})
+//	if err == nil {
+//		res.Report(os.Stdout)
+//	}
+package sunrpcbench
+
+import sunrpc "github.com/mzpqnxow/go-sunrpc"
+
+// The echo program, in the range of program numbers defined by users.
+const (
+	EchoProgram = 0x20000e40
+	EchoVersion = 1
+)
+
+// Procedures of the echo program.
+const (
+	ProcNull = 0 // does nothing
+	ProcEcho = 1 // returns its argument, an opaque byte string
+)
+
+// programRegisterer is implemented by the servers of the sunrpc package.
+type programRegisterer interface {
+	RegisterProgram(program, version uint32, procs map[uint32]interface{})
+}
+
+// RegisterEcho adds the echo program to a server, which can serve other programs.
+func RegisterEcho(s sunrpc.Server) {
+	s.(programRegisterer).RegisterProgram(EchoProgram, EchoVersion, map[uint32]interface{}{
+		ProcNull: func(args struct{}, reply *struct{}) error {
+			return nil
+		},
+		ProcEcho: func(payload []byte, reply *[]byte) error {
+			*reply = payload
+			return nil
+		},
+	})
+}
@@ -0,0 +1,167 @@
+package sunrpcbench
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// subBuckets is the number of buckets each power of two is split into, so that durations are
+// recorded with a precision of about 6%.
+const subBuckets = 16
+
+// numBuckets covers durations up to 2^63 ns.
+const numBuckets = (63-4)*subBuckets + subBuckets
+
+// Histogram records the distribution of latencies, in logarithmic buckets. The zero value is
+// an empty histogram. It is not safe for concurrent use.
+type Histogram struct {
+	counts   [numBuckets]uint64
+	count    uint64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+// bucketOf returns the bucket of a duration in nanoseconds: durations below 2*subBuckets have
+// their own bucket, the ones above share a bucket with the ones having the same top bits.
+func bucketOf(ns uint64) int {
+	if ns < 2*subBuckets {
+		return int(ns)
+	}
+	shift := bits.Len64(ns) - 5
+	return (shift+1)*subBuckets + int(ns>>uint(shift)) - subBuckets
+}
+
+// bucketLimit returns the largest duration of a bucket.
+func bucketLimit(i int) time.Duration {
+	if i < 2*subBuckets {
+		return time.Duration(i)
+	}
+	shift := uint(i/subBuckets - 1)
+	low := uint64(i%subBuckets+subBuckets) << shift
+	return time.Duration(low + 1<<shift - 1)
+}
+
+// Record adds a latency to the histogram.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[bucketOf(uint64(d))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Merge adds the latencies recorded by another histogram.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.count == 0 {
+		return
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// Count returns the number of latencies recorded.
+func (h *Histogram) Count() int {
+	return int(h.count)
+}
+
+// Min returns the lowest latency recorded.
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+// Max returns the highest latency recorded.
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Mean returns the average latency.
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Quantile returns the latency below which the fraction q (between 0 and 1) of the latencies
+// fall, e.g. 0.99 for the 99th percentile, within the precision of the buckets.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(q * float64(h.count))
+	if rank >= h.count {
+		rank = h.count - 1
+	}
+
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen > rank {
+			if d := bucketLimit(i); d < h.max {
+				return d
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// Fprint writes a summary of the histogram to w, followed by the distribution of the latencies,
+// grouped by powers of two.
+func (h *Histogram) Fprint(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "latency: min %v, mean %v, p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n",
+		h.Min(), h.Mean(), h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Quantile(0.999),
+		h.Max()); err != nil {
+		return err
+	}
+	if h.count == 0 {
+		return nil
+	}
+
+	var seen uint64
+	for i := 0; i < numBuckets; {
+		// Group the buckets of a power of two
+		end := i + 2*subBuckets
+		if i >= 2*subBuckets {
+			end = i + subBuckets
+		}
+		var n uint64
+		for ; i < end; i++ {
+			n += h.counts[i]
+		}
+		if n == 0 {
+			if seen == h.count {
+				break
+			}
+			continue
+		}
+
+		seen += n
+		pct := float64(n) * 100 / float64(h.count)
+		if _, err := fmt.Fprintf(w, "  <= %-10v %8d %6.2f%% %s\n",
+			bucketLimit(i-1), n, pct, strings.Repeat("#", int(pct/2))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
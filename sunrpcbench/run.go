@@ -0,0 +1,203 @@
+package sunrpcbench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sunrpc "github.com/mzpqnxow/go-sunrpc"
+)
+
+// Config describes the load generated by Run.
+type Config struct {
+	// Concurrency is the number of clients calling the server concurrently (default: 1).
+	// Since a Client serializes its calls, each one has its own.
+	Concurrency int
+
+	// QPS is the target rate of calls, across all the clients (0: as fast as possible). Calls
+	// are scheduled at regular intervals; when the clients are too slow to keep up, calls are
+	// performed as soon as they can.
+	QPS float64
+
+	// PayloadSize is the size of the payload echoed by each call. With 0, the null procedure
+	// is called instead, to measure the overhead of the calls alone.
+	PayloadSize int
+
+	// Duration is how long the load is generated. Requests is the total number of calls
+	// performed. When both are set, Run stops at the first limit reached; when neither is,
+	// it runs until its context is done.
+	Duration time.Duration
+	Requests int
+}
+
+// Dialer creates the clients used by Run, which closes them when done. The clients must talk to
+// a server serving the echo program (see RegisterEcho); their program and version don't matter.
+type Dialer func() (*sunrpc.Client, error)
+
+// Result holds the outcome of Run.
+type Result struct {
+	Calls   int           // calls performed, including failed ones
+	Errors  int           // failed calls
+	Err     error         // first failure, if any
+	Elapsed time.Duration // duration of the run
+
+	// Latency is the distribution of the latencies of the successful calls, measured from the
+	// time each call is started.
+	Latency Histogram
+}
+
+// QPS returns the achieved rate of calls.
+func (r *Result) QPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Calls) / r.Elapsed.Seconds()
+}
+
+// Report writes a human-readable report of the result to w.
+func (r *Result) Report(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "calls: %d, errors: %d, %.1f calls/s over %v\n",
+		r.Calls, r.Errors, r.QPS(), r.Elapsed); err != nil {
+		return err
+	}
+	if r.Err != nil {
+		if _, err := fmt.Fprintf(w, "first error: %v\n", r.Err); err != nil {
+			return err
+		}
+	}
+	return r.Latency.Fprint(w)
+}
+
+// errBadEcho is reported for echo calls returning a payload different from the one sent.
+var errBadEcho = errors.New("echoed payload differs from the one sent")
+
+// Run generates load against the echo program, as described by cfg, with the clients returned
+// by dial. It returns an error if the clients cannot be created; failed calls are counted in the
+// result instead.
+func Run(ctx context.Context, dial Dialer, cfg Config) (*Result, error) {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	clients := make([]*sunrpc.Client, 0, concurrency)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 0; i < concurrency; i++ {
+		c, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	payload := make([]byte, cfg.PayloadSize)
+	rand.Read(payload)
+
+	var interval time.Duration
+	if cfg.QPS > 0 {
+		interval = time.Duration(float64(time.Second) / cfg.QPS)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		next    int64 // number of calls scheduled so far
+		results = make([]Result, concurrency)
+	)
+	start := time.Now()
+	for i := range clients {
+		wg.Add(1)
+		go func(c *sunrpc.Client, res *Result) {
+			defer wg.Done()
+			for {
+				slot := atomic.AddInt64(&next, 1) - 1
+				if cfg.Requests > 0 && slot >= int64(cfg.Requests) {
+					return
+				}
+				if interval > 0 && !sleepUntil(ctx, start.Add(time.Duration(slot)*interval)) {
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+
+				begin := time.Now()
+				err := call(ctx, c, payload)
+				if err != nil && ctx.Err() != nil {
+					// Interrupted by the end of the run
+					return
+				}
+
+				res.Calls++
+				if err != nil {
+					res.Errors++
+					if res.Err == nil {
+						res.Err = err
+					}
+					continue
+				}
+				res.Latency.Record(time.Since(begin))
+			}
+		}(clients[i], &results[i])
+	}
+	wg.Wait()
+
+	total := &Result{Elapsed: time.Since(start)}
+	for i := range results {
+		total.Calls += results[i].Calls
+		total.Errors += results[i].Errors
+		if total.Err == nil {
+			total.Err = results[i].Err
+		}
+		total.Latency.Merge(&results[i].Latency)
+	}
+	return total, nil
+}
+
+// call performs a call to the echo program.
+func call(ctx context.Context, c *sunrpc.Client, payload []byte) error {
+	if len(payload) == 0 {
+		return c.CallProgramContext(ctx, EchoProgram, EchoVersion, ProcNull, struct{}{}, &struct{}{})
+	}
+
+	var reply []byte
+	if err := c.CallProgramContext(ctx, EchoProgram, EchoVersion, ProcEcho, payload, &reply); err != nil {
+		return err
+	}
+	if !bytes.Equal(reply, payload) {
+		return errBadEcho
+	}
+	return nil
+}
+
+// sleepUntil waits until t, returning false if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+package sunrpcbench
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	sunrpc "github.com/mzpqnxow/go-sunrpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+
+	assert.Equal(t, 1000, h.Count())
+	assert.Equal(t, time.Microsecond, h.Min())
+	assert.Equal(t, time.Millisecond, h.Max())
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		want := time.Duration(q*1000) * time.Microsecond
+		got := h.Quantile(q)
+		assert.True(t, got >= want && got <= want+want/16, "quantile %v: %v", q, got)
+	}
+	assert.Equal(t, time.Millisecond, h.Quantile(1))
+
+	for ns := uint64(0); ns < 1<<20; ns++ {
+		if i := bucketOf(ns); ns > uint64(bucketLimit(i)) || (i > 0 && ns <= uint64(bucketLimit(i-1))) {
+			t.Fatalf("%d ns in bucket %d", ns, i)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := sunrpc.NewTCPServer(EchoProgram, EchoVersion)
+	RegisterEcho(s)
+	defer s.Shutdown(context.Background())
+
+	dial := func() (*sunrpc.Client, error) {
+		conn, err := sunrpc.Pipe(s, nil)
+		if err != nil {
+			return nil, err
+		}
+		return sunrpc.NewClientFromConn(conn, sunrpc.Tcp, EchoProgram, EchoVersion), nil
+	}
+
+	res, err := Run(context.Background(), dial, Config{Concurrency: 4, PayloadSize: 512, Requests: 200})
+	if assert.Nil(t, err) {
+		assert.Equal(t, 200, res.Calls)
+		assert.Equal(t, 0, res.Errors)
+		assert.Equal(t, 200, res.Latency.Count())
+	}
+
+	// With a target rate, the calls are spread over the duration of the run
+	res, err = Run(context.Background(), dial, Config{QPS: 1000, Requests: 50})
+	if assert.Nil(t, err) {
+		assert.Equal(t, 50, res.Calls)
+		assert.True(t, res.Elapsed >= 49*time.Millisecond, "elapsed %v", res.Elapsed)
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, res.Report(&buf))
+	assert.Contains(t, buf.String(), "calls: 50, errors: 0")
+}
@@ -1,9 +1,15 @@
 package sunrpc
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"io"
+	"io/ioutil"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 
 	"gopkg.in/Sirupsen/logrus.v0"
 )
@@ -11,88 +17,532 @@ import (
 // TCPServer is an RPC server over TCP.
 type TCPServer struct {
 	server
+
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	wbuf        *WriteBufferConfig
+	lenient     bool
+	limits      RecordLimits
+	wtimeout    time.Duration
+	htimeout    time.Duration
+	hooks       *ConnHooks
+	connLimit   *connLimiter
+	compression *CompressionConfig
+	conns       map[net.Conn]*tcpConnState
+	active      sync.WaitGroup
+}
+
+// tcpConnState tracks the calls being processed on a client connection
+type tcpConnState struct {
+	inFlight int            // calls read but not replied yet, protected by TCPServer.mu
+	calls    sync.WaitGroup // signals when inFlight drops to zero
+	wmu      sync.Mutex     // serializes replies
+
+	bw         *bufio.Writer // buffered replies (if enabled), protected by wmu
+	flushTimer *time.Timer   // pending delayed flush, protected by wmu
+
+	store *ConnState // values stored by the procedures
+
+	// compression is the negotiated compression of the connection. It is only modified by the
+	// goroutine reading the calls, under wmu, so that goroutine can read it without locking.
+	compression Compression
 }
 
+// drainTimeout is the maximum time spent waiting for a client to close its side of
+// the connection after the server is shut down.
+const drainTimeout = time.Second
+
+// defaultHandshakeTimeout is the default maximum time to complete the TLS handshake of a new
+// connection.
+const defaultHandshakeTimeout = 10 * time.Second
+
 // NewTCPServer creates a new RPC server for the given program id and program version.
-func NewTCPServer(program uint32, version uint32) Server {
+func NewTCPServer(program uint32, version uint32) *TCPServer {
 	return &TCPServer{
-		server: newServer(program, version, logrus.Fields{"proto": "tcp"}),
+		server:   newServer(program, version, logrus.Fields{"proto": "tcp"}),
+		htimeout: defaultHandshakeTimeout,
+		conns:    make(map[net.Conn]*tcpConnState),
 	}
 }
 
 // Serve starts the RPC server.
 func (s *TCPServer) Serve(addr string) error {
-	// Start TCP Server
-	listener, err := net.Listen("tcp4", addr)
+	listener, port, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
 
 	// Bind to RPCBIND server
-	_, port, err := net.SplitHostPort(addr)
-	if err != nil {
+	if err := s.registerToPortmapper(Tcp, port); err != nil {
+		listener.Close()
 		return err
 	}
 
-	portAsInt, err := strconv.Atoi(port)
+	go s.serve(listener)
+	return nil
+}
+
+// RegisterAndAnnounce starts the RPC server and registers it to the portmapper, replacing
+// stale registrations. The registration is removed on Shutdown.
+func (s *TCPServer) RegisterAndAnnounce(addr string) error {
+	listener, port, err := s.listen(addr)
 	if err != nil {
 		return err
 	}
 
-	if err := s.registerToPortmapper(Tcp, portAsInt); err != nil {
+	if err := s.announce(Tcp, port); err != nil {
+		listener.Close()
 		return err
 	}
 
-	// Handle incoming connections
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				s.server.log.WithField("err", err).Error("Unable to accept incoming connection. Ignoring")
+	go s.serve(listener)
+	return nil
+}
 
-				continue
-			}
+// Shutdown stops the RPC server. Idle connections are closed immediately, while connections
+// with calls being processed are closed as soon as the replies have been sent. If ctx expires
+// before all connections are closed, the remaining ones are forcibly closed and the context
+// error is returned.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn, state := range s.conns {
+		if state.inFlight == 0 {
+			conn.Close()
+		} else {
+			// Stop reading further calls; the connection will be closed once the
+			// pending replies are sent
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
 
-			s.server.log.WithField("remote", conn.RemoteAddr().String()).Debug("Client connected.")
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
 
-			go s.handleCall(conn)
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
 		}
-	}()
+		s.mu.Unlock()
+	}
 
-	return nil
+	if uerr := s.release(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// ServeConn serves calls received on a single stream connection (e.g. one end of a net.Pipe),
+// until it is closed. The connection is handled like the ones accepted by Serve, and it is
+// closed on Shutdown.
+func (s *TCPServer) ServeConn(conn net.Conn) {
+	if s.tlsConfig != nil {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = s.newConnState(conn)
+	s.active.Add(1)
+	s.mu.Unlock()
+
+	s.handleCall(conn)
+}
+
+// SetTLSConfig makes the server accept TLS connections only, using the specified configuration.
+// It must be called before Serve. To authenticate clients by certificate, set cfg.ClientAuth
+// (e.g. to tls.RequireAndVerifyClientCert): the certificate chain of the client is then exposed
+// in the CallInfo of each call, and can be mapped to credentials through SetAuthenticator.
+func (s *TCPServer) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// SetTLSHandshakeTimeout bounds the time clients have to complete the TLS handshake, once
+// connected. It must be called before Serve. Connections on which the handshake times out are
+// closed. The default is 10 seconds; zero means no timeout.
+func (s *TCPServer) SetTLSHandshakeTimeout(timeout time.Duration) {
+	s.htimeout = timeout
+}
+
+// SetLenientRecordMarkers makes the server tolerate record markers sent in the wrong byte order,
+// as some embedded devices do. It must be called before Serve. Markers are interpreted as
+// little-endian only when their big-endian reading is not valid, and each occurrence is logged.
+func (s *TCPServer) SetLenientRecordMarkers(enabled bool) {
+	s.lenient = enabled
+}
+
+// SetRecordLimits bounds the number of fragments of the calls, and the time to receive them.
+// It must be called before Serve. Connections on which a call exceeds the limits are closed.
+// By default, there are no limits.
+func (s *TCPServer) SetRecordLimits(limits RecordLimits) {
+	s.limits = limits
+}
+
+// SetWriteTimeout bounds the time to write each reply (or fragment of a streamed reply) to a
+// client. It must be called before Serve. Connections on which a write times out are closed,
+// since the client cannot resynchronize on a partly written record. By default, there is no
+// timeout.
+func (s *TCPServer) SetWriteTimeout(timeout time.Duration) {
+	s.wtimeout = timeout
+}
+
+// armWriteDeadline sets the write deadline of a connection before a write, if a write timeout
+// is configured. It must be called with wmu held.
+func (s *TCPServer) armWriteDeadline(conn net.Conn) {
+	if s.wtimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.wtimeout))
+	}
 }
 
 //
 // Private
 //
 
+// swappedMarker returns the function reporting byte-swapped record markers received on conn,
+// or nil if they must not be tolerated.
+func (s *TCPServer) swappedMarker(conn net.Conn) func(marker uint32) {
+	if !s.lenient {
+		return nil
+	}
+	return func(marker uint32) {
+		s.server.log.WithFields(logrus.Fields{
+			"remote": conn.RemoteAddr().String(),
+			"marker": marker,
+		}).Warn("Tolerating byte-swapped record marker")
+	}
+}
+
+// listen opens the listening socket, and returns the port it is bound to.
+func (s *TCPServer) listen(addr string) (net.Listener, int, error) {
+	listener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	return listener, port, nil
+}
+
+// serve handles incoming connections until the listener is closed.
+func (s *TCPServer) serve(listener net.Listener) {
+	pause := s.connLimit != nil && s.connLimit.policy == ConnOverloadPause
+	for {
+		if pause && !s.waitConnSlot() {
+			return
+		}
+
+		conn, err := listener.Accept()
+		if err != nil {
+			if pause {
+				s.releaseConnSlot()
+			}
+			if s.isClosed() {
+				return
+			}
+			s.server.log.WithField("err", err).Error("Unable to accept incoming connection. Ignoring")
+
+			continue
+		}
+
+		s.server.log.WithField("remote", conn.RemoteAddr().String()).Debug("Client connected.")
+
+		switch {
+		case s.connLimit == nil:
+			s.startConn(conn, false)
+		case pause:
+			s.startConn(conn, true)
+		default:
+			s.admit(conn)
+		}
+	}
+}
+
+// startConn serves an accepted connection. If slot is set, the connection holds a slot of the
+// connection limit, which is released when it is closed.
+func (s *TCPServer) startConn(conn net.Conn, slot bool) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		if slot {
+			s.releaseConnSlot()
+		}
+		return
+	}
+	s.conns[conn] = s.newConnState(conn)
+	s.active.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		s.handleCall(conn)
+		if slot {
+			s.releaseConnSlot()
+		}
+	}()
+}
+
 func (s *TCPServer) handleCall(conn net.Conn) {
+	var draining bool
+
+	s.mu.Lock()
+	state := s.conns[conn]
+	s.mu.Unlock()
+
+	// Reported to the OnDisconnect hook, once OnConnect was called
+	var connInfo *ConnInfo
+	reason, closeErr := DisconnectShutdown, error(nil)
+
 	defer func() {
+		// Wait for pending calls to be replied
+		state.calls.Wait()
+
 		s.server.log.WithField("remote", conn.RemoteAddr().String()).Debug("Closing connection.")
 
-		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		if connInfo != nil && s.hooks.OnDisconnect != nil {
+			s.hooks.OnDisconnect(connInfo, reason, closeErr)
+		}
+		state.store.release()
+
+		if draining {
+			closeGracefully(conn)
+		} else {
+			conn.Close()
+		}
+		s.active.Done()
 	}()
 
+	info := CallInfo{Remote: conn.RemoteAddr(), Conn: state.store}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Complete the handshake upfront, so that the peer certificates are known
+		if s.htimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.htimeout))
+		}
+		err := tlsConn.Handshake()
+		if s.htimeout > 0 {
+			conn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			s.server.log.WithField("err", err).Error("TLS handshake failed")
+			return
+		}
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+		info.PeerCertificates = state.PeerCertificates
+	}
+
+	if s.hooks != nil {
+		connInfo = &ConnInfo{
+			Remote: conn.RemoteAddr(),
+			Local:  conn.LocalAddr(),
+			TLS:    info.TLS,
+			State:  state.store,
+		}
+		if s.hooks.OnConnect != nil {
+			s.hooks.OnConnect(connInfo)
+		}
+	}
+
 	for {
 		// Make sure to read a whole record at a time.
-		record, err := ReadRecord(conn)
-		if err != nil {
-			if err == io.EOF {
+		record := getRecordBuffer()
+		if err := readRecordLimited(conn, record, s.limits, s.swappedMarker(conn)); err != nil {
+			putRecordBuffer(record)
+			if s.isClosed() {
+				draining = true
 				return
 			}
-			s.server.log.WithField("err", err).Error("Unable to read a record")
+			if err != io.EOF {
+				s.server.log.WithField("err", err).Error("Unable to read a record")
+				reason, closeErr = DisconnectError, err
+			} else {
+				reason = DisconnectPeerClosed
+			}
 			return
 		}
 
-		reply, err := s.server.handleRecord(record.Bytes())
-		if err != nil {
-			s.server.log.WithField("err", err).Error("handling record")
+		if state.compression != CompressionNone && isCompressedRecord(record.Bytes()) {
+			msg, err := decompressRecord(record.Bytes(), s.compression.maxSize(s.limits.MaxSize))
+			if err != nil {
+				putRecordBuffer(record)
+				s.server.log.WithField("err", err).Error("Unable to decompress a record")
+				reason, closeErr = DisconnectError, err
+				return
+			}
+			record.Reset()
+			record.Write(msg)
+		}
+		if s.compression != nil && s.negotiateCompression(conn, state, info, record.Bytes()) {
+			putRecordBuffer(record)
+			continue
 		}
 
-		// Send response
-		if err := WriteTCPReplyMessage(conn, reply.Bytes()); err != nil {
-			s.server.log.Error(err)
+		// Account for the call, unless the server is shutting down
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			putRecordBuffer(record)
+			draining = true
+			return
+		}
+		state.inFlight++
+		state.calls.Add(1)
+		s.mu.Unlock()
+
+		job := func(release func()) {
+			defer putRecordBuffer(record)
+
+			// Streamed replies hold the connection until their last fragment is sent
+			var streaming bool
+			info := info
+			startStreaming := func() {
+				if !streaming {
+					state.wmu.Lock()
+					streaming = true
+				}
+			}
+			info.fragment = func(fragment []byte) error {
+				startStreaming()
+				s.armWriteDeadline(conn)
+				return writeFragment(state.writer(conn), fragment, false)
+			}
+			info.fragmentFrom = func(r io.Reader, n int64) error {
+				startStreaming()
+				s.armWriteDeadline(conn)
+				return writeFragmentFrom(state.writer(conn), r, n, false)
+			}
+
+			var abandoned abandonedProc
+			info.abandoned = &abandoned
+			reply, err := s.server.handleRecord(record.Bytes(), info)
+			if abandoned.done == nil {
+				release()
+			} else {
+				// A procedure given up after its call timed out holds the call, and its
+				// program concurrency slot, until it returns
+				defer func() {
+					abandoned.wait()
+					release()
+				}()
+			}
+			if err != nil {
+				s.server.log.WithField("err", err).Error("handling record")
+			}
+
+			if streaming {
+				if err == nil {
+					s.armWriteDeadline(conn)
+					err = writeFragment(state.writer(conn), reply.Bytes(), true)
+				}
+				state.wmu.Unlock()
+				if err != nil {
+					conn.Close()
+				}
+				s.reply(conn, state, nil)
+				return
+			}
+			s.reply(conn, state, reply.Bytes())
+		}
+
+		if ok, policy := s.dispatch(record.Bytes(), job); !ok {
+			reply := s.overloadReply(record.Bytes(), policy)
+			putRecordBuffer(record)
+			s.reply(conn, state, reply.Bytes())
+		}
+
+		if s.pool == nil && s.isClosed() {
+			draining = true
 			return
 		}
 	}
 }
+
+// recordBufPool holds the buffers used to read calls, which are recycled once the calls have
+// been handled.
+var recordBufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooledRecordSize is the capacity above which record buffers are not recycled, so that a
+// few large calls do not pin memory forever.
+const maxPooledRecordSize = 64 * 1024
+
+func getRecordBuffer() *bytes.Buffer {
+	buf := recordBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putRecordBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledRecordSize {
+		recordBufPool.Put(buf)
+	}
+}
+
+// reply sends a reply on a connection (if not empty), and accounts for the end of the call.
+func (s *TCPServer) reply(conn net.Conn, state *tcpConnState, reply []byte) {
+	if len(reply) > 0 {
+		state.wmu.Lock()
+		if state.compression != CompressionNone {
+			reply = compressRecord(state.compression, reply, s.compression.minSize())
+		}
+		s.armWriteDeadline(conn)
+		err := WriteTCPReplyMessage(state.writer(conn), reply)
+		state.wmu.Unlock()
+
+		if err != nil {
+			s.server.log.Error(err)
+			conn.Close()
+		}
+	}
+
+	s.mu.Lock()
+	state.inFlight--
+	idle := state.inFlight == 0
+	s.mu.Unlock()
+
+	// Send the batch of buffered replies once no other reply is expected soon
+	s.flush(conn, state, idle)
+	state.calls.Done()
+}
+
+// closeGracefully closes a connection on which replies were just sent. Closing a socket that
+// has unread data causes a TCP reset, which might destroy replies still in flight; so we
+// shut down our side first, and wait (for a short while) for the client to close its side.
+func closeGracefully(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(drainTimeout))
+		io.Copy(ioutil.Discard, conn)
+	}
+	conn.Close()
+}
@@ -0,0 +1,240 @@
+package sunrpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate creates a self-signed certificate for 127.0.0.1, usable by both ends.
+func testCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestTLS(t *testing.T) {
+	serverCert, serverX509 := testCertificate(t, "server")
+	clientCert, clientX509 := testCertificate(t, "alice")
+	clientCAs, rootCAs := x509.NewCertPool(), x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	rootCAs.AddCert(serverX509)
+
+	s := NewTCPServer(0x20000001, 1)
+	s.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	var peer string
+	s.SetAuthenticator(func(info *CallInfo) (interface{}, error) {
+		if info.TLS == nil || len(info.PeerCertificates) == 0 {
+			return nil, errors.New("no client certificate")
+		}
+		peer = info.PeerCertificates[0].Subject.CommonName
+		return nil, nil
+	})
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg * 2
+		return nil
+	})
+	ln, _, err := s.listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.serve(ln)
+
+	dialer := &tls.Dialer{Config: &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: rootCAs}}
+	c := NewClient(ln.Addr().String(), 0x20000001, 1, &ClientConfig{DialContext: dialer.DialContext})
+
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(21), &reply))
+	assert.Equal(t, uint32(42), reply)
+	assert.Equal(t, "alice", peer)
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	serverCert, _ := testCertificate(t, "server")
+
+	s := NewTCPServer(0x20000001, 1)
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert}})
+	s.SetTLSHandshakeTimeout(50 * time.Millisecond)
+	ln, _, err := s.listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.serve(ln)
+
+	// A client which never starts the handshake is disconnected
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	ne, timeout := err.(net.Error)
+	assert.False(t, timeout && ne.Timeout())
+	assert.True(t, time.Since(start) < 4*time.Second)
+	conn.Close()
+
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestShutdownDrain(t *testing.T) {
+	for _, udp := range []bool{false, true} {
+		started, release := make(chan struct{}), make(chan struct{})
+		register := func(s Server) {
+			s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+			s.Register(1, func(arg uint32, reply *uint32) error {
+				close(started)
+				<-release
+				*reply = arg
+				return nil
+			})
+		}
+
+		var s Server
+		var addr string
+		transport := ClientTransportTcpOnly
+		if udp {
+			us := NewUDPServer(0x20000001, 1)
+			register(us)
+			conn, _, err := us.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go us.serve(conn)
+			s, addr, transport = us, conn.LocalAddr().String(), ClientTransportUdpOnly
+		} else {
+			ts := NewTCPServer(0x20000001, 1)
+			register(ts)
+			ln, _, err := ts.listen("127.0.0.1:0")
+			assert.Nil(t, err)
+			go ts.serve(ln)
+			s, addr = ts, ln.Addr().String()
+		}
+
+		c := NewClient(addr, 0x20000001, 1, &ClientConfig{Transport: transport})
+		var reply uint32
+		called := make(chan error, 1)
+		go func() {
+			called <- c.Call(1, uint32(9), &reply)
+		}()
+		<-started
+
+		// Shutdown waits for the call being processed to be replied
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- s.Shutdown(context.Background())
+		}()
+		select {
+		case err := <-shutdown:
+			t.Fatalf("shutdown did not wait for the pending call (udp: %v): %v", udp, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(release)
+		assert.Nil(t, <-called)
+		assert.Equal(t, uint32(9), reply)
+		c.Close()
+		assert.Nil(t, <-shutdown)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	s := NewTCPServer(0x20000001, 1)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		<-release
+		return nil
+	})
+	ln, _, err := s.listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.serve(ln)
+
+	c := NewClient(ln.Addr().String(), 0x20000001, 1, &ClientConfig{Transport: ClientTransportTcpOnly})
+	assert.Nil(t, c.Call(0, nil, nil))
+	called := make(chan error, 1)
+	go func() {
+		called <- c.Call(1, uint32(0), nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// When ctx expires, the connections are forcibly closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	_, transport := (<-called).(*TransportError)
+	assert.True(t, transport)
+	c.Close()
+}
+
+func TestCallTimeoutAbandoned(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	s := NewTCPServer(0x20000001, 1)
+	s.SetCallTimeout(20 * time.Millisecond)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		started <- struct{}{}
+		<-release // ignores the timeout
+		return nil
+	})
+	s.Register(2, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	conn, err := Pipe(s, nil)
+	assert.Nil(t, err)
+	c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+
+	// The call is replied with SYSTEM_ERR once it times out
+	if e, ok := c.Call(1, uint32(0), nil).(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(SystemErr), e.Stat)
+	}
+	<-started
+
+	// The procedure still running holds the connection, until it returns
+	var reply uint32
+	called := make(chan error, 1)
+	go func() {
+		called <- c.Call(2, uint32(2), &reply)
+	}()
+	select {
+	case err := <-called:
+		t.Fatalf("call served while the previous procedure was running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Nil(t, <-called)
+	assert.Equal(t, uint32(2), reply)
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/bits"
+	"net"
+	"time"
 )
 
 const (
@@ -70,53 +73,271 @@ func WriteRecordMarker(w io.Writer, size uint32, last bool) error {
 
 // ReadRecord reads a whole record into memory (up to 32 KB), otherwise the record is discarded.
 func ReadRecord(r io.Reader) (*bytes.Buffer, error) {
-
 	var buf bytes.Buffer
 
-	for {
-		size, last, err := ReadRecordMarker(r)
+	if err := ReadRecordInto(r, &buf); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
 
+// ReadRecordInto is like ReadRecord, but appends the record to a buffer provided by the caller
+// (e.g. taken from a pool, or pre-sized when the size of the record can be anticipated). The
+// buffer is grown one fragment at a time, by at most the size declared by the fragment.
+func ReadRecordInto(r io.Reader, buf *bytes.Buffer) error {
+	return readRecordInto(r, buf, nil, RecordLimits{})
+}
+
+// readRecordInto implements ReadRecordInto, enforcing the size and fragment limits (but not the
+// timeout). If swapped is not nil, byte-swapped record markers are tolerated (see
+// readFragmentHeader).
+func readRecordInto(r io.Reader, buf *bytes.Buffer, swapped func(marker uint32), limits RecordLimits) error {
+	var total int
+	for fragments := 1; ; fragments++ {
+		if limits.MaxFragments > 0 && fragments > limits.MaxFragments {
+			return &ErrTooManyFragments{Max: limits.MaxFragments}
+		}
+
+		size, last, err := readFragmentHeader(r, swapped)
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		total += int(size)
+		if limits.MaxSize > 0 && total > limits.MaxSize {
+			if limits.Discard {
+				if err := discardRecord(r, size, last, swapped); err != nil {
+					return err
+				}
+			}
+			return &ErrRecordTooLarge{Max: limits.MaxSize}
+		}
+
+		buf.Grow(int(size))
+		if n, err := io.CopyN(buf, r, int64(size)); err != nil {
+			return fmt.Errorf("Unable to read entire record. Read %v, expected %v", n, size)
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// RecordLimits bounds the resources a peer can pin by sending a record slowly, or as an endless
+// series of fragments.
+type RecordLimits struct {
+	// MaxSize is the maximum size of a record (0: no limit, besides the size of the
+	// fragments).
+	MaxSize int
+
+	// Discard makes records exceeding MaxSize be read and thrown away, so that the stream
+	// can still be used, instead of being left unread.
+	Discard bool
+
+	// MaxFragments is the maximum number of fragments of a record (0: no limit).
+	MaxFragments int
+
+	// Timeout is the maximum time to receive a record, starting when its first byte is
+	// received (0: no limit). It is only enforced on readers with a SetReadDeadline method,
+	// such as net.Conn.
+	Timeout time.Duration
+}
+
+// ReadRecordLimited is like ReadRecordInto, but gives up reading records exceeding limits,
+// returning an ErrRecordTooLarge, ErrTooManyFragments or ErrRecordTimeout error. Unless they
+// are too large and limits.Discard is set, the rest of the record is not consumed, so the
+// stream cannot be used anymore.
+//
+// When a timeout is set, the read deadline of r is cleared once the record is read.
+func ReadRecordLimited(r io.Reader, buf *bytes.Buffer, limits RecordLimits) error {
+	return readRecordLimited(r, buf, limits, nil)
+}
+
+func readRecordLimited(r io.Reader, buf *bytes.Buffer, limits RecordLimits, swapped func(marker uint32)) error {
+	dr, ok := r.(readDeadliner)
+	if limits.Timeout <= 0 || !ok {
+		return readRecordInto(r, buf, swapped, limits)
+	}
+
+	tr := &recordTimer{r: dr, timeout: limits.Timeout}
+	err := readRecordInto(tr, buf, swapped, limits)
+	if tr.armed {
+		dr.SetReadDeadline(time.Time{})
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && tr.armed && time.Now().After(tr.deadline) {
+		return &ErrRecordTimeout{Timeout: limits.Timeout}
+	}
+	return err
+}
+
+// discardRecord skips the rest of a record, starting with the payload of a fragment of the
+// specified size.
+func discardRecord(r io.Reader, size uint32, last bool, swapped func(marker uint32)) error {
+	for {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+			return err
+		}
+		if last {
+			return nil
 		}
 
-		if size < 1 {
-			return nil, errors.New("A TCP record must be at least one byte in size")
+		var err error
+		if size, last, err = readFragmentHeader(r, swapped); err != nil {
+			return err
 		}
+	}
+}
+
+type readDeadliner interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
 
-		if size >= maxRecordSize {
-			io.CopyN(ioutil.Discard, r, int64(size))
+// recordTimer sets the deadline of a record when its first byte is received.
+type recordTimer struct {
+	r        readDeadliner
+	timeout  time.Duration
+	armed    bool
+	deadline time.Time
+}
+
+func (t *recordTimer) Read(b []byte) (int, error) {
+	if t.armed {
+		return t.r.Read(b)
+	}
+
+	// Read the first byte alone, so that the rest of the record is covered by the deadline
+	n, err := t.r.Read(b[:1])
+	if n > 0 {
+		t.armed = true
+		t.deadline = time.Now().Add(t.timeout)
+		t.r.SetReadDeadline(t.deadline)
+	}
+	return n, err
+}
 
-			return nil, fmt.Errorf("Discarded record exceeding maximum size of %v bytes", maxRecordSize)
+// AppendRecord is like ReadRecordInto, but appends the record to a byte slice, returning the
+// extended slice.
+func AppendRecord(dst []byte, r io.Reader) ([]byte, error) {
+	for {
+		size, last, err := readFragmentHeader(r, nil)
+		if err != nil {
+			return dst, err
 		}
 
-		if n, err := io.CopyN(&buf, r, int64(size)); err != nil {
-			return nil, fmt.Errorf("Unable to read entire record. Read %v, expected %v", n, size)
+		start := len(dst)
+		if cap(dst)-start < int(size) {
+			grown := make([]byte, start, start+int(size))
+			copy(grown, dst)
+			dst = grown
+		}
+		dst = dst[:start+int(size)]
+
+		if n, err := io.ReadFull(r, dst[start:]); err != nil {
+			return dst[:start+n], fmt.Errorf("Unable to read entire record. Read %v, expected %v", n, size)
 		}
 
 		if last {
-			break
+			return dst, nil
 		}
 	}
+}
 
-	return &buf, nil
+// readFragmentHeader reads the record marker of a fragment, and checks the declared size.
+// Fragments exceeding the maximum size are discarded.
+//
+// If swapped is not nil, markers sent in little-endian order by broken peers are detected:
+// when a marker declares an invalid size but is valid once byte-swapped, the swapped marker
+// is used, and swapped is called with the marker as received.
+func readFragmentHeader(r io.Reader, swapped func(marker uint32)) (size uint32, last bool, err error) {
+	var marker uint32
+	if err := binary.Read(r, binary.BigEndian, &marker); err != nil {
+		return 0, false, err
+	}
+
+	size, last = ParseRecordMarker(marker)
+	if swapped != nil && !validFragmentSize(size) {
+		if ssize, slast := ParseRecordMarker(bits.ReverseBytes32(marker)); validFragmentSize(ssize) {
+			swapped(marker)
+			size, last = ssize, slast
+		}
+	}
+
+	if size < 1 {
+		return 0, false, errors.New("A TCP record must be at least one byte in size")
+	}
+
+	if size >= maxRecordSize {
+		io.CopyN(ioutil.Discard, r, int64(size))
+
+		return 0, false, fmt.Errorf("Discarded record exceeding maximum size of %v bytes", maxRecordSize)
+	}
+
+	return size, last, nil
+}
+
+func validFragmentSize(size uint32) bool {
+	return size >= 1 && size < maxRecordSize
 }
 
 // WriteTCPReplyMessage writes an outgoing "reply" message with the appropriate framing structure
-// required by RPC-over-TCP.
+// required by RPC-over-TCP. Short writes are retried until the whole record is written; if it
+// is interrupted by an error after part of it was written, an ErrPartialWrite is returned.
 func WriteTCPReplyMessage(w io.Writer, reply []byte) error {
-
-	// Write the record marker
-	//
 	// FIXME: Assuming we are sending a single record
-	if err := WriteRecordMarker(w, uint32(len(reply)), true); err != nil {
+	buf := bytes.NewBuffer(make([]byte, 0, len(reply)+4))
+	if err := WriteRecordMarker(buf, uint32(len(reply)), true); err != nil {
 		return err
 	}
+	buf.Write(reply)
 
-	// Write the payload
-	if _, err := w.Write(reply); err != nil {
-		return err
+	return writeFull(w, buf.Bytes())
+}
+
+// WriteTCPReplyMessageDeadline is like WriteTCPReplyMessage, but gives up writing the record
+// at deadline. It is only enforced on writers with a SetWriteDeadline method, such as
+// net.Conn, whose write deadline is cleared once the record is written.
+func WriteTCPReplyMessageDeadline(w io.Writer, reply []byte, deadline time.Time) error {
+	if dw, ok := w.(writeDeadliner); ok && !deadline.IsZero() {
+		dw.SetWriteDeadline(deadline)
+		defer dw.SetWriteDeadline(time.Time{})
 	}
+	return WriteTCPReplyMessage(w, reply)
+}
+
+type writeDeadliner interface {
+	io.Writer
+	SetWriteDeadline(t time.Time) error
+}
+
+// maxStalledWrites is the number of consecutive writes that can return neither data nor an
+// error, before writeFull gives up.
+const maxStalledWrites = 16
 
+// writeFull writes the whole of b to w. Writers breaking the io.Writer contract (e.g. wrapped
+// or non-blocking ones) can return short writes without an error: they are retried. If only
+// part of b could be written, an ErrPartialWrite is returned.
+func writeFull(w io.Writer, b []byte) error {
+	var written, stalled int
+	for written < len(b) {
+		n, err := w.Write(b[written:])
+		written += n
+		if n == 0 && err == nil {
+			if stalled++; stalled == maxStalledWrites {
+				err = io.ErrShortWrite
+			}
+		} else {
+			stalled = 0
+		}
+
+		if err != nil {
+			if written == 0 {
+				return err
+			}
+			return &ErrPartialWrite{Written: written, Total: len(b), Err: err}
+		}
+	}
 	return nil
 }
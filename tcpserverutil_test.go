@@ -2,8 +2,14 @@ package sunrpc
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/rasky/go-xdr/xdr2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -87,3 +93,198 @@ func TestReadTCPCallMessage(t *testing.T) {
 	assert.EqualValues(t, PortmapperVersion, call.Body.Version)
 	assert.EqualValues(t, PortmapperPortSet, call.Body.Procedure)
 }
+
+func TestReadCallMessage(t *testing.T) {
+	var msg bytes.Buffer
+	_, err := xdr.Marshal(&msg, NewProcedureCall(0x20000001, 1, 3))
+	assert.Nil(t, err)
+	_, err = xdr.Marshal(&msg, uint32(42))
+	assert.Nil(t, err)
+
+	check := func(call *ProcedureCall, args *bytes.Reader, err error) {
+		if assert.Nil(t, err) {
+			assert.EqualValues(t, 0x20000001, call.Body.Program)
+			assert.EqualValues(t, 3, call.Body.Procedure)
+			var arg uint32
+			_, err = xdr.Unmarshal(args, &arg)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(42), arg)
+		}
+	}
+
+	// Stream transport
+	var stream bytes.Buffer
+	assert.Nil(t, WriteTCPReplyMessage(&stream, msg.Bytes()))
+	check(ReadCallMessage(&stream))
+
+	// Datagram transport
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer server.Close()
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write(msg.Bytes())
+	assert.Nil(t, err)
+	check(ReadCallMessage(server))
+
+	_, err = client.Write(msg.Bytes())
+	assert.Nil(t, err)
+	call, args, addr, err := ReadCallMessageFrom(server)
+	check(call, args, err)
+	assert.Equal(t, client.LocalAddr().String(), addr.String())
+
+	// Truncated header
+	_, err = client.Write(msg.Bytes()[:10])
+	assert.Nil(t, err)
+	_, _, err = ReadCallMessage(server)
+	assert.NotNil(t, err)
+	assert.NotEmpty(t, err.Error())
+}
+
+func TestReadRecordIntoFragments(t *testing.T) {
+	frame := []byte{
+		0x00, 0x00, 0x00, 0x02, 0xaa, 0xbb, // First fragment
+		0x80, 0x00, 0x00, 0x03, 0xcc, 0xdd, 0xee, // Last fragment
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x01)
+	assert.Nil(t, ReadRecordInto(bytes.NewReader(frame), &buf))
+	assert.Equal(t, []byte{0x01, 0xaa, 0xbb, 0xcc, 0xdd, 0xee}, buf.Bytes())
+
+	record, err := AppendRecord(make([]byte, 0, 2), bytes.NewReader(frame))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee}, record)
+
+	_, err = AppendRecord(nil, bytes.NewReader(frame[:9]))
+	assert.NotNil(t, err)
+}
+
+func TestReadRecordSwappedMarker(t *testing.T) {
+	frame := []byte{
+		0x02, 0x00, 0x00, 0x00, 0xaa, 0xbb, // First fragment, little-endian marker
+		0x01, 0x00, 0x00, 0x80, 0xcc, // Last fragment, little-endian marker
+	}
+
+	assert.NotNil(t, ReadRecordInto(bytes.NewReader(frame), &bytes.Buffer{}))
+
+	var swapped int
+	var buf bytes.Buffer
+	assert.Nil(t, readRecordInto(bytes.NewReader(frame), &buf, func(uint32) { swapped++ }, RecordLimits{}))
+	assert.Equal(t, []byte{0xaa, 0xbb, 0xcc}, buf.Bytes())
+	assert.Equal(t, 2, swapped)
+}
+
+func TestReadRecordLimited(t *testing.T) {
+	frame := []byte{
+		0x00, 0x00, 0x00, 0x01, 0xaa, // First fragment
+		0x00, 0x00, 0x00, 0x01, 0xbb, // Second fragment
+		0x80, 0x00, 0x00, 0x01, 0xcc, // Last fragment
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, ReadRecordLimited(bytes.NewReader(frame), &buf, RecordLimits{MaxFragments: 3}))
+	assert.Equal(t, []byte{0xaa, 0xbb, 0xcc}, buf.Bytes())
+
+	err := ReadRecordLimited(bytes.NewReader(frame), &bytes.Buffer{}, RecordLimits{MaxFragments: 2})
+	assert.Equal(t, &ErrTooManyFragments{Max: 2}, err)
+
+	// Records too large can be skipped, keeping the stream usable
+	r := bytes.NewReader(append(append([]byte{}, frame...), 0x80, 0x00, 0x00, 0x01, 0xdd))
+	err = ReadRecordLimited(r, &bytes.Buffer{}, RecordLimits{MaxSize: 2, Discard: true})
+	assert.Equal(t, &ErrRecordTooLarge{Max: 2}, err)
+	buf.Reset()
+	assert.Nil(t, ReadRecordInto(r, &buf))
+	assert.Equal(t, []byte{0xdd}, buf.Bytes())
+
+	// A record which is never completed
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write(frame[:7])
+
+	err = ReadRecordLimited(server, &bytes.Buffer{}, RecordLimits{Timeout: 20 * time.Millisecond})
+	assert.Equal(t, &ErrRecordTimeout{Timeout: 20 * time.Millisecond}, err)
+}
+
+func TestRecordReaderWriter(t *testing.T) {
+	payload := make([]byte, 3*recordFragmentSize+100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	f, err := ioutil.TempFile("", "record")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(payload)
+	assert.Nil(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+
+	// Some data buffered before a file, whose size is known, and a reader whose size is not
+	var stream bytes.Buffer
+	w := NewRecordWriter(&stream)
+	_, err = w.Write([]byte("head"))
+	assert.Nil(t, err)
+	n, err := w.ReadFrom(f)
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(payload), n)
+	n, err = w.ReadFrom(io.MultiReader(bytes.NewReader(payload)))
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(payload), n)
+	assert.Nil(t, w.Close())
+	_, err = w.Write([]byte("tail"))
+	assert.NotNil(t, err)
+
+	expected := append(append([]byte("head"), payload...), payload...)
+	buf, err := ReadRecord(bytes.NewReader(stream.Bytes()))
+	if assert.Nil(t, err) {
+		assert.Equal(t, expected, buf.Bytes())
+	}
+
+	var out bytes.Buffer
+	n, err = NewRecordReader(bytes.NewReader(stream.Bytes())).WriteTo(&out)
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(expected), n)
+	assert.Equal(t, expected, out.Bytes())
+
+	data, err := ioutil.ReadAll(NewRecordReader(bytes.NewReader(stream.Bytes())))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, data)
+
+	_, err = ioutil.ReadAll(NewRecordReader(bytes.NewReader(stream.Bytes()[:stream.Len()-1])))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+// shortWriter accepts at most max bytes per write, and fails once limit bytes are written.
+type shortWriter struct {
+	buf        bytes.Buffer
+	max, limit int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.buf.Len() >= w.limit {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.buf.Write(p)
+}
+
+func TestWriteTCPReplyMessageShortWrites(t *testing.T) {
+	reply := []byte("0123456789")
+
+	w := &shortWriter{max: 3, limit: 100}
+	assert.Nil(t, WriteTCPReplyMessage(w, reply))
+	assert.Equal(t, append([]byte{0x80, 0, 0, 10}, reply...), w.buf.Bytes())
+
+	w = &shortWriter{max: 3, limit: 6}
+	err := WriteTCPReplyMessage(w, reply)
+	assert.Equal(t, &ErrPartialWrite{Written: 6, Total: 14, Err: io.ErrClosedPipe}, err)
+
+	// Errors occurring before anything is written are returned as is
+	assert.Equal(t, io.ErrClosedPipe, WriteTCPReplyMessage(w, reply))
+}
@@ -0,0 +1,64 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// TraceInfo describes a call observed by a CallTracer.
+type TraceInfo struct {
+	Server    bool // whether the call is served (true), or performed by a Client (false)
+	Program   uint32
+	Version   uint32
+	Procedure uint32
+	Xid       uint32
+	Transport string   // "tcp", "udp", or the network of the connection (e.g. "pipe")
+	Peer      net.Addr // address of the caller (served calls) or the server (Client calls)
+}
+
+// CallTracer observes the calls served by a Server or performed by a Client, e.g. to record
+// them as the spans of a distributed trace (see the otelsunrpc package).
+//
+// It is invoked when a call starts, with the context of the call: for a Client, the context
+// passed to CallContext; for a Server, a context which is canceled on Shutdown. For served
+// calls, the returned context is the parent of the one passed to the procedures; for Client
+// calls, it is not used. The returned function is called when the call ends, with a nil error
+// on success: otherwise, err describes the failure, with the types used by Client (in
+// particular, RPCAcceptError and RPCDeniedError for the replies reporting an error).
+type CallTracer func(ctx context.Context, info *TraceInfo) (context.Context, func(err error))
+
+// SetTracer installs a tracer, which observes the calls received by the server. The calls
+// which cannot be decoded (and are thus not replied) are not traced. It must be called before
+// the server is started.
+func (s *server) SetTracer(tracer CallTracer) {
+	s.tracer = tracer
+}
+
+// errCallDropped describes served calls which are not replied.
+var errCallDropped = errors.New("call dropped")
+
+// replyResult returns the result of a served call, as reported to a CallTracer.
+func replyResult(reply []byte, success bool, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case success:
+		return nil
+	case len(reply) == 0:
+		return errCallDropped
+	}
+
+	r, _, err := DecodeReplyBody(reply)
+	if err != nil {
+		return &ProtocolError{Err: err}
+	}
+	return replyError(r)
+}
+
+func addrNetwork(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.Network()
+}
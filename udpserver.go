@@ -1,8 +1,11 @@
 package sunrpc
 
 import (
+	"context"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"gopkg.in/Sirupsen/logrus.v0"
 )
@@ -13,80 +16,274 @@ const MaxUdpSize = 65507
 // UDPServer is an RPC server over UDP.
 type UDPServer struct {
 	server
+
+	conn        *net.UDPConn
+	stopped     chan struct{}
+	calls       sync.WaitGroup
+	readBuffer  int
+	writeBuffer int
+	pinSource   bool
+	pinned      bool // source pinning is enabled on conn
 }
 
 // NewUDPServer creates a new UDPServer for the given RPC program identifier and program version.
-func NewUDPServer(program uint32, version uint32) Server {
+func NewUDPServer(program uint32, version uint32) *UDPServer {
 	return &UDPServer{
-		server: newServer(program, version, logrus.Fields{"proto": "udp"}),
+		server:      newServer(program, version, logrus.Fields{"proto": "udp"}),
+		readBuffer:  MaxUdpSize,
+		writeBuffer: MaxUdpSize,
 	}
 }
 
 // Serve starts the RPC server.
 func (server *UDPServer) Serve(addr string) error {
-	// Parse and deconstruct host and port
-	host, portString, err := net.SplitHostPort(addr)
+	conn, port, err := server.listen(addr)
 	if err != nil {
 		return err
 	}
 
-	port, err := strconv.Atoi(portString)
-	if err != nil {
+	if err := server.registerToPortmapper(Udp, port); err != nil {
+		conn.Close()
 		return err
 	}
 
-	// Start UDP Server
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+	go server.serve(conn)
+	return nil
+}
+
+// RegisterAndAnnounce starts the RPC server and registers it to the portmapper, replacing
+// stale registrations. The registration is removed on Shutdown.
+func (server *UDPServer) RegisterAndAnnounce(addr string) error {
+	conn, port, err := server.listen(addr)
 	if err != nil {
 		return err
 	}
 
-	if err := conn.SetReadBuffer(MaxUdpSize); err != nil {
-		return err
-	}
-	if err := conn.SetWriteBuffer(MaxUdpSize); err != nil {
+	if err := server.announce(Udp, port); err != nil {
+		conn.Close()
 		return err
 	}
 
-	if err := server.registerToPortmapper(Udp, port); err != nil {
-		return err
+	go server.serve(conn)
+	return nil
+}
+
+// Shutdown stops the RPC server. If a call is being processed, Shutdown waits for its reply
+// to be sent, or for ctx to expire.
+func (server *UDPServer) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.closed = true
+	conn, stopped := server.conn, server.stopped
+	server.mu.Unlock()
+
+	if conn != nil {
+		// Wake up the serving goroutine, so that it notices the shutdown
+		conn.SetReadDeadline(time.Now())
 	}
 
+	drained := make(chan struct{})
 	go func() {
-		for {
-			server.handleCall(conn)
+		if stopped != nil {
+			<-stopped
 		}
+		server.calls.Wait()
+		close(drained)
 	}()
 
-	return nil
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	if uerr := server.release(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// SetSocketBuffers sets the size of the receive and send buffers (SO_RCVBUF and SO_SNDBUF) of
+// the socket. It must be called before Serve. The default, MaxUdpSize, fits one datagram of
+// the maximum size; larger buffers absorb bursts of calls. Zero keeps the system default.
+//
+// The system may cap the sizes (on Linux, to net.core.rmem_max and net.core.wmem_max).
+func (server *UDPServer) SetSocketBuffers(read, write int) {
+	server.readBuffer = read
+	server.writeBuffer = write
+}
+
+// SetSourcePinning makes the server send each reply from the local address the call was
+// received on, which matters on multihomed hosts when the server is bound to the wildcard
+// address: many legacy clients reject replies coming from another address than the one they
+// sent the call to. It must be called before Serve.
+//
+// It relies on IP_PKTINFO, and is only supported on Linux (see PlatformCapabilities):
+// elsewhere, a warning is logged and replies are sent without pinning.
+func (server *UDPServer) SetSourcePinning(pin bool) {
+	server.pinSource = pin
 }
 
 //
 // Private
 //
 
+// listen opens the UDP socket, and returns the port it is bound to.
+func (server *UDPServer) listen(addr string) (*net.UDPConn, int, error) {
+	// Parse and deconstruct host and port
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Start UDP Server
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := setSocketBuffers(conn, server.readBuffer, server.writeBuffer); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	server.pinned = false
+	if server.pinSource && !sourcePinningSupported {
+		server.server.log.Warn("Source address pinning is not supported on this platform")
+	} else if server.pinSource {
+		if err := enablePacketInfo(conn); err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+		server.pinned = true
+	}
+
+	server.mu.Lock()
+	server.conn = conn
+	server.stopped = make(chan struct{})
+	server.mu.Unlock()
+
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// serve handles incoming datagrams until the socket is closed.
+func (server *UDPServer) serve(conn *net.UDPConn) {
+	server.mu.Lock()
+	stopped := server.stopped
+	server.mu.Unlock()
+	defer close(stopped)
+
+	for !server.isClosed() {
+		server.handleCall(conn)
+	}
+}
+
 func (s *UDPServer) handleCall(conn *net.UDPConn) {
 	// Read and buffer UDP datagram
 	b := make([]byte, MaxUdpSize)
 
-	packetSize, callerAddr, err := conn.ReadFromUDP(b)
+	// Control messages are only read when needed, since not all platforms support them
+	var packetSize, oobn int
+	var callerAddr *net.UDPAddr
+	var err error
+	var oob []byte
+	if s.pinned {
+		oob = make([]byte, 64)
+		packetSize, oobn, _, callerAddr, err = conn.ReadMsgUDP(b, oob)
+	} else {
+		packetSize, callerAddr, err = conn.ReadFromUDP(b)
+	}
 	if err != nil {
+		if s.isClosed() {
+			return
+		}
 		s.server.log.WithField("err", err).Error("Cannot read UDP datagram")
 
 		return
 	}
 
-	reply, err := s.server.handleRecord(b[0:packetSize])
-	if err != nil {
-		s.server.log.WithField("err", err).Error("handling record")
+	// Control message sending the reply from the local address of the call
+	var control []byte
+	if s.pinned {
+		control = replyControl(oob[:oobn])
+	}
+
+	s.calls.Add(1)
+	job := func(release func()) {
+		defer s.calls.Done()
+
+		var abandoned abandonedProc
+		reply, err := s.server.handleRecord(b[0:packetSize], CallInfo{Remote: callerAddr, abandoned: &abandoned})
+		if abandoned.done == nil {
+			release()
+		} else {
+			// A procedure given up after its call timed out holds the call, and its
+			// program concurrency slot, until it returns
+			defer func() {
+				abandoned.wait()
+				release()
+			}()
+		}
+		if err != nil {
+			s.server.log.WithField("err", err).Error("handling record")
+		}
+		s.reply(conn, callerAddr, control, reply.Bytes())
+	}
+
+	if ok, policy := s.dispatch(b[0:packetSize], job); !ok {
+		reply := s.overloadReply(b[0:packetSize], policy)
+		s.reply(conn, callerAddr, control, reply.Bytes())
+		s.calls.Done()
 	}
+}
 
-	if _, err := conn.WriteToUDP(reply.Bytes(), callerAddr); err != nil {
+func (s *UDPServer) reply(conn *net.UDPConn, callerAddr *net.UDPAddr, control, reply []byte) {
+	if len(reply) == 0 {
+		return
+	}
+
+	var err error
+	if control != nil {
+		_, _, err = conn.WriteMsgUDP(reply, control, callerAddr)
+	} else {
+		_, err = conn.WriteToUDP(reply, callerAddr)
+	}
+	if err != nil {
 		s.server.log.WithFields(logrus.Fields{
 			"callerAddr": callerAddr.String(),
 			"err":        err,
 		}).Error("Cannot send reply over UDP")
+	}
+}
 
-		return
+// setSocketBuffers sets the size of the buffers of a socket; zero sizes are left unchanged.
+// Connections without socket buffers are left untouched.
+func setSocketBuffers(conn net.Conn, read, write int) error {
+	sc, ok := conn.(interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	})
+	if !ok {
+		return nil
+	}
+
+	if read > 0 {
+		if err := sc.SetReadBuffer(read); err != nil {
+			return err
+		}
 	}
+	if write > 0 {
+		if err := sc.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
+	return nil
 }
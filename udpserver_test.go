@@ -0,0 +1,64 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPLargeReply(t *testing.T) {
+	s := NewUDPServer(0x20000001, 1)
+	s.SetSocketBuffers(1<<20, 1<<20)
+	s.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	s.Register(1, func(size uint32, reply *[]byte) error {
+		*reply = bytes.Repeat([]byte{0xa5}, int(size))
+		return nil
+	})
+	conn, _, err := s.listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.serve(conn)
+
+	// Replies up to the largest datagram are received intact
+	c := NewClient(conn.LocalAddr().String(), 0x20000001, 1, &ClientConfig{
+		Transport:  ClientTransportUdpOnly,
+		ReadBuffer: 1 << 20,
+	})
+	var reply []byte
+	assert.Nil(t, c.Call(1, uint32(60000), &reply))
+	assert.Equal(t, bytes.Repeat([]byte{0xa5}, 60000), reply)
+
+	c.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+// bufferConn records the socket buffer sizes set on a connection.
+type bufferConn struct {
+	net.Conn
+	read, write int
+}
+
+func (c *bufferConn) SetReadBuffer(n int) error {
+	c.read = n
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(n int) error {
+	c.write = n
+	return nil
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	conn := &bufferConn{}
+	assert.Nil(t, setSocketBuffers(conn, 4096, 0))
+	assert.Equal(t, 4096, conn.read)
+	assert.Equal(t, 0, conn.write)
+
+	// Connections without socket buffers are left untouched
+	client, server := net.Pipe()
+	assert.Nil(t, setSocketBuffers(client, 4096, 4096))
+	client.Close()
+	server.Close()
+}
@@ -0,0 +1,237 @@
+package sunrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"sync"
+)
+
+// OverloadPolicy defines what a server running a worker pool does with incoming calls when
+// all workers are busy and the queue is full.
+type OverloadPolicy int
+
+const (
+	OverloadQueue  OverloadPolicy = iota // stop reading from the transport until there is room in the queue
+	OverloadReject                       // reply immediately with SYSTEM_ERR
+	OverloadDrop                         // drop the call without replying
+)
+
+// WorkerPoolConfig configures the worker pool of a server (see SetWorkerPool).
+type WorkerPoolConfig struct {
+	Workers    int            // number of goroutines executing calls (default: 16)
+	QueueDepth int            // number of calls waiting for a worker (default: Workers)
+	Overload   OverloadPolicy // behavior when the queue is full (default: OverloadQueue)
+}
+
+// workerPool executes calls on a bounded number of goroutines.
+type workerPool struct {
+	queue  chan func()
+	quit   chan struct{}
+	policy OverloadPolicy
+}
+
+func newWorkerPool(cfg WorkerPoolConfig) *workerPool {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 16
+	}
+	if cfg.QueueDepth <= 0 {
+		cfg.QueueDepth = cfg.Workers
+	}
+
+	p := &workerPool{
+		queue:  make(chan func(), cfg.QueueDepth),
+		quit:   make(chan struct{}),
+		policy: cfg.Overload,
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case job := <-p.queue:
+			job()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// submit queues a job. It returns false if the job was not queued because the pool is
+// overloaded (or stopped).
+func (p *workerPool) submit(job func()) bool {
+	if p.policy == OverloadQueue {
+		select {
+		case p.queue <- job:
+			return true
+		case <-p.quit:
+			return false
+		}
+	}
+
+	select {
+	case p.queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop terminates the workers. Jobs still in the queue are not executed.
+func (p *workerPool) stop() {
+	close(p.quit)
+}
+
+// SetWorkerPool makes the server execute calls on a bounded pool of goroutines, so that
+// memory usage stays bounded under call floods. It must be called before the server is started.
+//
+// Procedures given up after their call timed out (see SetCallTimeout) keep their worker until
+// they return, so that slow procedures cannot run in unbounded numbers.
+func (s *server) SetWorkerPool(cfg *WorkerPoolConfig) {
+	if cfg == nil {
+		cfg = &WorkerPoolConfig{}
+	}
+	s.pool = newWorkerPool(*cfg)
+}
+
+// dispatch executes the job handling a record on the worker pool if the server (or the
+// program called) has one, or inline otherwise, once the concurrency limit of the program
+// allows it. It returns false, and the overload policy to apply, if the job was not executed
+// nor queued.
+//
+// The job must call release once the procedure returned, before sending the reply, so that
+// the client can issue its next call as soon as it gets the reply without hitting the limit.
+// Procedures given up after their call timed out must be released when they return, after
+// the reply was sent.
+func (s *server) dispatch(record []byte, job func(release func())) (bool, OverloadPolicy) {
+	pool := s.pool
+	l := s.limiter(record)
+	if l != nil && l.pool != nil {
+		pool = l.pool
+	}
+
+	run := func() { job(func() {}) }
+	acquired := false
+	if l != nil && l.slots != nil {
+		var once sync.Once
+		free := func() {
+			once.Do(func() { <-l.slots })
+		}
+		if l.policy == OverloadQueue {
+			// Wait for a slot on the goroutine executing the call
+			run = func() {
+				l.slots <- struct{}{}
+				defer free()
+				job(free)
+			}
+		} else {
+			select {
+			case l.slots <- struct{}{}:
+				acquired = true
+			default:
+				s.log.WithField("prog", strconv.Itoa(int(binary.BigEndian.Uint32(record[12:])))).
+					Warn("Program concurrency limit reached")
+				return false, l.policy
+			}
+			run = func() {
+				defer free()
+				job(free)
+			}
+		}
+	}
+
+	if pool == nil {
+		run()
+		return true, 0
+	}
+	if !pool.submit(run) {
+		if acquired {
+			<-l.slots
+		}
+		s.log.Warn("Worker pool overloaded")
+		return false, pool.policy
+	}
+	return true, 0
+}
+
+// overloadReply returns the reply to send for a record that couldn't be dispatched, according
+// to the overload policy. The reply is empty if nothing should be sent.
+func (s *server) overloadReply(record []byte, policy OverloadPolicy) bytes.Buffer {
+	var reply bytes.Buffer
+
+	if policy != OverloadReject || len(record) < 4 {
+		return reply
+	}
+
+	xid := binary.BigEndian.Uint32(record)
+	if err := s.WriteReplyMessage(&reply, xid, SystemErr, nil); err != nil {
+		reply.Reset()
+	}
+	return reply
+}
+
+// ProgramConcurrency limits the calls to a program executed at once (see
+// SetProgramConcurrency).
+type ProgramConcurrency struct {
+	// MaxConcurrent is the maximum number of calls to the program executed at once (0: no
+	// limit).
+	MaxConcurrent int
+
+	// Overload is the behavior for the calls exceeding MaxConcurrent: by default, they wait
+	// for a running call to complete, on the goroutine (or worker) they were dispatched to.
+	// Without a worker pool, that is the goroutine reading the transport: the connection (or,
+	// on UDP, the whole server) does not read other calls meanwhile.
+	Overload OverloadPolicy
+
+	// Pool, if not nil, makes the calls to the program run on a dedicated worker pool,
+	// instead of the pool of the server (or the goroutine reading them), so that they never
+	// hold the resources used by the calls to the other programs.
+	Pool *WorkerPoolConfig
+}
+
+// programLimiter enforces the ProgramConcurrency of a program.
+type programLimiter struct {
+	slots  chan struct{} // one per running call, nil if unlimited
+	policy OverloadPolicy
+	pool   *workerPool
+}
+
+// SetProgramConcurrency limits the resources used by the calls to a program, so that a slow
+// program (e.g. a disk-bound one) cannot starve the other programs served by the server. A
+// nil cfg removes the limits. It must be called before the server is started.
+//
+// To isolate programs from each other, waiting calls must not hold shared workers: either
+// give slow programs their own Pool, or reject the calls exceeding the limit. Procedures given
+// up after their call timed out (see SetCallTimeout) count against the limit until they
+// return.
+func (s *server) SetProgramConcurrency(program uint32, cfg *ProgramConcurrency) {
+	if old := s.limiters[program]; old != nil && old.pool != nil {
+		old.pool.stop()
+	}
+	if cfg == nil {
+		delete(s.limiters, program)
+		return
+	}
+
+	l := &programLimiter{policy: cfg.Overload}
+	if cfg.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	if cfg.Pool != nil {
+		l.pool = newWorkerPool(*cfg.Pool)
+	}
+	s.limiters[program] = l
+}
+
+// limiter returns the limiter of the program called by a record, if any.
+func (s *server) limiter(record []byte) *programLimiter {
+	// xid, message type and RPC version precede the program
+	if len(s.limiters) == 0 || len(record) < 16 {
+		return nil
+	}
+	return s.limiters[binary.BigEndian.Uint32(record[12:])]
+}
@@ -0,0 +1,122 @@
+package sunrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool(t *testing.T) {
+	for _, policy := range []OverloadPolicy{OverloadQueue, OverloadReject, OverloadDrop} {
+		started, release := make(chan uint32, 4), make(chan struct{})
+		s := NewTCPServer(0x20000001, 1)
+		s.Register(1, func(arg uint32, reply *uint32) error {
+			started <- arg
+			<-release
+			*reply = arg
+			return nil
+		})
+		s.SetWorkerPool(&WorkerPoolConfig{Workers: 2, QueueDepth: 1, Overload: policy})
+
+		call := func(arg uint32, done chan<- error) {
+			conn, err := Pipe(s, nil)
+			assert.Nil(t, err)
+			c := NewClientFromConn(conn, Tcp, 0x20000001, 1)
+			c.SetCallTimeout(time.Second)
+			go func() {
+				var reply uint32
+				err := c.Call(1, arg, &reply)
+				if err == nil && reply != arg {
+					err = &ErrGarbageArgs{}
+				}
+				c.Close()
+				done <- err
+			}()
+		}
+
+		// Two calls occupy the workers, the third one waits in the queue
+		done := make(chan error, 3)
+		for arg := uint32(1); arg <= 2; arg++ {
+			call(arg, done)
+			<-started
+		}
+		call(3, done)
+		time.Sleep(50 * time.Millisecond)
+		assert.Len(t, started, 0)
+
+		// The fourth call exceeds the capacity of the pool: depending on the policy, it is
+		// rejected right away, dropped, or served once the workers are released
+		overflow := make(chan error, 1)
+		call(4, overflow)
+		if policy == OverloadReject {
+			if e, ok := (<-overflow).(*RPCAcceptError); assert.True(t, ok) {
+				assert.Equal(t, AcceptType(SystemErr), e.Stat)
+			}
+		} else {
+			select {
+			case err := <-overflow:
+				t.Fatalf("overflowing call completed with policy %v: %v", policy, err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		close(release)
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, <-done)
+		}
+		switch policy {
+		case OverloadQueue:
+			assert.Nil(t, <-overflow)
+		case OverloadDrop:
+			e, ok := (<-overflow).(*TransportError)
+			assert.True(t, ok && e.Timeout())
+		}
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+}
+
+func TestWorkerPoolCallTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	s := NewTCPServer(0x20000001, 1)
+	s.SetCallTimeout(20 * time.Millisecond)
+	s.SetWorkerPool(&WorkerPoolConfig{Workers: 1, QueueDepth: 1, Overload: OverloadReject})
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		started <- struct{}{}
+		<-release // ignores the timeout
+		return nil
+	})
+	s.Register(2, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	client := func() *Client {
+		conn, err := Pipe(s, nil)
+		assert.Nil(t, err)
+		return NewClientFromConn(conn, Tcp, 0x20000001, 1)
+	}
+
+	// The call times out, but its procedure keeps the worker
+	if e, ok := client().Call(1, uint32(0), nil).(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(SystemErr), e.Stat)
+	}
+	<-started
+
+	// The next call waits in the queue, and the one after is rejected
+	var reply uint32
+	queued := make(chan error, 1)
+	go func() {
+		queued <- client().Call(2, uint32(2), &reply)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, queued, 0)
+	if e, ok := client().Call(2, uint32(3), nil).(*RPCAcceptError); assert.True(t, ok) {
+		assert.Equal(t, AcceptType(SystemErr), e.Stat)
+	}
+
+	close(release)
+	assert.Nil(t, <-queued)
+	assert.Equal(t, uint32(2), reply)
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
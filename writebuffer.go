@@ -0,0 +1,89 @@
+package sunrpc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+)
+
+// WriteBufferConfig configures the buffering of replies on the connections of a TCPServer.
+//
+// Replies are written to a per-connection buffer, which is flushed as soon as the connection
+// has no more calls being processed; while other calls are pending (e.g. with pipelining
+// clients and a worker pool), replies are batched for at most FlushDelay. When the buffer is
+// full, it is written to the socket, blocking until the kernel accepts the data: buffering
+// is thus bounded by Size, and slow clients apply backpressure to the server.
+type WriteBufferConfig struct {
+	Size       int           // size of the buffer of each connection (default: 32 KB)
+	FlushDelay time.Duration // maximum time replies wait for a batch to complete (default: 1 ms)
+}
+
+// SetWriteBuffering enables reply buffering on the connections of the server. It must be
+// called before Serve. A nil config disables buffering (which is the default): each reply
+// is then written to the socket as soon as it is ready.
+func (s *TCPServer) SetWriteBuffering(cfg *WriteBufferConfig) {
+	if cfg == nil {
+		s.wbuf = nil
+		return
+	}
+
+	c := *cfg
+	if c.Size <= 0 {
+		c.Size = 32 * 1024
+	}
+	if c.FlushDelay <= 0 {
+		c.FlushDelay = time.Millisecond
+	}
+	s.wbuf = &c
+}
+
+// newConnState creates the state tracking a client connection.
+func (s *TCPServer) newConnState(conn net.Conn) *tcpConnState {
+	state := &tcpConnState{store: newConnStore()}
+	if s.wbuf != nil {
+		state.bw = bufio.NewWriterSize(conn, s.wbuf.Size)
+	}
+	return state
+}
+
+// writer returns the writer replies must be written to. It must be called with wmu held.
+func (state *tcpConnState) writer(conn net.Conn) io.Writer {
+	if state.bw != nil {
+		return state.bw
+	}
+	return conn
+}
+
+// flush writes the buffered replies of a connection to the socket: immediately if now is
+// set, otherwise after the configured delay.
+func (s *TCPServer) flush(conn net.Conn, state *tcpConnState, now bool) {
+	if state.bw == nil {
+		return
+	}
+
+	state.wmu.Lock()
+	defer state.wmu.Unlock()
+
+	if !now {
+		if state.flushTimer == nil && state.bw.Buffered() > 0 {
+			state.flushTimer = time.AfterFunc(s.wbuf.FlushDelay, func() {
+				s.flush(conn, state, true)
+			})
+		}
+		return
+	}
+
+	if state.flushTimer != nil {
+		state.flushTimer.Stop()
+		state.flushTimer = nil
+	}
+	if state.bw.Buffered() == 0 {
+		return
+	}
+	s.armWriteDeadline(conn)
+	if err := state.bw.Flush(); err != nil {
+		s.server.log.Error(err)
+		conn.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCountConn counts the writes to a connection.
+type writeCountConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *writeCountConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *writeCountConn) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+func TestWriteBuffering(t *testing.T) {
+	started, release := make(chan uint32, 4), make(chan struct{})
+	s := NewTCPServer(0x20000001, 1)
+	s.SetWriteBuffering(&WriteBufferConfig{FlushDelay: 50 * time.Millisecond})
+	s.SetWorkerPool(&WorkerPoolConfig{Workers: 4})
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		started <- arg
+		<-release
+		*reply = arg
+		return nil
+	})
+	s.Register(2, func(arg uint32, reply *uint32) error {
+		*reply = arg
+		return nil
+	})
+	client, server := net.Pipe()
+	conn := &writeCountConn{Conn: server}
+	go s.ServeConn(conn)
+
+	pipeline := func(proc uint32, args ...uint32) {
+		var calls bytes.Buffer
+		for _, arg := range args {
+			var msg bytes.Buffer
+			call := NewProcedureCall(0x20000001, 1, proc)
+			call.Header.Xid = arg
+			_, err := xdr.Marshal(&msg, call)
+			assert.Nil(t, err)
+			_, err = xdr.Marshal(&msg, arg)
+			assert.Nil(t, err)
+			assert.Nil(t, WriteTCPReplyMessage(&calls, msg.Bytes()))
+		}
+		go client.Write(calls.Bytes())
+	}
+	readReplies := func(n int) []uint32 {
+		var xids []uint32
+		for i := 0; i < n; i++ {
+			record, err := ReadRecord(client)
+			if !assert.Nil(t, err) {
+				break
+			}
+			reply, _, err := DecodeReplyBody(record.Bytes())
+			assert.Nil(t, err)
+			xids = append(xids, reply.Header.Xid)
+		}
+		return xids
+	}
+
+	// The replies of pipelined calls are written at once, when the last one is ready
+	pipeline(1, 1, 2, 3)
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	close(release)
+	assert.Len(t, readReplies(3), 3)
+	assert.Equal(t, 1, conn.count())
+
+	// While a call is pending, the other replies wait for at most FlushDelay
+	release = make(chan struct{})
+	pipeline(1, 4)
+	<-started
+	start := time.Now()
+	pipeline(2, 5)
+	assert.Equal(t, []uint32{5}, readReplies(1))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, 2, conn.count())
+
+	close(release)
+	assert.Equal(t, []uint32{4}, readReplies(1))
+	client.Close()
+	assert.Nil(t, s.Shutdown(context.Background()))
+}